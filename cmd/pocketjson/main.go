@@ -34,8 +34,10 @@ func main() {
 		log.Fatalf("failed to create data directory: %v", err)
 	}
 
-	// SQLite optimizations: WAL mode for concurrency, 32MB cache, 5s busy timeout
-	dbPath := filepath.Join(cfg.DataDir, "jsonstore.db") + "?_fk=1&_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL&cache_size=-32000"
+	// SQLite optimizations: WAL mode for concurrency, 32MB cache, 5s busy timeout.
+	// Transactions take the write lock when they begin, so that a transaction
+	// that reads before it writes waits for other writers instead of failing.
+	dbPath := filepath.Join(cfg.DataDir, "jsonstore.db") + "?_fk=1&_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL&cache_size=-32000&_txlock=immediate"
 	db, err := storage.NewDB(dbPath)
 	if err != nil {
 		log.Fatalf("failed to initialize database: %v", err)
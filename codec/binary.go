@@ -0,0 +1,264 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// CBOR and MessagePack can hold values JSON has no type for. They are
+// converted to JSON by these rules, the same for both formats:
+//
+//   - Byte strings become base64url text without padding (RFC 8949, 6.1).
+//   - Map keys that are integers become their decimal text. Other non-text
+//     keys, and keys that collide once converted (1 and "1"), are rejected.
+//   - Timestamps (CBOR tags 0 and 1, the MessagePack timestamp extension)
+//     become RFC 3339 text in UTC.
+//   - Big integers (CBOR tags 2 and 3) become JSON numbers with all their
+//     digits.
+//   - Other CBOR tags are dropped and their content converted.
+//   - CBOR undefined becomes null.
+//   - NaN and infinities, other CBOR simple values and other MessagePack
+//     extensions are rejected.
+//
+// Converting JSON back writes integers as integers and other numbers as
+// floats in their shortest exact form. Map keys are sorted, so the output is
+// deterministic. Text that was a byte string stays text.
+
+var (
+	cborDecoder cbor.DecMode
+	cborEncoder cbor.EncMode
+)
+
+func init() {
+	var err error
+	cborDecoder, err = cbor.DecOptions{
+		DupMapKey: cbor.DupMapKeyEnforcedAPF,
+		TimeTag:   cbor.DecTagOptional,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	if cborEncoder, err = cbor.CoreDetEncOptions().EncMode(); err != nil {
+		panic(err)
+	}
+}
+
+// CBORToJSON converts a CBOR data item to JSON.
+func CBORToJSON(data []byte) ([]byte, error) {
+	var value interface{}
+	if err := cborDecoder.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	converted, err := jsonValue(value, "")
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(converted)
+}
+
+// MsgPackToJSON converts a MessagePack object to JSON.
+func MsgPackToJSON(data []byte) ([]byte, error) {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetMapDecoder(decodeMsgPackMap)
+	value, err := decoder.DecodeInterface()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.DecodeInterface(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("extraneous data after the first object")
+	}
+	converted, err := jsonValue(value, "")
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(converted)
+}
+
+// decodeMsgPackMap decodes a MessagePack map with keys of any type, for
+// jsonKey to convert. Keys Go cannot hash, such as bin, and keys that occur
+// twice are rejected here.
+func decodeMsgPackMap(d *msgpack.Decoder) (interface{}, error) {
+	n, err := d.DecodeMapLen()
+	if err != nil || n == -1 {
+		return nil, err
+	}
+	m := make(map[interface{}]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := d.DecodeInterface()
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case []byte:
+			return nil, fmt.Errorf("bin map keys are not supported, only text and integer keys are")
+		case []interface{}, map[interface{}]interface{}:
+			return nil, fmt.Errorf("map keys of type %T are not supported, only text and integer keys are", key)
+		}
+		if _, ok := m[key]; ok {
+			return nil, fmt.Errorf("map key %v occurs more than once", key)
+		}
+		if m[key], err = d.DecodeInterface(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// JSONToCBOR converts a JSON document to deterministically encoded CBOR
+// (RFC 8949, 4.2).
+func JSONToCBOR(data []byte) ([]byte, error) {
+	value, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return cborEncoder.Marshal(binaryValue(value))
+}
+
+// JSONToMsgPack converts a JSON document to MessagePack with sorted map
+// keys and the smallest encoding of each number.
+func JSONToMsgPack(data []byte) ([]byte, error) {
+	value, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	encoder := msgpack.NewEncoder(&out)
+	encoder.SetSortMapKeys(true)
+	encoder.UseCompactInts(true)
+	encoder.UseCompactFloats(true)
+	if err := encoder.Encode(binaryValue(value)); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// jsonValue converts a decoded CBOR or MessagePack value to one that
+// encoding/json represents by the rules above. path locates the value in
+// error messages.
+func jsonValue(value interface{}, path string) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, bool, string,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64:
+		return v, nil
+	case float32:
+		return jsonFloat(float64(v), path)
+	case float64:
+		return jsonFloat(v, path)
+	case []byte:
+		return base64.RawURLEncoding.EncodeToString(v), nil
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano), nil
+	case big.Int:
+		return json.Number(v.String()), nil
+	case *big.Int:
+		return json.Number(v.String()), nil
+	case cbor.Tag:
+		return jsonValue(v.Content, path)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, element := range v {
+			var err error
+			if out[i], err = jsonValue(element, path+"/"+strconv.Itoa(i)); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, element := range v {
+			var err error
+			if out[key], err = jsonValue(element, path+"/"+key); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, element := range v {
+			name, err := jsonKey(key, path)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := out[name]; ok {
+				return nil, fmt.Errorf("at %s: key %q occurs more than once after converting keys to text", locate(path), name)
+			}
+			if out[name], err = jsonValue(element, path+"/"+name); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("at %s: %T has no JSON representation", locate(path), value)
+}
+
+// jsonKey converts a map key to text. Only text and integer keys are
+// accepted.
+func jsonKey(key interface{}, path string) (string, error) {
+	switch k := key.(type) {
+	case string:
+		return k, nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(k), nil
+	case cbor.ByteString, []byte:
+		return "", fmt.Errorf("at %s: byte string map keys are not supported, only text and integer keys are", locate(path))
+	}
+	return "", fmt.Errorf("at %s: map keys of type %T are not supported, only text and integer keys are", locate(path), key)
+}
+
+func jsonFloat(f float64, path string) (interface{}, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("at %s: JSON has no NaN or infinity", locate(path))
+	}
+	return f, nil
+}
+
+// locate names the position of a value in error messages.
+func locate(path string) string {
+	if path == "" {
+		return "the top level"
+	}
+	return path
+}
+
+// binaryValue prepares a decoded JSON document for encoding: numbers
+// become integers where they are whole and fit, floats otherwise. Floats a
+// float32 holds exactly are passed as one, as the MessagePack encoder does
+// not shorten them by itself.
+func binaryValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return u
+		}
+		f, _ := v.Float64()
+		if float64(float32(f)) == f {
+			return float32(f)
+		}
+		return f
+	case []interface{}:
+		for i, element := range v {
+			v[i] = binaryValue(element)
+		}
+	case map[string]interface{}:
+		for key, element := range v {
+			v[key] = binaryValue(element)
+		}
+	}
+	return value
+}
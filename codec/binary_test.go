@@ -0,0 +1,146 @@
+package codec
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// hexBytes decodes hex written with optional spaces between bytes.
+func hexBytes(t *testing.T, s string) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("invalid hex %q: %v", s, err)
+	}
+	return data
+}
+
+func TestCBORToJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"byte string", "a1 6162 42fbff", `{"b":"-_8"}`},
+		{"integer keys", "a2 01 6161 21 6162", `{"-2":"b","1":"a"}`},
+		{"epoch timestamp", "c1 1a6553f100", `"2023-11-14T22:13:20Z"`},
+		{"text timestamp", "c0 7819" + hex.EncodeToString([]byte("2023-11-14T23:13:20+01:00")), `"2023-11-14T22:13:20Z"`},
+		{"positive bignum", "c2 49 010000000000000000", `18446744073709551616`},
+		{"negative bignum", "c3 49 010000000000000000", `-18446744073709551617`},
+		{"other tag", "d820 63612f62", `"a/b"`},
+		{"undefined", "81 f7", `[null]`},
+		{"float", "82 f93e00 fb3ff199999999999a", `[1.5,1.1]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CBORToJSON(hexBytes(t, tt.input))
+			if err != nil {
+				t.Fatalf("CBORToJSON(%s): %v", tt.input, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("CBORToJSON(%s) = %s, want %s", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCBORToJSONRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"colliding keys", "a2 01 6161 6131 6162"},
+		{"byte string key", "a1 4100 01"},
+		{"float key", "a1 f93c00 01"},
+		{"duplicate keys", "a2 6161 01 6161 02"},
+		{"NaN", "81 f97e00"},
+		{"infinity", "81 f97c00"},
+		{"simple value", "81 f0"},
+		{"truncated", "82 01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := CBORToJSON(hexBytes(t, tt.input)); err == nil {
+				t.Errorf("CBORToJSON(%s) = %s, want an error", tt.input, got)
+			}
+		})
+	}
+}
+
+func TestMsgPackToJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"bin", "81 a162 c402fbff", `{"b":"-_8"}`},
+		{"integer keys", "82 01 a161 ff a162", `{"-1":"b","1":"a"}`},
+		{"timestamp", "d6ff 6553f100", `"2023-11-14T22:13:20Z"`},
+		{"numbers", "94 cf ffffffffffffffff d0 80 ca 3fc00000 c0", `[18446744073709551615,-128,1.5,null]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MsgPackToJSON(hexBytes(t, tt.input))
+			if err != nil {
+				t.Fatalf("MsgPackToJSON(%s): %v", tt.input, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("MsgPackToJSON(%s) = %s, want %s", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMsgPackToJSONRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"colliding keys", "82 01 a161 a131 a162"},
+		{"bin key", "81 c40100 01"},
+		{"array key", "81 9101 01"},
+		{"duplicate keys", "82 a161 01 a161 02"},
+		{"other extension", "d405 00"},
+		{"NaN", "91 cb 7ff8000000000000"},
+		{"trailing data", "80 80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := MsgPackToJSON(hexBytes(t, tt.input)); err == nil {
+				t.Errorf("MsgPackToJSON(%s) = %s, want an error", tt.input, got)
+			}
+		})
+	}
+}
+
+func TestJSONToBinary(t *testing.T) {
+	const document = `{"b":[1,-2,1.5,1e300,18446744073709551615],"a":"x"}`
+
+	// Keys are sorted, whole numbers are integers and floats take their
+	// shortest exact encoding.
+	cbor, err := JSONToCBOR([]byte(document))
+	if err != nil {
+		t.Fatalf("JSONToCBOR: %v", err)
+	}
+	if want := "a2 6161 6178 6162 85 01 21 f93e00 fb7e37e43c8800759c 1bffffffffffffffff"; hex.EncodeToString(cbor) != strings.ReplaceAll(want, " ", "") {
+		t.Errorf("JSONToCBOR = %x, want %s", cbor, want)
+	}
+	msgpack, err := JSONToMsgPack([]byte(document))
+	if err != nil {
+		t.Fatalf("JSONToMsgPack: %v", err)
+	}
+	if want := "82 a161 a178 a162 95 01 fe ca3fc00000 cb7e37e43c8800759c cfffffffffffffffff"; hex.EncodeToString(msgpack) != strings.ReplaceAll(want, " ", "") {
+		t.Errorf("JSONToMsgPack = %x, want %s", msgpack, want)
+	}
+
+	// Converting back gives the same document.
+	const want = `{"a":"x","b":[1,-2,1.5,1e+300,18446744073709551615]}`
+	if got, err := CBORToJSON(cbor); err != nil || string(got) != want {
+		t.Errorf("CBOR round trip = %s, %v; want %s", got, err, want)
+	}
+	if got, err := MsgPackToJSON(msgpack); err != nil || string(got) != want {
+		t.Errorf("MessagePack round trip = %s, %v; want %s", got, err, want)
+	}
+}
@@ -0,0 +1,48 @@
+// Package codec converts between JSON and the other formats documents can
+// be sent or served in.
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// ShapeError reports a document that cannot be represented in a format,
+// such as an object asked for as CSV.
+type ShapeError struct {
+	Format  string
+	Message string
+}
+
+func (e *ShapeError) Error() string {
+	return fmt.Sprintf("%s needs %s", e.Format, e.Message)
+}
+
+// decode parses a JSON document, keeping numbers as written.
+func decode(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// typeName describes a decoded JSON value in error messages.
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case json.Number:
+		return "a number"
+	case bool:
+		return "a boolean"
+	}
+	return "null"
+}
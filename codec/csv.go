@@ -0,0 +1,106 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// CSVOptions controls how an array of objects becomes CSV.
+type CSVOptions struct {
+	// Columns selects and orders the columns. By default every key that
+	// occurs is a column, in the order the keys first appear.
+	Columns []string
+	// Flatten turns nested objects into columns named by their dotted path
+	// (address.city). Otherwise they are written as JSON text, as arrays
+	// always are.
+	Flatten bool
+}
+
+// ToCSV renders a document that is an array of objects as CSV with a
+// header row. Missing and null values are empty cells.
+func ToCSV(data []byte, options CSVOptions) ([]byte, error) {
+	value, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	elements, ok := value.([]interface{})
+	if !ok {
+		return nil, &ShapeError{"csv", "an array of objects, not " + typeName(value)}
+	}
+
+	rows := make([]map[string]string, len(elements))
+	var columns []string
+	seen := map[string]bool{}
+	for i, element := range elements {
+		object, ok := element.(map[string]interface{})
+		if !ok {
+			return nil, &ShapeError{"csv", fmt.Sprintf("an array of objects, but element %d is %s", i, typeName(element))}
+		}
+		rows[i] = map[string]string{}
+		for _, key := range flattenObject(rows[i], "", object, options.Flatten) {
+			if !seen[key] {
+				seen[key] = true
+				columns = append(columns, key)
+			}
+		}
+	}
+	if len(options.Columns) > 0 {
+		columns = options.Columns
+	}
+
+	var out bytes.Buffer
+	writer := csv.NewWriter(&out)
+	writer.Write(columns)
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, column := range columns {
+			record[i] = row[column]
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	return out.Bytes(), writer.Error()
+}
+
+// flattenObject writes the cells of object into row and returns their
+// column names in key order.
+func flattenObject(row map[string]string, prefix string, object map[string]interface{}, flatten bool) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var columns []string
+	for _, key := range keys {
+		column := prefix + key
+		switch value := object[key].(type) {
+		case map[string]interface{}:
+			if flatten {
+				columns = append(columns, flattenObject(row, column+".", value, flatten)...)
+				continue
+			}
+			row[column] = compactText(value)
+		case []interface{}:
+			row[column] = compactText(value)
+		case string:
+			row[column] = value
+		case json.Number:
+			row[column] = value.String()
+		case bool:
+			row[column] = fmt.Sprint(value)
+		case nil:
+			row[column] = ""
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+func compactText(value interface{}) string {
+	text, _ := json.Marshal(value)
+	return string(text)
+}
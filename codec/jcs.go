@@ -0,0 +1,174 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Canonicalize returns the JSON Canonicalization Scheme (RFC 8785) form of
+// a JSON document: no whitespace, object members sorted by the UTF-16 code
+// units of their names, numbers written as ECMAScript does, and strings
+// escaped only where JSON requires it. Equal documents have equal
+// canonical forms, so the result can be hashed or signed.
+func Canonicalize(data []byte) ([]byte, error) {
+	value, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := canonicalValue(&out, value); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func canonicalValue(out *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		out.WriteString("null")
+	case bool:
+		out.WriteString(strconv.FormatBool(v))
+	case string:
+		canonicalString(out, v)
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return fmt.Errorf("number %s is out of range", v)
+		}
+		out.WriteString(ecmaNumber(f))
+	case []interface{}:
+		out.WriteByte('[')
+		for i, element := range v {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := canonicalValue(out, element); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return lessUTF16(keys[i], keys[j]) })
+
+		out.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			canonicalString(out, key)
+			out.WriteByte(':')
+			if err := canonicalValue(out, v[key]); err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+	default:
+		return fmt.Errorf("unexpected JSON value %T", value)
+	}
+	return nil
+}
+
+// canonicalString escapes quotes, backslashes and control characters, the
+// latter with the short forms where JSON has them. Everything else is
+// written as it is.
+func canonicalString(out *bytes.Buffer, s string) {
+	out.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			out.WriteString(`\"`)
+		case '\\':
+			out.WriteString(`\\`)
+		case '\b':
+			out.WriteString(`\b`)
+		case '\f':
+			out.WriteString(`\f`)
+		case '\n':
+			out.WriteString(`\n`)
+		case '\r':
+			out.WriteString(`\r`)
+		case '\t':
+			out.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(out, `\u%04x`, r)
+			} else {
+				out.WriteRune(r)
+			}
+		}
+	}
+	out.WriteByte('"')
+}
+
+// lessUTF16 orders strings by their UTF-16 code units, which differs from
+// Go's byte order for characters outside the Basic Multilingual Plane.
+func lessUTF16(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
+
+// ecmaNumber formats a double the way ECMAScript's Number.prototype.toString
+// does: the shortest digits that round-trip, in plain notation for
+// exponents from -7 to 20 and in exponential notation otherwise.
+func ecmaNumber(f float64) string {
+	if f == 0 {
+		return "0"
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		// JSON cannot hold these, so decoding never produces them.
+		return "null"
+	}
+
+	sign := ""
+	if f < 0 {
+		sign, f = "-", -f
+	}
+
+	// Shortest round-trip digits and exponent, as d.ddde±x.
+	mantissa, exp, _ := strings.Cut(strconv.FormatFloat(f, 'e', -1, 64), "e")
+	digits := strings.Replace(mantissa, ".", "", 1)
+	e, _ := strconv.Atoi(exp)
+	k := len(digits)
+	n := e + 1 // the value is 0.digits × 10^n
+
+	switch {
+	case k <= n && n <= 21:
+		return sign + digits + strings.Repeat("0", n-k)
+	case 0 < n && n <= 21:
+		return sign + digits[:n] + "." + digits[n:]
+	case -6 < n && n <= 0:
+		return sign + "0." + strings.Repeat("0", -n) + digits
+	}
+
+	expSign := "+"
+	if n-1 < 0 {
+		expSign = "-"
+	}
+	exponent := strconv.Itoa(abs(n - 1))
+	if k == 1 {
+		return sign + digits + "e" + expSign + exponent
+	}
+	return sign + digits[:1] + "." + digits[1:] + "e" + expSign + exponent
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,73 @@
+package codec
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"whitespace", "{ \"b\" : [ 1 , true , null ] ,\n \"a\" : \"x\" }", `{"a":"x","b":[1,true,null]}`},
+		{"nested keys", `{"b":{"z":1,"y":2},"a":[{"d":1,"c":2}]}`, `{"a":[{"c":2,"d":1}],"b":{"y":2,"z":1}}`},
+		// U+FB33 sorts after U+1F600 in UTF-8 but before its surrogate
+		// pair in UTF-16.
+		{"utf-16 key order", `{"\ufb33":1,"\ud83d\ude00":2,"\u20ac":3,"\u00f6":4,"1":5,"\r":6}`, "{\"\\r\":6,\"1\":5,\"\u00f6\":4,\"\u20ac\":3,\"\U0001f600\":2,\"\ufb33\":1}"},
+		{"numbers", `[1.0,1e2,-0.0,0.000001,1e-7,1e21,1e20,-1.5E+3]`, `[1,100,0,0.000001,1e-7,1e+21,100000000000000000000,-1500]`},
+		{"escapes", `"\u0001\b\f\n\r\t\"\\\/\u001f"`, `"\u0001\b\f\n\r\t\"\\/\u001f"`},
+		{"no html escaping", `"<&>"`, `"<&>"`},
+		{"non-ascii kept", `"\u00e9\u2028"`, "\"\u00e9\u2028\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Canonicalize([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("Canonicalize(%s): %v", tt.input, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Canonicalize(%s) = %s, want %s", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalizeRejectsOutOfRangeNumbers(t *testing.T) {
+	for _, input := range []string{`{"a":1e400}`, `[-1e309]`} {
+		if got, err := Canonicalize([]byte(input)); err == nil {
+			t.Errorf("Canonicalize(%s) = %s, want an error", input, got)
+		}
+	}
+}
+
+func TestEcmaNumber(t *testing.T) {
+	tests := []struct {
+		input float64
+		want  string
+	}{
+		{0, "0"},
+		{math.Copysign(0, -1), "0"},
+		{1, "1"},
+		{-1, "-1"},
+		{0.1, "0.1"},
+		{123.456, "123.456"},
+		{1e20, "100000000000000000000"},
+		{123456789012345680000, "123456789012345680000"},
+		{1e21, "1e+21"},
+		{1.5e21, "1.5e+21"},
+		{0.000001, "0.000001"},
+		{0.0000015, "0.0000015"},
+		{1e-7, "1e-7"},
+		{-1.5e-7, "-1.5e-7"},
+		{5e-324, "5e-324"},
+		{math.MaxFloat64, "1.7976931348623157e+308"},
+		{9007199254740993, "9007199254740992"},
+	}
+	for _, tt := range tests {
+		if got := ecmaNumber(tt.input); got != tt.want {
+			t.Errorf("ecmaNumber(%v) = %s, want %s", tt.input, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// StripJSONC turns JSON with comments (JSONC) into plain JSON: line (//)
+// and block (/* */) comments are removed, and so are trailing commas
+// before a closing brace or bracket. Anything else is left untouched, so
+// the result still has to be validated as JSON.
+func StripJSONC(data []byte) ([]byte, error) {
+	stripped, err := stripComments(data)
+	if err != nil {
+		return nil, err
+	}
+	return stripTrailingCommas(stripped), nil
+}
+
+// stripComments replaces comments outside of strings with a space, so that
+// tokens on either side of a comment stay apart.
+func stripComments(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '"':
+			end, err := stringEnd(data, i)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, data[i:end]...)
+			i = end - 1
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			end := bytes.IndexByte(data[i:], '\n')
+			if end < 0 {
+				return append(out, ' '), nil
+			}
+			out = append(out, ' ')
+			i += end - 1
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment at offset %d", i)
+			}
+			out = append(out, ' ')
+			i += end + 3
+		default:
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// stripTrailingCommas drops commas that are followed, after optional
+// whitespace, by a closing brace or bracket. Comments must already be gone.
+func stripTrailingCommas(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if c == '"' {
+			// stripComments has already checked that strings end.
+			end, _ := stringEnd(data, i)
+			out = append(out, data[i:end]...)
+			i = end - 1
+			continue
+		}
+		if c == ',' {
+			next := i + 1
+			for next < len(data) && isSpace(data[next]) {
+				next++
+			}
+			if next < len(data) && (data[next] == '}' || data[next] == ']') {
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// stringEnd returns the offset just past the string starting at the quote
+// at start.
+func stringEnd(data []byte, start int) (int, error) {
+	for i := start + 1; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string at offset %d", start)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
@@ -0,0 +1,46 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// DecodeNDJSON splits newline-delimited JSON into its values. Blank lines
+// are skipped; any other line has to be one complete JSON value.
+func DecodeNDJSON(data []byte) ([]json.RawMessage, error) {
+	values := []json.RawMessage{}
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			return nil, fmt.Errorf("line %d is not valid JSON", n+1)
+		}
+		values = append(values, json.RawMessage(line))
+	}
+	return values, nil
+}
+
+// ToNDJSON renders a document that is an array as newline-delimited JSON,
+// one element per line.
+func ToNDJSON(data []byte) ([]byte, error) {
+	var elements []json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		value, decodeErr := decode(data)
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		return nil, &ShapeError{"ndjson", "an array, not " + typeName(value)}
+	}
+
+	var out bytes.Buffer
+	for _, element := range elements {
+		if err := json.Compact(&out, element); err != nil {
+			return nil, err
+		}
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), nil
+}
@@ -7,26 +7,58 @@ import (
 )
 
 type Config struct {
-	MasterAPIKey      string
-	DefaultMaxSize    int
-	AuthenticatedSize int
-	DefaultExpiry     time.Duration
-	RequestLimit      int
-	CORSOrigins       string
-	Port              string
-	DataDir           string
+	MasterAPIKey       string
+	DefaultMaxSize     int
+	AuthenticatedSize  int
+	DefaultExpiry      time.Duration
+	RequestLimit       int
+	CORSOrigins        string
+	Port               string
+	DataDir            string
+	KeyRotationGrace   time.Duration
+	AuditRetention     time.Duration
+	ChangesRetention   time.Duration
+	SignedURLMaxTTL    time.Duration
+	WebhookMaxAttempts int
+	StreamsPerIP       int
+	StreamsPerKey      int
+	BatchMaxOperations int
+	BatchMaxBytes      int
+	CollectionMaxItems int
+	CollectionMaxBytes int
+	QueueMaxMessages   int
+	QueueMaxReceives   int
+	QueueRetention     time.Duration
+	BucketMaxBody      int
+	BucketMaxRecords   int
 }
 
 func Load() *Config {
 	return &Config{
-		MasterAPIKey:      getEnvStr("MASTER_API_KEY", ""),
-		DefaultMaxSize:    getEnvInt("DEFAULT_MAX_SIZE", 100*1024),
-		AuthenticatedSize: getEnvInt("AUTHENTICATED_MAX_SIZE", 1024*1024),
-		DefaultExpiry:     time.Duration(getEnvInt("DEFAULT_EXPIRY_HOURS", 48)) * time.Hour,
-		RequestLimit:      getEnvInt("REQUEST_LIMIT", 15),
-		CORSOrigins:       getEnvStr("CORS_ALLOWED_ORIGINS", "*"),
-		Port:              getEnvStr("PORT", "9819"),
-		DataDir:           getEnvStr("DATA_DIR", "data"),
+		MasterAPIKey:       getEnvStr("MASTER_API_KEY", ""),
+		DefaultMaxSize:     getEnvInt("DEFAULT_MAX_SIZE", 100*1024),
+		AuthenticatedSize:  getEnvInt("AUTHENTICATED_MAX_SIZE", 1024*1024),
+		DefaultExpiry:      time.Duration(getEnvInt("DEFAULT_EXPIRY_HOURS", 48)) * time.Hour,
+		RequestLimit:       getEnvInt("REQUEST_LIMIT", 15),
+		CORSOrigins:        getEnvStr("CORS_ALLOWED_ORIGINS", "*"),
+		Port:               getEnvStr("PORT", "9819"),
+		DataDir:            getEnvStr("DATA_DIR", "data"),
+		KeyRotationGrace:   time.Duration(getEnvInt("KEY_ROTATION_GRACE_HOURS", 24)) * time.Hour,
+		AuditRetention:     time.Duration(getEnvInt("AUDIT_RETENTION_DAYS", 90)) * 24 * time.Hour,
+		ChangesRetention:   time.Duration(getEnvInt("CHANGES_RETENTION_DAYS", 30)) * 24 * time.Hour,
+		SignedURLMaxTTL:    time.Duration(getEnvInt("SIGNED_URL_MAX_TTL_HOURS", 168)) * time.Hour,
+		WebhookMaxAttempts: getEnvInt("WEBHOOK_MAX_ATTEMPTS", 8),
+		StreamsPerIP:       getEnvInt("STREAMS_PER_IP", 5),
+		StreamsPerKey:      getEnvInt("STREAMS_PER_KEY", 50),
+		BatchMaxOperations: getEnvInt("BATCH_MAX_OPERATIONS", 100),
+		BatchMaxBytes:      getEnvInt("BATCH_MAX_BYTES", 10*1024*1024),
+		CollectionMaxItems: getEnvInt("COLLECTION_MAX_ITEMS", 10000),
+		CollectionMaxBytes: getEnvInt("COLLECTION_MAX_BYTES", 10*1024*1024),
+		QueueMaxMessages:   getEnvInt("QUEUE_MAX_MESSAGES", 100000),
+		QueueMaxReceives:   getEnvInt("QUEUE_MAX_RECEIVES", 5),
+		QueueRetention:     time.Duration(getEnvInt("QUEUE_RETENTION_HOURS", 96)) * time.Hour,
+		BucketMaxBody:      getEnvInt("BUCKET_MAX_BODY_BYTES", 1024*1024),
+		BucketMaxRecords:   getEnvInt("BUCKET_MAX_RECORDS", 500),
 	}
 }
 
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSignedURLCannotManageSharing(t *testing.T) {
+	ts := newTestServer(t)
+	owner, _ := ts.createTenantKey(t, nil)
+	_, otherID := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, owner, "shared", "", map[string]interface{}{"a": 1})
+
+	var signed struct {
+		URL string `json:"url"`
+	}
+	if status := ts.do(t, http.MethodPost, "/"+id+"/sign", owner, map[string]interface{}{"method": "PUT"}, &signed); status != http.StatusOK {
+		t.Fatalf("sign: status %d", status)
+	}
+	signedURL, err := url.Parse(signed.URL)
+	if err != nil {
+		t.Fatalf("invalid signed url %q: %v", signed.URL, err)
+	}
+	query := "?" + signedURL.RawQuery
+
+	// The URL works for the route it was signed for.
+	if status := ts.do(t, http.MethodPut, "/"+id+query, "", map[string]interface{}{"a": 2}, nil); status != http.StatusOK {
+		t.Errorf("signed PUT: status %d, want 200", status)
+	}
+
+	// Replayed against the ACL routes it grants nothing.
+	if status := ts.do(t, http.MethodPut, "/"+id+"/acl/"+otherID+query, "", map[string]interface{}{"access": "read-write"}, nil); status == http.StatusOK {
+		t.Errorf("signed grant: status %d, want it refused", status)
+	}
+	if status := ts.do(t, http.MethodDelete, "/"+id+"/acl/"+otherID+query, "", nil, nil); status == http.StatusOK || status == http.StatusNoContent {
+		t.Errorf("signed revoke: status %d, want it refused", status)
+	}
+
+	var grants struct {
+		Grants []interface{} `json:"grants"`
+	}
+	if status := ts.do(t, http.MethodGet, "/"+id+"/acl", owner, nil, &grants); status != http.StatusOK {
+		t.Fatalf("list grants: status %d", status)
+	}
+	if len(grants.Grants) != 0 {
+		t.Errorf("grants = %v, want none", grants.Grants)
+	}
+}
+
+func TestEditTokenCannotManageSharing(t *testing.T) {
+	ts := newTestServer(t)
+	_, otherID := ts.createTenantKey(t, nil)
+
+	var created struct {
+		ID        string `json:"id"`
+		EditToken string `json:"edit_token"`
+	}
+	if status := ts.do(t, http.MethodPost, "/", "", map[string]interface{}{"a": 1}, &created); status != http.StatusOK && status != http.StatusCreated {
+		t.Fatalf("create guest document: status %d", status)
+	}
+
+	requests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodGet, "/" + created.ID + "/acl", ""},
+		{http.MethodPut, "/" + created.ID + "/acl/" + otherID, `{"access":"read-write"}`},
+		{http.MethodDelete, "/" + created.ID + "/acl/" + otherID, ""},
+	}
+	for _, tt := range requests {
+		req, _ := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Edit-Token", created.EditToken)
+		if status := send(t, req, nil); status != http.StatusForbidden {
+			t.Errorf("%s %s: status %d, want 403", tt.method, tt.path, status)
+		}
+	}
+}
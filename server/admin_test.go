@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCreateApiKeyInheritsRestrictions(t *testing.T) {
+	ts := newTestServer(t)
+	expiresAt := time.Now().Add(2 * time.Hour).Truncate(time.Second).UTC()
+	limited, _ := ts.createKey(t, testMasterKey, map[string]interface{}{
+		"scopes":     []string{"documents:read", "keys:manage"},
+		"id_prefix":  "team-",
+		"expires_at": expiresAt,
+	})
+
+	var created struct {
+		Scopes    []string `json:"scopes"`
+		IDPrefix  string   `json:"id_prefix"`
+		ExpiresAt string   `json:"expires_at"`
+	}
+	if status := ts.do(t, http.MethodPost, "/admin/keys", limited, map[string]interface{}{}, &created); status != http.StatusOK {
+		t.Fatalf("status %d, want 200", status)
+	}
+	if len(created.Scopes) != 2 || created.Scopes[0] != "documents:read" || created.Scopes[1] != "keys:manage" {
+		t.Errorf("scopes = %v, want the creator's", created.Scopes)
+	}
+	if created.IDPrefix != "team-" {
+		t.Errorf("id_prefix = %q, want %q", created.IDPrefix, "team-")
+	}
+	if created.ExpiresAt != expiresAt.Format(time.RFC3339) {
+		t.Errorf("expires_at = %q, want %q", created.ExpiresAt, expiresAt.Format(time.RFC3339))
+	}
+}
+
+func TestCreateApiKeyCannotWidenRestrictions(t *testing.T) {
+	ts := newTestServer(t)
+	expiresAt := time.Now().Add(2 * time.Hour)
+	limited, _ := ts.createKey(t, testMasterKey, map[string]interface{}{
+		"scopes":     []string{"documents:read", "keys:manage"},
+		"id_prefix":  "team-",
+		"expires_at": expiresAt,
+	})
+
+	tests := []struct {
+		name    string
+		request map[string]interface{}
+		want    int
+	}{
+		{"narrower prefix", map[string]interface{}{"id_prefix": "team-a"}, http.StatusOK},
+		{"other prefix", map[string]interface{}{"id_prefix": "other"}, http.StatusForbidden},
+		{"earlier expiry", map[string]interface{}{"expires_at": expiresAt.Add(-time.Hour)}, http.StatusOK},
+		{"later expiry", map[string]interface{}{"expires_at": expiresAt.Add(time.Hour)}, http.StatusForbidden},
+		{"more scopes", map[string]interface{}{"scopes": []string{"documents:write"}}, http.StatusForbidden},
+		{"admin", map[string]interface{}{"is_admin": true}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := ts.do(t, http.MethodPost, "/admin/keys", limited, tt.request, nil); status != tt.want {
+				t.Errorf("status %d, want %d", status, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatchApiKeyCannotWidenRestrictions(t *testing.T) {
+	ts := newTestServer(t)
+	expiresAt := time.Now().Add(2 * time.Hour)
+	limited, limitedID := ts.createKey(t, testMasterKey, map[string]interface{}{
+		"scopes":     []string{"documents:read", "keys:manage"},
+		"id_prefix":  "team-",
+		"expires_at": expiresAt,
+	})
+	_, otherID := ts.createKey(t, limited, map[string]interface{}{"id_prefix": "team-a"})
+
+	tests := []struct {
+		name    string
+		keyID   string
+		request map[string]interface{}
+		want    int
+	}{
+		{"own description", limitedID, map[string]interface{}{"description": "mine"}, http.StatusOK},
+		{"clear own prefix", limitedID, map[string]interface{}{"id_prefix": ""}, http.StatusForbidden},
+		{"clear own expiry", limitedID, map[string]interface{}{"expires_at": nil}, http.StatusForbidden},
+		{"extend own expiry", limitedID, map[string]interface{}{"expires_at": expiresAt.Add(time.Hour)}, http.StatusForbidden},
+		{"narrow other prefix", otherID, map[string]interface{}{"id_prefix": "team-b"}, http.StatusOK},
+		{"clear other prefix", otherID, map[string]interface{}{"id_prefix": ""}, http.StatusForbidden},
+		{"widen other prefix", otherID, map[string]interface{}{"id_prefix": "other"}, http.StatusForbidden},
+		{"shorten other expiry", otherID, map[string]interface{}{"expires_at": expiresAt.Add(-time.Hour)}, http.StatusOK},
+		{"clear other expiry", otherID, map[string]interface{}{"expires_at": nil}, http.StatusForbidden},
+		{"extend other expiry", otherID, map[string]interface{}{"expires_at": expiresAt.Add(time.Hour)}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := ts.do(t, http.MethodPatch, "/admin/keys/"+tt.keyID, limited, tt.request, nil); status != tt.want {
+				t.Errorf("status %d, want %d", status, tt.want)
+			}
+		})
+	}
+
+	// Admin keys are not bound by the restrictions.
+	if status := ts.do(t, http.MethodPatch, "/admin/keys/"+limitedID, testMasterKey, map[string]interface{}{"id_prefix": "", "expires_at": nil}, nil); status != http.StatusOK {
+		t.Errorf("admin patch: status %d, want 200", status)
+	}
+}
+
+func TestRotateApiKeyGracePeriod(t *testing.T) {
+	ts := newTestServer(t)
+	original, id := ts.createTenantKey(t, nil)
+	works := func(secret string) bool {
+		return ts.do(t, http.MethodGet, "/changes", secret, nil, nil) == http.StatusOK
+	}
+
+	var rotated struct {
+		Key                  string `json:"key"`
+		PreviousKeyExpiresAt string `json:"previous_key_expires_at"`
+	}
+	rotate := "/admin/keys/" + id + "/rotate"
+	if status := ts.do(t, http.MethodPost, rotate, testMasterKey, map[string]interface{}{"grace_hours": 1}, &rotated); status != http.StatusOK {
+		t.Fatalf("rotate: status %d", status)
+	}
+	if rotated.PreviousKeyExpiresAt == "" || !works(original) || !works(rotated.Key) {
+		t.Fatalf("after rotation: grace until %q, old works %v, new works %v", rotated.PreviousKeyExpiresAt, works(original), works(rotated.Key))
+	}
+
+	// A second rotation would overwrite the secret still in its grace period.
+	if status := ts.do(t, http.MethodPost, rotate, testMasterKey, map[string]interface{}{"grace_hours": 1}, nil); status != http.StatusConflict {
+		t.Errorf("rotate during the grace period: status %d, want 409", status)
+	}
+	if !works(original) || !works(rotated.Key) {
+		t.Errorf("after a refused rotation: old works %v, new works %v, want both", works(original), works(rotated.Key))
+	}
+
+	// grace_hours 0 revokes every old secret at once.
+	second := rotated.Key
+	if status := ts.do(t, http.MethodPost, rotate, testMasterKey, map[string]interface{}{"grace_hours": 0}, &rotated); status != http.StatusOK {
+		t.Fatalf("rotate with grace_hours 0: status %d", status)
+	}
+	if works(original) || works(second) || !works(rotated.Key) {
+		t.Errorf("after revoking: first works %v, second works %v, newest works %v", works(original), works(second), works(rotated.Key))
+	}
+}
+
+func TestRotatedSecretExpires(t *testing.T) {
+	ts := newTestServer(t)
+	original, id := ts.createTenantKey(t, nil)
+	works := func(secret string) bool {
+		return ts.do(t, http.MethodGet, "/changes", secret, nil, nil) == http.StatusOK
+	}
+	if !works(original) {
+		t.Fatal("the new key does not work")
+	}
+
+	// Grace periods are set in hours through the API; shorten one here.
+	if err := ts.store.DB().RotateApiKey(context.Background(), id, "second-secret-0123456789abcdef01", time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("RotateApiKey: %v", err)
+	}
+	ts.store.InvalidateApiKeyCache(id)
+	if !works(original) {
+		t.Error("the old secret stopped working during its grace period")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if works(original) {
+		t.Error("the old secret still works after its grace period")
+	}
+	if !works("second-secret-0123456789abcdef01") {
+		t.Error("the new secret does not work")
+	}
+
+	// Once the grace period is over the key can be rotated again.
+	if status := ts.do(t, http.MethodPost, "/admin/keys/"+id+"/rotate", testMasterKey, map[string]interface{}{"grace_hours": 1}, nil); status != http.StatusOK {
+		t.Errorf("rotate after the grace period: status %d, want 200", status)
+	}
+}
+
+func TestDeleteApiKeyDocuments(t *testing.T) {
+	ts := newTestServer(t)
+	owner, ownerID := ts.createTenantKey(t, map[string]interface{}{
+		"scopes": []string{"documents:read", "documents:write", "documents:delete", "keys:manage"},
+	})
+	_, strangerID := ts.createTenantKey(t, nil)
+
+	deleteKey := func(keyID, documents string) (int, int64) {
+		t.Helper()
+		var deleted struct {
+			Affected int64 `json:"documents_affected"`
+		}
+		status := ts.do(t, http.MethodDelete, "/admin/keys/"+keyID+"?documents="+documents, owner, nil, &deleted)
+		return status, deleted.Affected
+	}
+
+	kept, keptID := ts.createKey(t, owner, nil)
+	keptDoc := ts.createDocument(t, kept, "kept", "", map[string]interface{}{"v": 1})
+	removed, removedID := ts.createKey(t, owner, nil)
+	removedDocs := []string{
+		ts.createDocument(t, removed, "removed-1", "", map[string]interface{}{"v": 1}),
+		ts.createDocument(t, removed, "removed-2", "", map[string]interface{}{"v": 1}),
+	}
+	moved, movedID := ts.createKey(t, owner, nil)
+	movedDoc := ts.createDocument(t, moved, "moved", "visibility=private", map[string]interface{}{"v": 1})
+
+	// Refused requests leave the key and its documents alone.
+	for _, documents := range []string{"purge", "transfer:", "transfer:" + movedID, "transfer:" + strangerID, "transfer:missing"} {
+		if status, _ := deleteKey(movedID, documents); status != http.StatusBadRequest {
+			t.Errorf("documents=%s: status %d, want 400", documents, status)
+		}
+	}
+	if status := ts.do(t, http.MethodGet, "/"+movedDoc, moved, nil, nil); status != http.StatusOK {
+		t.Fatalf("key after refused deletions: status %d", status)
+	}
+	if status, _ := deleteKey("missing", "keep"); status != http.StatusNotFound {
+		t.Errorf("missing key: status %d, want 404", status)
+	}
+
+	if status, affected := deleteKey(keptID, "keep"); status != http.StatusOK || affected != 1 {
+		t.Fatalf("keep: status %d, %d affected", status, affected)
+	}
+	if status := ts.do(t, http.MethodGet, "/"+keptDoc, "", nil, nil); status != http.StatusOK {
+		t.Errorf("kept document: status %d", status)
+	}
+	var orphaned struct {
+		Documents []struct {
+			ID string `json:"id"`
+		} `json:"documents"`
+	}
+	if status := ts.do(t, http.MethodGet, "/admin/documents/orphaned", owner, nil, &orphaned); status != http.StatusOK || len(orphaned.Documents) != 1 || orphaned.Documents[0].ID != keptDoc {
+		t.Errorf("orphaned: status %d, %+v, want %s", status, orphaned.Documents, keptDoc)
+	}
+	if status := ts.do(t, http.MethodPut, "/"+keptDoc, kept, map[string]interface{}{"v": 2}, nil); status != http.StatusUnauthorized {
+		t.Errorf("deleted key: status %d, want 401", status)
+	}
+
+	if status, affected := deleteKey(removedID, "delete"); status != http.StatusOK || affected != 2 {
+		t.Fatalf("delete: status %d, %d affected", status, affected)
+	}
+	for _, id := range removedDocs {
+		if status := ts.do(t, http.MethodGet, "/"+id, "", nil, nil); status != http.StatusNotFound {
+			t.Errorf("deleted document %s: status %d, want 404", id, status)
+		}
+	}
+	deletions := 0
+	for _, change := range ts.changes(t, owner, "") {
+		if change.Deleted {
+			deletions++
+		}
+	}
+	if deletions != 2 {
+		t.Errorf("changes record %d deletions, want 2", deletions)
+	}
+
+	if status, affected := deleteKey(movedID, "transfer:"+ownerID); status != http.StatusOK || affected != 1 {
+		t.Fatalf("transfer: status %d, %d affected", status, affected)
+	}
+	// The new creator can read the private document and manage it.
+	if got := ts.listDocuments(t, owner); len(got) != 2 {
+		t.Errorf("owner lists %v, want the kept and the transferred document", got)
+	}
+	if status := ts.do(t, http.MethodGet, "/"+movedDoc, owner, nil, nil); status != http.StatusOK {
+		t.Errorf("transferred private document: status %d", status)
+	}
+	if status := ts.do(t, http.MethodDelete, "/"+movedDoc, owner, nil, nil); status != http.StatusOK && status != http.StatusNoContent {
+		t.Errorf("delete transferred document: status %d", status)
+	}
+}
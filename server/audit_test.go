@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"pocketjson/storage"
+)
+
+// auditEvents lists audit events. query is appended to the URL as it is.
+func (ts *testServer) auditEvents(t *testing.T, apiKey, query string) []*storage.AuditEvent {
+	t.Helper()
+
+	var page struct {
+		Events []*storage.AuditEvent `json:"events"`
+	}
+	if status := ts.do(t, http.MethodGet, "/admin/audit?"+query, apiKey, nil, &page); status != http.StatusOK {
+		t.Fatalf("audit %s: status %d", query, status)
+	}
+	return page.Events
+}
+
+// exportAudit reads the NDJSON export of the audit log.
+func (ts *testServer) exportAudit(t *testing.T, apiKey, query, accept string) []*storage.AuditEvent {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/admin/audit?"+query, nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Header.Set("X-API-Key", apiKey)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("export: status %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	var events []*storage.AuditEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var ev storage.AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("export line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, &ev)
+	}
+	return events
+}
+
+func TestAuditLogRecordsWrites(t *testing.T) {
+	ts := newTestServer(t)
+	owner, ownerID := ts.createTenantKey(t, map[string]interface{}{
+		"scopes": []string{"documents:read", "documents:write", "documents:delete", "keys:manage"},
+	})
+	other, _ := ts.createTenantKey(t, map[string]interface{}{
+		"scopes": []string{"documents:read", "documents:write", "keys:manage"},
+	})
+
+	id := ts.createDocument(t, owner, "doc", "", map[string]interface{}{"a": 1})
+	if status := ts.do(t, http.MethodDelete, "/admin/keys/missing", owner, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("delete a missing key: status %d", status)
+	}
+	ts.createDocument(t, other, "doc", "", map[string]interface{}{"a": 1})
+
+	events := ts.auditEvents(t, owner, "actor="+ownerID)
+	if len(events) != 2 {
+		t.Fatalf("events = %+v, want the creation and the failed deletion", events)
+	}
+	if ev := events[0]; ev.Action != "document.create" || ev.Target != id || ev.Outcome != storage.AuditSuccess || ev.ClientIP == "" {
+		t.Errorf("first event = %+v", ev)
+	}
+	if ev := events[1]; ev.Action != "key.delete" || ev.Target != "missing" || ev.Outcome != storage.AuditFailure || ev.Status != http.StatusNotFound {
+		t.Errorf("second event = %+v", ev)
+	}
+	if events := ts.auditEvents(t, owner, "action=key&outcome=failure"); len(events) != 1 {
+		t.Errorf("failed key actions = %+v, want one", events)
+	}
+
+	// Tenant keys only see their own tenant; the master key sees all.
+	for _, ev := range ts.auditEvents(t, owner, "") {
+		if ev.TenantID != events[0].TenantID {
+			t.Errorf("tenant key sees event %+v of another tenant", ev)
+		}
+	}
+	if events := ts.auditEvents(t, testMasterKey, "action=document.create"); len(events) != 2 {
+		t.Errorf("master key sees %d creations, want 2", len(events))
+	}
+
+	if status := ts.do(t, http.MethodGet, "/admin/audit?since=yesterday", owner, nil, nil); status != http.StatusBadRequest {
+		t.Errorf("invalid since: status %d, want 400", status)
+	}
+}
+
+func TestAuditLogExport(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	for i := 0; i < 3; i++ {
+		ts.createDocument(t, key, "", "", map[string]interface{}{"n": i})
+	}
+
+	listed := ts.auditEvents(t, testMasterKey, "limit=2")
+	if len(listed) != 2 {
+		t.Fatalf("listed %d events, want a page of 2", len(listed))
+	}
+
+	// The export ignores the page size and streams every matching event.
+	all := ts.auditEvents(t, testMasterKey, "limit=1000")
+	exported := ts.exportAudit(t, testMasterKey, "format=ndjson&limit=2", "")
+	if len(exported) != len(all) || len(exported) < 4 {
+		t.Fatalf("exported %d events, want all %d", len(exported), len(all))
+	}
+	for i, ev := range exported {
+		if ev.ID != all[i].ID || ev.Action != all[i].Action {
+			t.Errorf("exported event %d = %+v, want %+v", i, ev, all[i])
+		}
+	}
+
+	if exported := ts.exportAudit(t, testMasterKey, "action=document", "application/json;q=0.5, application/x-ndjson"); len(exported) != 3 {
+		t.Errorf("exported %d document events, want 3", len(exported))
+	}
+	for _, ev := range ts.exportAudit(t, testMasterKey, "format=ndjson&after="+strconv.FormatInt(all[1].ID, 10), "") {
+		if ev.ID <= all[1].ID {
+			t.Errorf("export after %d contains %d", all[1].ID, ev.ID)
+		}
+	}
+	if status := ts.do(t, http.MethodGet, "/admin/audit?format=ndjson", key, nil, nil); status != http.StatusForbidden {
+		t.Errorf("export without keys:manage: status %d, want 403", status)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestBatchPatchKeepsLargeIntegers(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "big", "", json.RawMessage(`{"n":9007199254740993}`))
+
+	batch := map[string]interface{}{
+		"operations": []map[string]interface{}{
+			{"op": "patch", "id": id, "data": json.RawMessage(`{"m":123456789012345678901234567890}`)},
+		},
+	}
+	if status := ts.do(t, http.MethodPost, "/batch", key, batch, nil); status != http.StatusOK {
+		t.Fatalf("batch: status %d", status)
+	}
+
+	resp, err := http.Get(ts.URL + "/" + id)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if want := `{"m":123456789012345678901234567890,"n":9007199254740993}`; string(bytes.TrimSpace(data)) != want {
+		t.Errorf("patched document = %s, want %s", data, want)
+	}
+}
+
+func TestReservedIDsAreRefused(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	// POST /batch reaches the batch handler, so "batch" could only be
+	// created through a batch. The names of all routes are refused there.
+	for _, id := range []string{"admin", "batch", "buckets", "catch", "changes", "health", "locks", "queues", "webhooks"} {
+		batch := map[string]interface{}{
+			"operations": []map[string]interface{}{
+				{"op": "create", "id": id, "data": map[string]interface{}{"a": 1}},
+			},
+		}
+		var result struct {
+			Results []struct {
+				Status int `json:"status"`
+			} `json:"results"`
+		}
+		if status := ts.do(t, http.MethodPost, "/batch", key, batch, &result); status != http.StatusOK && status != http.StatusMultiStatus {
+			t.Fatalf("batch creating %s: status %d", id, status)
+		}
+		if len(result.Results) != 1 || result.Results[0].Status != http.StatusBadRequest {
+			t.Errorf("batch creating %s: results %+v, want 400", id, result.Results)
+		}
+	}
+
+	if status := ts.do(t, http.MethodPost, "/health", key, map[string]interface{}{"a": 1}, nil); status == http.StatusOK {
+		t.Errorf("POST /health: status %d, want it refused", status)
+	}
+	ts.createDocument(t, key, "batches", "", map[string]interface{}{"a": 1})
+}
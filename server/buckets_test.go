@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"pocketjson/storage"
+)
+
+// createBucket creates a catcher bucket and returns its ID.
+func (ts *testServer) createBucket(t *testing.T, apiKey string) string {
+	t.Helper()
+
+	var bucket struct {
+		ID string `json:"id"`
+	}
+	if status := ts.do(t, http.MethodPost, "/buckets", apiKey, map[string]interface{}{}, &bucket); status != http.StatusCreated {
+		t.Fatalf("create bucket: status %d", status)
+	}
+	return bucket.ID
+}
+
+// capturedRequests lists what a bucket recorded. query is appended to the
+// URL as it is.
+func (ts *testServer) capturedRequests(t *testing.T, apiKey, bucketID, query string) []*storage.CapturedRequest {
+	t.Helper()
+
+	var captured struct {
+		Requests []*storage.CapturedRequest `json:"requests"`
+	}
+	path := "/buckets/" + bucketID + "/requests"
+	if query != "" {
+		path += "?" + query
+	}
+	if status := ts.do(t, http.MethodGet, path, apiKey, nil, &captured); status != http.StatusOK {
+		t.Fatalf("list captured requests: status %d", status)
+	}
+	return captured.Requests
+}
+
+func TestCatchRecordsRequests(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	bucket := ts.createBucket(t, key)
+
+	req, _ := http.NewRequest(http.MethodPatch, ts.URL+"/catch/"+bucket+"/github/push?delivery=1&delivery=2", strings.NewReader("plain text"))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Hub-Signature", "sha256=abc")
+	if status := send(t, req, nil); status != http.StatusOK {
+		t.Fatalf("catch: status %d", status)
+	}
+	binary := []byte{0xff, 0x00, 0xfe}
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+"/catch/"+bucket, bytes.NewReader(binary))
+	if status := send(t, req, nil); status != http.StatusOK {
+		t.Fatalf("catch: status %d", status)
+	}
+
+	captured := ts.capturedRequests(t, key, bucket, "")
+	if len(captured) != 2 {
+		t.Fatalf("captured %d requests, want 2", len(captured))
+	}
+	first := captured[0]
+	if first.Method != http.MethodPatch || first.Path != "/github/push" || strings.Join(first.Query["delivery"], ",") != "1,2" {
+		t.Errorf("first = %s %s %v", first.Method, first.Path, first.Query)
+	}
+	if first.Body != "plain text" || first.BodyEncoding != storage.BodyText || first.BodySize != 10 || first.Truncated {
+		t.Errorf("first body = %q (%s, %d bytes, truncated %v)", first.Body, first.BodyEncoding, first.BodySize, first.Truncated)
+	}
+	if got := http.Header(first.Headers).Get("X-Hub-Signature"); got != "sha256=abc" {
+		t.Errorf("X-Hub-Signature = %q", got)
+	}
+	second := captured[1]
+	if second.Path != "/" || second.BodyEncoding != storage.BodyBase64 || second.Body != base64.StdEncoding.EncodeToString(binary) {
+		t.Errorf("second = %s %q (%s)", second.Path, second.Body, second.BodyEncoding)
+	}
+
+	// Paging follows the record IDs.
+	page := ts.capturedRequests(t, key, bucket, "limit=1")
+	if len(page) != 1 || page[0].ID != first.ID {
+		t.Fatalf("first page = %v", page)
+	}
+	page = ts.capturedRequests(t, key, bucket, "limit=1&after="+strconv.FormatInt(first.ID, 10))
+	if len(page) != 1 || page[0].ID != second.ID {
+		t.Errorf("second page = %v", page)
+	}
+
+	// Buckets belong to the key that created them.
+	other, _ := ts.createTenantKey(t, nil)
+	if status := ts.do(t, http.MethodGet, "/buckets/"+bucket+"/requests", other, nil, nil); status != http.StatusNotFound {
+		t.Errorf("list with another key: status %d, want 404", status)
+	}
+	if status := ts.do(t, http.MethodGet, "/buckets/"+bucket+"/requests", testMasterKey, nil, nil); status != http.StatusOK {
+		t.Errorf("list as admin: status %d, want 200", status)
+	}
+
+	if status := ts.do(t, http.MethodDelete, "/buckets/"+bucket, key, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("delete bucket: status %d", status)
+	}
+	if status := ts.do(t, http.MethodPost, "/catch/"+bucket, "", map[string]interface{}{}, nil); status != http.StatusNotFound {
+		t.Errorf("catch after delete: status %d, want 404", status)
+	}
+}
+
+func TestCatchLimits(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.Config().BucketMaxBody = 8
+	ts.store.Config().BucketMaxRecords = 3
+	key, _ := ts.createTenantKey(t, nil)
+	bucket := ts.createBucket(t, key)
+
+	for _, body := range []string{"12345678", "123456789", "a", "b"} {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/catch/"+bucket, strings.NewReader(body))
+		if status := send(t, req, nil); status != http.StatusOK {
+			t.Fatalf("catch %q: status %d", body, status)
+		}
+	}
+
+	// Only the latest records are kept, and long bodies are cut off.
+	captured := ts.capturedRequests(t, key, bucket, "")
+	if len(captured) != 3 {
+		t.Fatalf("captured %d requests, want 3", len(captured))
+	}
+	if got := captured[0]; got.Body != "12345678" || got.BodySize != 8 || !got.Truncated {
+		t.Errorf("long body = %q (%d bytes, truncated %v), want the first 8 bytes marked truncated", got.Body, got.BodySize, got.Truncated)
+	}
+	if captured[1].Truncated || captured[2].Body != "b" {
+		t.Errorf("captured = %q, %q", captured[1].Body, captured[2].Body)
+	}
+
+	// A truncated body cannot be sent again as it was.
+	replay := "/buckets/" + bucket + "/requests/" + strconv.FormatInt(captured[0].ID, 10) + "/replay"
+	if status := ts.do(t, http.MethodPost, replay, key, map[string]interface{}{"url": "https://example.com/"}, nil); status != http.StatusConflict {
+		t.Errorf("replay of a truncated body: status %d, want 409", status)
+	}
+}
+
+func TestReplayRefusesNonPublicAddresses(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	bucket := ts.createBucket(t, key)
+	if status := ts.do(t, http.MethodPost, "/catch/"+bucket, "", map[string]interface{}{"a": 1}, nil); status >= 300 {
+		t.Fatalf("catch: status %d", status)
+	}
+	captured := ts.capturedRequests(t, key, bucket, "")
+	if len(captured) != 1 {
+		t.Fatalf("captured %d requests, want 1", len(captured))
+	}
+
+	var reached atomic.Bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Store(true)
+	}))
+	defer target.Close()
+
+	replay := "/buckets/" + bucket + "/requests/" + strconv.FormatInt(captured[0].ID, 10) + "/replay"
+	for _, url := range []string{target.URL, "http://localhost:" + strconv.Itoa(target.Listener.Addr().(*net.TCPAddr).Port), "http://169.254.169.254/latest/meta-data/"} {
+		if status := ts.do(t, http.MethodPost, replay, key, map[string]interface{}{"url": url}, nil); status != http.StatusBadGateway {
+			t.Errorf("replay to %s: status %d, want 502", url, status)
+		}
+	}
+	if reached.Load() {
+		t.Error("replay reached a loopback server")
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"pocketjson/storage"
+)
+
+// sseEvent is one Server-Sent Event read from a stream.
+type sseEvent struct {
+	id, event, data string
+}
+
+// eventStreamReader reads the events of an open stream.
+type eventStreamReader struct {
+	scanner *bufio.Scanner
+}
+
+// openEventStream opens an event stream, resuming after lastEventID if it
+// is not empty. Reads fail after ten seconds so a missing event cannot
+// hang the test.
+func (ts *testServer) openEventStream(t *testing.T, path, apiKey, lastEventID string) *eventStreamReader {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET %s: status %d, Content-Type %q", path, resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return &eventStreamReader{scanner: bufio.NewScanner(resp.Body)}
+}
+
+// next returns the next event, skipping retry hints and heartbeats. It
+// reports false once the server ended the stream.
+func (s *eventStreamReader) next(t *testing.T) (sseEvent, bool) {
+	t.Helper()
+
+	var event sseEvent
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		if line == "" {
+			if event.event != "" {
+				return event, true
+			}
+			continue
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			event.id = value
+		case "event":
+			event.event = value
+		case "data":
+			event.data = value
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		t.Fatalf("reading event stream: %v", err)
+	}
+	return sseEvent{}, false
+}
+
+func TestChangesFeed(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, map[string]interface{}{
+		"scopes": []string{"documents:read", "documents:write", "documents:delete", "keys:manage"},
+	})
+	scoped, _ := ts.createKey(t, key, map[string]interface{}{"id_prefix": "flags-"})
+	other, _ := ts.createTenantKey(t, nil)
+
+	flag := ts.createDocument(t, key, "flags-web", "", map[string]interface{}{"on": true})
+	gone := ts.createDocument(t, key, "old", "", map[string]interface{}{})
+	if status := ts.do(t, http.MethodPut, "/"+flag, key, map[string]interface{}{"on": false}, nil); status != http.StatusOK {
+		t.Fatalf("update: status %d", status)
+	}
+	if status := ts.do(t, http.MethodDelete, "/"+gone, key, nil, nil); status != http.StatusOK && status != http.StatusNoContent {
+		t.Fatalf("delete: status %d", status)
+	}
+	ts.createDocument(t, other, "flags-web", "", map[string]interface{}{})
+
+	changes := ts.changes(t, key, "since=0")
+	if len(changes) != 4 {
+		t.Fatalf("changes = %d, want 4", len(changes))
+	}
+	for i := 1; i < len(changes); i++ {
+		if changes[i].Seq <= changes[i-1].Seq {
+			t.Errorf("changes out of order: %d after %d", changes[i].Seq, changes[i-1].Seq)
+		}
+	}
+	if last := changes[3]; last.DocumentID != gone || !last.Deleted {
+		t.Errorf("last change = %+v, want the deletion of %s", last, gone)
+	}
+
+	// Keys restricted to an ID prefix only follow documents under it.
+	if changes := ts.changes(t, scoped, ""); len(changes) != 2 || changes[0].DocumentID != flag {
+		t.Errorf("scoped changes = %+v, want the two writes of %s", changes, flag)
+	}
+	if status := ts.do(t, http.MethodGet, "/changes?prefix=other", scoped, nil, nil); status != http.StatusForbidden {
+		t.Errorf("prefix outside the restriction: status %d, want 403", status)
+	}
+	if changes := ts.changes(t, key, "since=now"); len(changes) != 0 {
+		t.Errorf("since=now = %+v, want none", changes)
+	}
+}
+
+func TestChangesLongPoll(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	start := time.Now()
+	if changes := ts.changes(t, key, "since=now&feed=longpoll&timeout=1"); len(changes) != 0 {
+		t.Errorf("idle long poll = %+v, want none", changes)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("idle long poll answered after %v, want the timeout", elapsed)
+	}
+
+	done := make(chan []*storage.Change)
+	go func() {
+		done <- ts.changes(t, key, "since=now&feed=longpoll&timeout=10")
+	}()
+	time.Sleep(200 * time.Millisecond)
+	id := ts.createDocument(t, key, "doc", "", map[string]interface{}{})
+
+	select {
+	case changes := <-done:
+		if len(changes) != 1 || changes[0].DocumentID != id {
+			t.Errorf("long poll = %+v, want the creation of %s", changes, id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the long poll was not woken by the write")
+	}
+}
+
+func TestChangesEventSource(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	first := ts.createDocument(t, key, "first", "", map[string]interface{}{})
+
+	stream := ts.openEventStream(t, "/changes?feed=eventsource", key, "")
+	event, ok := stream.next(t)
+	if !ok || event.event != "change" {
+		t.Fatalf("first event = %+v", event)
+	}
+	var change storage.Change
+	if err := json.Unmarshal([]byte(event.data), &change); err != nil || change.DocumentID != first || strconv.FormatInt(change.Seq, 10) != event.id {
+		t.Fatalf("first event = %+v, want the creation of %s with its seq as ID", event, first)
+	}
+
+	second := ts.createDocument(t, key, "second", "", map[string]interface{}{})
+	event, ok = stream.next(t)
+	if !ok || !strings.Contains(event.data, second) {
+		t.Fatalf("second event = %+v, want the creation of %s", event, second)
+	}
+
+	// Last-Event-ID resumes after the events already seen.
+	resumed := ts.openEventStream(t, "/changes?feed=eventsource", key, event.id)
+	third := ts.createDocument(t, key, "third", "", map[string]interface{}{})
+	if event, ok := resumed.next(t); !ok || !strings.Contains(event.data, third) {
+		t.Errorf("resumed stream = %+v, want only the creation of %s", event, third)
+	}
+}
+
+func TestExpiredDocumentIsADeletion(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+
+	expired := time.Now().Add(-time.Second)
+	if err := ts.store.DB().CreateJSON(ctx, "t1_old", `{}`, expired, "k1", "t1", storage.VisibilityPublic, storage.KindDocument, ""); err != nil {
+		t.Fatalf("CreateJSON: %v", err)
+	}
+	if _, err := ts.store.DB().DeleteExpiredJSON(ctx); err != nil {
+		t.Fatalf("DeleteExpiredJSON: %v", err)
+	}
+
+	changes := ts.changes(t, testMasterKey, "tenant_id=t1")
+	if len(changes) != 2 {
+		t.Fatalf("changes = %+v, want the creation and the expiry", changes)
+	}
+	if last := changes[1]; last.DocumentID != "t1_old" || !last.Deleted {
+		t.Errorf("expiry = %+v, want a deletion of t1_old", last)
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"pocketjson/storage"
+)
+
+type itemPage struct {
+	Items     []*storage.Item `json:"items"`
+	Count     int64           `json:"count"`
+	Bytes     int64           `json:"bytes"`
+	NextAfter *int64          `json:"next_after"`
+}
+
+// changes reads the changes feed. query is appended to the URL as it is.
+func (ts *testServer) changes(t *testing.T, apiKey, query string) []*storage.Change {
+	t.Helper()
+
+	var feed struct {
+		Results []*storage.Change `json:"results"`
+	}
+	if status := ts.do(t, http.MethodGet, "/changes?"+query, apiKey, nil, &feed); status != http.StatusOK {
+		t.Fatalf("changes %s: status %d", query, status)
+	}
+	return feed.Results
+}
+
+func TestCollectionItems(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "signups", "kind=collection", map[string]interface{}{"title": "Signups"})
+
+	for i := 1; i <= 3; i++ {
+		var item storage.Item
+		if status := ts.do(t, http.MethodPost, "/"+id+"/items", key, map[string]interface{}{"n": i}, &item); status != http.StatusCreated {
+			t.Fatalf("append %d: status %d, want 201", i, status)
+		}
+		if item.ID == 0 || item.CreatedAt.IsZero() || item.ExpiresAt != nil {
+			t.Errorf("append %d: item %+v", i, item)
+		}
+	}
+
+	var page itemPage
+	if status := ts.do(t, http.MethodGet, "/"+id+"/items?limit=2", key, nil, &page); status != http.StatusOK {
+		t.Fatalf("list: status %d", status)
+	}
+	if len(page.Items) != 2 || string(page.Items[0].Data) != `{"n":1}` || page.Count != 3 || page.Bytes != 21 || page.NextAfter == nil {
+		t.Fatalf("first page = %+v", page)
+	}
+	after := strconv.FormatInt(*page.NextAfter, 10)
+	page = itemPage{}
+	if status := ts.do(t, http.MethodGet, "/"+id+"/items?limit=2&after="+after, key, nil, &page); status != http.StatusOK {
+		t.Fatalf("list: status %d", status)
+	}
+	if len(page.Items) != 1 || string(page.Items[0].Data) != `{"n":3}` || page.NextAfter != nil {
+		t.Errorf("second page = %+v", page)
+	}
+
+	// The collection's own body is untouched by appends.
+	if got := ts.documentBody(t, id); got != `{"title":"Signups"}` {
+		t.Errorf("collection = %s", got)
+	}
+
+	plain := ts.createDocument(t, key, "plain", "", map[string]interface{}{"a": 1})
+	if status := ts.do(t, http.MethodPost, "/"+plain+"/items", key, map[string]interface{}{"n": 1}, nil); status != http.StatusConflict {
+		t.Errorf("append to a document: status %d, want 409", status)
+	}
+	if status := ts.do(t, http.MethodGet, "/"+plain+"/items", key, nil, nil); status != http.StatusConflict {
+		t.Errorf("items of a document: status %d, want 409", status)
+	}
+	if status := ts.do(t, http.MethodPost, "/"+id+"/items?ttl=0", key, map[string]interface{}{"n": 1}, nil); status != http.StatusBadRequest {
+		t.Errorf("append with ttl=0: status %d, want 400", status)
+	}
+}
+
+func TestCollectionItemTTL(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "signups", "kind=collection", map[string]interface{}{})
+
+	if status := ts.do(t, http.MethodPost, "/"+id+"/items?ttl=1", key, map[string]interface{}{"n": 1}, nil); status != http.StatusCreated {
+		t.Fatalf("append: status %d", status)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	var page itemPage
+	if status := ts.do(t, http.MethodGet, "/"+id+"/items", key, nil, &page); status != http.StatusOK {
+		t.Fatalf("list: status %d", status)
+	}
+	if len(page.Items) != 0 || page.Count != 0 {
+		t.Errorf("page = %+v, want the expired item gone", page)
+	}
+}
+
+func TestCollectionIsCapped(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.Config().CollectionMaxItems = 2
+	ts.store.Config().CollectionMaxBytes = 30
+	key, _ := ts.createTenantKey(t, nil)
+
+	byCount := ts.createDocument(t, key, "by-count", "kind=collection", map[string]interface{}{})
+	for i := 0; i < 2; i++ {
+		if status := ts.do(t, http.MethodPost, "/"+byCount+"/items", key, map[string]interface{}{"n": i}, nil); status != http.StatusCreated {
+			t.Fatalf("append %d: status %d", i, status)
+		}
+	}
+	if status := ts.do(t, http.MethodPost, "/"+byCount+"/items", key, map[string]interface{}{"n": 2}, nil); status != http.StatusInsufficientStorage {
+		t.Errorf("append past the item cap: status %d, want 507", status)
+	}
+
+	bySize := ts.createDocument(t, key, "by-size", "kind=collection", map[string]interface{}{})
+	if status := ts.do(t, http.MethodPost, "/"+bySize+"/items", key, map[string]interface{}{"text": "0123456789"}, nil); status != http.StatusCreated {
+		t.Fatalf("append: status %d", status)
+	}
+	if status := ts.do(t, http.MethodPost, "/"+bySize+"/items", key, map[string]interface{}{"text": "0123456789"}, nil); status != http.StatusInsufficientStorage {
+		t.Errorf("append past the byte cap: status %d, want 507", status)
+	}
+}
+
+func TestAppendIsAChange(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "signups", "kind=collection", map[string]interface{}{})
+
+	before := ts.changes(t, key, "")
+	if len(before) != 1 {
+		t.Fatalf("changes = %d, want the creation", len(before))
+	}
+	since := strconv.FormatInt(before[0].Seq, 10)
+
+	// A long poll waiting for the next change is answered by the append.
+	done := make(chan []*storage.Change)
+	go func() {
+		done <- ts.changes(t, key, "feed=longpoll&timeout=10&since="+since)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if status := ts.do(t, http.MethodPost, "/"+id+"/items", key, map[string]interface{}{"n": 1}, nil); status != http.StatusCreated {
+		t.Fatalf("append: status %d", status)
+	}
+
+	select {
+	case changes := <-done:
+		if len(changes) != 1 || changes[0].DocumentID != id || changes[0].Version != 2 || changes[0].Deleted {
+			t.Errorf("changes after the append = %+v, want version 2 of %s", changes, id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the long poll was not woken by the append")
+	}
+
+	// A refused append changes nothing.
+	ts.store.Config().CollectionMaxItems = 1
+	if status := ts.do(t, http.MethodPost, "/"+id+"/items", key, map[string]interface{}{"n": 2}, nil); status != http.StatusInsufficientStorage {
+		t.Fatalf("append past the cap: status %d, want 507", status)
+	}
+	if changes := ts.changes(t, key, "since="+since); len(changes) != 1 {
+		t.Errorf("changes = %+v, want only the successful append", changes)
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// get fetches path and returns the response with its body read.
+func (ts *testServer) get(t *testing.T, path string) (*http.Response, string) {
+	t.Helper()
+
+	resp, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestDigestOfCanonicalForm(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "invoice", "", json.RawMessage(`{"b": "<&>", "a": 1.5e3}`))
+
+	const canonical = `{"a":1500,"b":"<&>"}`
+	sum := sha256.Sum256([]byte(canonical))
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+
+	for _, query := range []string{"", "?format=yaml", "?indent=2"} {
+		resp, _ := ts.get(t, "/"+id+query)
+		if got := resp.Header.Get("Digest"); got != "sha-256="+digest {
+			t.Errorf("GET %s: Digest = %q, want sha-256=%s", query, got, digest)
+		}
+	}
+
+	resp, body := ts.get(t, "/"+id+"?canonical=true")
+	if resp.StatusCode != http.StatusOK || body != canonical {
+		t.Errorf("canonical: status %d, body %s, want %s", resp.StatusCode, body, canonical)
+	}
+	if got := resp.Header.Get("Content-Digest"); got != "sha-256=:"+digest+":" {
+		t.Errorf("canonical: Content-Digest = %q", got)
+	}
+
+	if resp, _ := ts.get(t, "/"+id+"?canonical=true&format=yaml"); resp.StatusCode != http.StatusNotAcceptable {
+		t.Errorf("canonical YAML: status %d, want 406", resp.StatusCode)
+	}
+}
+
+func TestDocumentWithoutCanonicalForm(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "huge", "", json.RawMessage(`{"a":1e400}`))
+
+	resp, body := ts.get(t, "/"+id)
+	if resp.StatusCode != http.StatusOK || body != `{"a":1e400}` {
+		t.Fatalf("GET: status %d, body %s, want the document", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Digest"); got != "" {
+		t.Errorf("Digest = %q, want none", got)
+	}
+
+	if resp, _ := ts.get(t, "/"+id+"?canonical=true"); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("canonical: status %d, want 422", resp.StatusCode)
+	}
+}
+
+func TestContentDigest(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "checked", "", map[string]interface{}{"total": 1})
+
+	body := []byte(`{"total":42}`)
+	sum256 := sha256.Sum256(body)
+	sum512 := sha512.Sum512(body)
+	other := sha256.Sum256([]byte(`{"total":43}`))
+	encode := func(sum []byte) string { return ":" + base64.StdEncoding.EncodeToString(sum) + ":" }
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"sha-256", "sha-256=" + encode(sum256[:]), http.StatusOK},
+		{"sha-512", "sha-512=" + encode(sum512[:]), http.StatusOK},
+		{"both", "sha-256=" + encode(sum256[:]) + ", sha-512=" + encode(sum512[:]), http.StatusOK},
+		{"unknown algorithm ignored", "md5=:AAAA:, sha-256=" + encode(sum256[:]), http.StatusOK},
+		{"mismatch", "sha-256=" + encode(other[:]), http.StatusBadRequest},
+		{"one of two mismatches", "sha-256=" + encode(sum256[:]) + ", sha-512=" + encode(other[:]), http.StatusBadRequest},
+		{"no supported algorithm", "md5=:AAAA:", http.StatusBadRequest},
+		{"not base64", "sha-256=:not base64:", http.StatusBadRequest},
+		{"no colons", "sha-256=" + base64.StdEncoding.EncodeToString(sum256[:]), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Start from a different document so a rejected write shows.
+			if status := ts.do(t, http.MethodPut, "/"+id, key, map[string]interface{}{"total": 1}, nil); status != http.StatusOK {
+				t.Fatalf("reset: status %d", status)
+			}
+
+			req, _ := http.NewRequest(http.MethodPut, ts.URL+"/"+id, bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", key)
+			req.Header.Set("Content-Digest", tt.header)
+			if status := send(t, req, nil); status != tt.want {
+				t.Fatalf("status %d, want %d", status, tt.want)
+			}
+
+			want := `{"total":1}`
+			if tt.want == http.StatusOK {
+				want = string(body)
+			}
+			if _, stored := ts.get(t, "/"+id); stored != want {
+				t.Errorf("stored %s, want %s", stored, want)
+			}
+		})
+	}
+}
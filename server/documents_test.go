@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+// listDocuments returns the sorted IDs of the documents the key lists.
+func (ts *testServer) listDocuments(t *testing.T, apiKey string) []string {
+	t.Helper()
+
+	var listed struct {
+		Documents []struct {
+			ID string `json:"id"`
+		} `json:"documents"`
+	}
+	if status := ts.do(t, http.MethodGet, "/admin/documents", apiKey, nil, &listed); status != http.StatusOK {
+		t.Fatalf("list: status %d", status)
+	}
+	var ids []string
+	for _, doc := range listed.Documents {
+		ids = append(ids, doc.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestAdminDocumentsHonourIDPrefix(t *testing.T) {
+	ts := newTestServer(t)
+	owner, _ := ts.createTenantKey(t, map[string]interface{}{
+		"scopes": []string{"documents:read", "documents:write", "documents:delete", "keys:manage"},
+	})
+	prefixed, _ := ts.createKey(t, owner, map[string]interface{}{"id_prefix": "team-"})
+
+	data := map[string]interface{}{"a": 1}
+	inside := ts.createDocument(t, owner, "team-one", "", data)
+	private := ts.createDocument(t, owner, "team-private", "visibility=private", data)
+	outside := ts.createDocument(t, owner, "other-one", "", data)
+
+	// The private document is left out for keys other than its creator.
+	if ids := ts.listDocuments(t, prefixed); len(ids) != 1 || ids[0] != inside {
+		t.Errorf("listed %v, want only %s", ids, inside)
+	}
+	if ids := ts.listDocuments(t, owner); len(ids) != 3 || ids[0] != outside || ids[2] != private {
+		t.Errorf("listed %v for the creator, want %s, %s and %s", ids, outside, inside, private)
+	}
+
+	inspect := []struct {
+		id   string
+		want int
+	}{
+		{inside, http.StatusOK},
+		{outside, http.StatusNotFound},
+		{private, http.StatusNotFound},
+	}
+	for _, tt := range inspect {
+		if status := ts.do(t, http.MethodGet, "/admin/documents/"+tt.id, prefixed, nil, nil); status != tt.want {
+			t.Errorf("inspect %s: status %d, want %d", tt.id, status, tt.want)
+		}
+	}
+
+	var deleted struct {
+		Deleted int `json:"deleted"`
+	}
+	if status := ts.do(t, http.MethodDelete, "/admin/documents?all=true", prefixed, nil, &deleted); status != http.StatusOK {
+		t.Fatalf("delete: status %d", status)
+	}
+	if deleted.Deleted != 2 {
+		t.Errorf("deleted %d documents, want 2", deleted.Deleted)
+	}
+	if status := ts.do(t, http.MethodGet, "/admin/documents/"+outside, owner, nil, nil); status != http.StatusOK {
+		t.Errorf("document outside the prefix: status %d, want 200", status)
+	}
+}
+
+func TestDocumentVisibility(t *testing.T) {
+	ts := newTestServer(t)
+	owner, _ := ts.createTenantKey(t, map[string]interface{}{
+		"scopes": []string{"documents:read", "documents:write", "documents:delete", "keys:manage"},
+	})
+	sibling, siblingID := ts.createKey(t, owner, nil)
+	stranger, _ := ts.createTenantKey(t, nil)
+
+	data := map[string]interface{}{"secret": 1}
+	public := ts.createDocument(t, owner, "public", "", data)
+	private := ts.createDocument(t, owner, "private", "visibility=private", data)
+	tenant := ts.createDocument(t, owner, "tenant", "visibility=tenant", data)
+
+	_, missingBody := ts.get(t, "/missing")
+	readers := []struct {
+		name string
+		key  string
+		want map[string]int
+	}{
+		{"guest", "", map[string]int{public: 200, private: 404, tenant: 404}},
+		{"creator", owner, map[string]int{public: 200, private: 200, tenant: 200}},
+		{"same tenant", sibling, map[string]int{public: 200, private: 404, tenant: 200}},
+		{"other tenant", stranger, map[string]int{public: 200, private: 404, tenant: 404}},
+		{"admin", testMasterKey, map[string]int{public: 200, private: 200, tenant: 200}},
+	}
+	for _, reader := range readers {
+		for id, want := range reader.want {
+			for _, query := range []string{"", "?format=yaml"} {
+				req, _ := http.NewRequest(http.MethodGet, ts.URL+"/"+id+query, nil)
+				if reader.key != "" {
+					req.Header.Set("X-API-Key", reader.key)
+				}
+				if status := send(t, req, nil); status != want {
+					t.Errorf("%s reads %s%s: status %d, want %d", reader.name, id, query, status, want)
+				}
+			}
+		}
+	}
+
+	// A hidden document answers exactly like one that does not exist.
+	if _, body := ts.get(t, "/"+private); body != missingBody {
+		t.Errorf("private document answers %q, a missing one %q", body, missingBody)
+	}
+
+	// Other keys of the tenant cannot reach it through writes either, which
+	// would let them share it with themselves or read it through ops.
+	writes := []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodPut, "/" + private, map[string]interface{}{"secret": 2}},
+		{http.MethodPost, "/" + private + "/ops", map[string]interface{}{"op": "incr", "path": "secret", "value": 0}},
+		{http.MethodPut, "/" + private + "/acl/" + siblingID, map[string]interface{}{"access": "read"}},
+		{http.MethodGet, "/" + private + "/acl", nil},
+		{http.MethodGet, "/admin/documents/" + private, nil},
+		{http.MethodDelete, "/" + private, nil},
+	}
+	for _, write := range writes {
+		if status := ts.do(t, write.method, write.path, sibling, write.body, nil); status != http.StatusNotFound {
+			t.Errorf("%s %s by another key of the tenant: status %d, want 404", write.method, write.path, status)
+		}
+	}
+	var batch struct {
+		Results []struct {
+			Status int `json:"status"`
+		} `json:"results"`
+	}
+	ops := map[string]interface{}{"operations": []map[string]interface{}{
+		{"op": "get", "id": private},
+		{"op": "patch", "id": private, "data": map[string]interface{}{"secret": 3}},
+	}}
+	if status := ts.do(t, http.MethodPost, "/batch", sibling, ops, &batch); status != http.StatusOK || len(batch.Results) != 2 || batch.Results[0].Status != 404 || batch.Results[1].Status != 404 {
+		t.Errorf("batch by another key of the tenant: status %d, %+v, want 404s", status, batch.Results)
+	}
+	var stored json.RawMessage
+	if status := ts.do(t, http.MethodGet, "/"+private, owner, nil, &stored); status != http.StatusOK || string(stored) != `{"secret":1}` {
+		t.Errorf("private document = %s (status %d), want it unchanged", stored, status)
+	}
+	if status := ts.do(t, http.MethodPut, "/"+tenant, sibling, map[string]interface{}{"secret": 2}, nil); status != http.StatusOK {
+		t.Errorf("update of a tenant document by another key of the tenant: status %d, want 200", status)
+	}
+
+	if status := ts.do(t, http.MethodPost, "/?visibility=private", "", data, nil); status != http.StatusBadRequest {
+		t.Errorf("guest creating a private document: status %d, want 400", status)
+	}
+}
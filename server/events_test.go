@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"pocketjson/storage"
+)
+
+func TestWatchDocument(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "doc", "", map[string]interface{}{"v": 1})
+
+	stream := ts.openEventStream(t, "/"+id+"/events", "", "")
+	if event, ok := stream.next(t); !ok || event != (sseEvent{"1", "document", `{"v":1}`}) {
+		t.Fatalf("first event = %+v, want version 1", event)
+	}
+	if status := ts.do(t, http.MethodPut, "/"+id, key, map[string]interface{}{"v": 2}, nil); status != http.StatusOK {
+		t.Fatalf("update: status %d", status)
+	}
+	if event, ok := stream.next(t); !ok || event != (sseEvent{"2", "document", `{"v":2}`}) {
+		t.Fatalf("event after the update = %+v, want version 2", event)
+	}
+
+	// A client resuming at the current version is not sent it again: the
+	// first event it gets is the next version.
+	resumed := ts.openEventStream(t, "/"+id+"/events", "", "2")
+	if status := ts.do(t, http.MethodPut, "/"+id, key, map[string]interface{}{"v": 3}, nil); status != http.StatusOK {
+		t.Fatalf("update: status %d", status)
+	}
+	if event, ok := resumed.next(t); !ok || event != (sseEvent{"3", "document", `{"v":3}`}) {
+		t.Fatalf("resumed stream = %+v, want version 3 first", event)
+	}
+	// A client resuming at an older version gets the current one right away.
+	behind := ts.openEventStream(t, "/"+id+"/events", "", "1")
+	if event, ok := behind.next(t); !ok || event.id != "3" {
+		t.Fatalf("stream resumed at version 1 = %+v, want version 3", event)
+	}
+	if event, ok := stream.next(t); !ok || event.id != "3" {
+		t.Fatalf("third event = %+v, want version 3", event)
+	}
+
+	if status := ts.do(t, http.MethodDelete, "/"+id, key, nil, nil); status != http.StatusOK && status != http.StatusNoContent {
+		t.Fatalf("delete: status %d", status)
+	}
+	for _, s := range []*eventStreamReader{stream, resumed, behind} {
+		if event, ok := s.next(t); !ok || event.event != "deleted" || event.data != `{"id":"`+id+`"}` {
+			t.Errorf("event after the deletion = %+v, want deleted", event)
+		}
+		if event, ok := s.next(t); ok {
+			t.Errorf("event after deleted = %+v, want the stream to end", event)
+		}
+	}
+}
+
+func TestWatchExpiringDocument(t *testing.T) {
+	ts := newTestServer(t)
+	expiresAt := time.Now().Add(time.Second)
+	if err := ts.store.DB().CreateJSON(context.Background(), "t1_short", `{}`, expiresAt, "k1", "t1", storage.VisibilityPublic, storage.KindDocument, ""); err != nil {
+		t.Fatalf("CreateJSON: %v", err)
+	}
+
+	stream := ts.openEventStream(t, "/t1_short/events", "", "")
+	if event, ok := stream.next(t); !ok || event.event != "document" {
+		t.Fatalf("first event = %+v", event)
+	}
+	// The stream notices the expiry by itself, before any cleanup runs.
+	if event, ok := stream.next(t); !ok || event.event != "expired" {
+		t.Fatalf("event at the expiry = %+v, want expired", event)
+	}
+	if time.Now().Before(expiresAt) {
+		t.Error("expired event sent before the document expired")
+	}
+	if _, ok := stream.next(t); ok {
+		t.Error("the stream went on after expired")
+	}
+}
+
+func TestWatchIsRestrictedLikeReads(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "secret", "visibility=private", map[string]interface{}{"v": 1})
+
+	if status := ts.do(t, http.MethodGet, "/"+id+"/events", "", nil, nil); status != http.StatusNotFound {
+		t.Errorf("anonymous watch of a private document: status %d, want 404", status)
+	}
+	stream := ts.openEventStream(t, "/"+id+"/events", key, "")
+	if event, ok := stream.next(t); !ok || event.data != `{"v":1}` {
+		t.Errorf("creator's watch = %+v", event)
+	}
+}
+
+func TestShutdownEndsStreams(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "doc", "", map[string]interface{}{"v": 1})
+
+	document := ts.openEventStream(t, "/"+id+"/events", "", "")
+	document.next(t)
+	changes := ts.openEventStream(t, "/changes?feed=eventsource", key, "")
+	changes.next(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ts.server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	for name, s := range map[string]*eventStreamReader{"document": document, "changes": changes} {
+		if event, ok := s.next(t); ok {
+			t.Errorf("%s stream after shutdown = %+v, want it closed", name, event)
+		}
+	}
+}
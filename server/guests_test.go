@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// guestDocument is a document created without an API key.
+type guestDocument struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	EditToken string    `json:"edit_token"`
+}
+
+func (ts *testServer) createGuestDocument(t *testing.T) guestDocument {
+	t.Helper()
+
+	var doc guestDocument
+	if status := ts.do(t, http.MethodPost, "/", "", map[string]interface{}{"v": 1}, &doc); status != http.StatusOK {
+		t.Fatalf("create: status %d", status)
+	}
+	if doc.EditToken == "" {
+		t.Fatalf("create: no edit token in %+v", doc)
+	}
+	return doc
+}
+
+// withEditToken sends body, if any, as JSON with the edit token and, if not
+// empty, an API key, and decodes a JSON response into out, if given.
+func (ts *testServer) withEditToken(t *testing.T, method, path, token, apiKey string, body, out interface{}) int {
+	t.Helper()
+
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Edit-Token", token)
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	return send(t, req, out)
+}
+
+func TestEditTokenCoversOneDocument(t *testing.T) {
+	ts := newTestServer(t)
+	doc := ts.createGuestDocument(t)
+	other := ts.createGuestDocument(t)
+	key, _ := ts.createTenantKey(t, nil)
+	owned := ts.createDocument(t, key, "owned", "", map[string]interface{}{"v": 1})
+
+	if status := ts.withEditToken(t, http.MethodPut, "/"+doc.ID, doc.EditToken, "", map[string]interface{}{"v": 2}, nil); status != http.StatusOK {
+		t.Fatalf("update with the edit token: status %d", status)
+	}
+	if got := ts.documentBody(t, doc.ID); got != `{"v":2}` {
+		t.Errorf("document = %s", got)
+	}
+
+	refused := []struct {
+		name, method, path, token string
+		body                      interface{}
+		want                      int
+	}{
+		{"wrong token", http.MethodPut, "/" + doc.ID, other.EditToken, map[string]interface{}{"v": 3}, http.StatusUnauthorized},
+		{"another guest document", http.MethodPut, "/" + other.ID, doc.EditToken, map[string]interface{}{"v": 3}, http.StatusUnauthorized},
+		{"a key's document", http.MethodPut, "/" + owned, doc.EditToken, map[string]interface{}{"v": 3}, http.StatusUnauthorized},
+		{"share", http.MethodPut, "/" + doc.ID + "/acl/someone", doc.EditToken, map[string]interface{}{"access": "read"}, http.StatusForbidden},
+		{"sign", http.MethodPost, "/" + doc.ID + "/sign", doc.EditToken, map[string]interface{}{}, http.StatusUnauthorized},
+		{"batch", http.MethodPost, "/batch", doc.EditToken, map[string]interface{}{"operations": []map[string]interface{}{{"op": "delete", "id": doc.ID}}}, http.StatusUnauthorized},
+	}
+	for _, tt := range refused {
+		if status := ts.withEditToken(t, tt.method, tt.path, tt.token, "", tt.body, nil); status != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.want)
+		}
+	}
+	if got := ts.documentBody(t, other.ID); got != `{"v":1}` {
+		t.Errorf("other guest document = %s, want it unchanged", got)
+	}
+
+	if status := ts.withEditToken(t, http.MethodDelete, "/"+doc.ID, doc.EditToken, "", nil, nil); status != http.StatusOK && status != http.StatusNoContent {
+		t.Fatalf("delete with the edit token: status %d", status)
+	}
+	if status := ts.withEditToken(t, http.MethodPut, "/"+doc.ID, doc.EditToken, "", map[string]interface{}{"v": 4}, nil); status != http.StatusUnauthorized {
+		t.Errorf("update after the deletion: status %d, want 401", status)
+	}
+}
+
+func TestEditTokenOnlyShortensExpiry(t *testing.T) {
+	ts := newTestServer(t)
+	doc := ts.createGuestDocument(t)
+
+	for _, expiry := range []string{"never", "100000"} {
+		if status := ts.withEditToken(t, http.MethodPut, "/"+doc.ID+"?expiry="+expiry, doc.EditToken, "", map[string]interface{}{"v": 2}, nil); status != http.StatusBadRequest {
+			t.Errorf("expiry=%s: status %d, want 400", expiry, status)
+		}
+	}
+
+	var updated guestDocument
+	if status := ts.withEditToken(t, http.MethodPut, "/"+doc.ID+"?expiry=1", doc.EditToken, "", map[string]interface{}{"v": 2}, &updated); status != http.StatusOK {
+		t.Fatalf("expiry=1: status %d, want 200", status)
+	}
+	if !updated.ExpiresAt.Before(doc.ExpiresAt) || updated.ExpiresAt.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expires_at = %v, want an hour from now, before %v", updated.ExpiresAt, doc.ExpiresAt)
+	}
+	// Without ?expiry= the shortened expiry is kept.
+	if status := ts.withEditToken(t, http.MethodPut, "/"+doc.ID, doc.EditToken, "", map[string]interface{}{"v": 3}, &updated); status != http.StatusOK {
+		t.Fatalf("update: status %d", status)
+	}
+	if updated.ExpiresAt.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expires_at = %v, want the shortened expiry kept", updated.ExpiresAt)
+	}
+}
+
+func TestEditTokenIsIgnoredWithAnAPIKey(t *testing.T) {
+	ts := newTestServer(t)
+	doc := ts.createGuestDocument(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	// The API key decides: it does not own the guest document, and the
+	// edit token next to it grants nothing.
+	if status := ts.withEditToken(t, http.MethodPut, "/"+doc.ID, doc.EditToken, key, map[string]interface{}{"v": 2}, nil); status != http.StatusNotFound {
+		t.Errorf("update with a key and the edit token: status %d, want 404", status)
+	}
+	if status := ts.withEditToken(t, http.MethodDelete, "/"+doc.ID, doc.EditToken, "not-a-key", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("delete with an invalid key and the edit token: status %d, want 401", status)
+	}
+	if got := ts.documentBody(t, doc.ID); got != `{"v":1}` {
+		t.Errorf("document = %s, want it unchanged", got)
+	}
+}
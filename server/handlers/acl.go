@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"pocketjson/storage"
+)
+
+// ListGrants lists the keys a document has been shared with. Only the
+// document's owner can see them.
+func ListGrants(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		doc, _, ok := loadSharedDocument(store, w, r)
+		if !ok {
+			return
+		}
+
+		grants, err := store.DB().ListGrants(r.Context(), doc.ID)
+		if err != nil {
+			log.Printf("failed to list grants: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":     doc.ID,
+			"grants": grants,
+		})
+	}
+}
+
+// GrantAccess shares a document with another key, or changes the access
+// that key already has.
+func GrantAccess(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Access string `json:"access"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		access, err := storage.ParseAccess(request.Access)
+		if err != nil {
+			http.Error(w, "access must be read or read-write", http.StatusBadRequest)
+			return
+		}
+
+		doc, caller, ok := loadSharedDocument(store, w, r)
+		if !ok {
+			return
+		}
+
+		keyID := chi.URLParam(r, "keyID")
+		setAuditTarget(r, doc.ID)
+		setAuditDetail(r, "key=%s access=%s", keyID, access)
+
+		if keyID != store.MasterKeyID() {
+			if _, err := store.DB().GetApiKeyByID(r.Context(), keyID); err != nil {
+				if strings.Contains(err.Error(), "not found") {
+					http.Error(w, "API key not found", http.StatusNotFound)
+					return
+				}
+				log.Printf("failed to load api key: %v", err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		grant := &storage.Grant{
+			DocumentID: doc.ID,
+			KeyID:      keyID,
+			Access:     access,
+			GrantedBy:  caller.KeyID,
+			CreatedAt:  time.Now(),
+		}
+		if err := store.DB().GrantAccess(r.Context(), grant); err != nil {
+			log.Printf("failed to grant access: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(grant)
+	}
+}
+
+// RevokeAccess removes a key's grant on a document.
+func RevokeAccess(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		doc, _, ok := loadSharedDocument(store, w, r)
+		if !ok {
+			return
+		}
+
+		keyID := chi.URLParam(r, "keyID")
+		setAuditTarget(r, doc.ID)
+		setAuditDetail(r, "key=%s", keyID)
+
+		if err := store.DB().RevokeAccess(r.Context(), doc.ID, keyID); err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				http.Error(w, "Grant not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("failed to revoke access: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// loadSharedDocument loads the document whose grants are being listed or
+// changed, along with the caller, who has to own it. Edit tokens and signed
+// URLs only reach a document's data and cannot decide who it is shared
+// with. On failure it writes the error response.
+func loadSharedDocument(store *storage.Store, w http.ResponseWriter, r *http.Request) (*storage.Document, *storage.Permissions, bool) {
+	doc, ok := loadManagedDocument(store, w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	caller, _ := authenticate(store, r)
+	if caller.Guest || caller.DocumentID != "" {
+		http.Error(w, "Edit tokens and signed URLs cannot manage sharing", http.StatusForbidden)
+		return nil, nil, false
+	}
+	return doc, caller, true
+}
+
+// hasGrant reports whether the calling key was granted at least the given
+// access to a document it does not own.
+func hasGrant(store *storage.Store, r *http.Request, perms *storage.Permissions, doc *storage.Document, want storage.Access) (bool, error) {
+	scope := storage.ScopeDocumentsRead
+	if want == storage.AccessReadWrite {
+		scope = storage.ScopeDocumentsWrite
+	}
+	if !perms.Has(scope) || (perms.DocumentID != "" && perms.DocumentID != doc.ID) {
+		return false, nil
+	}
+
+	access, err := store.DB().GetAccess(r.Context(), doc.ID, perms.KeyID)
+	if err != nil {
+		return false, err
+	}
+	return access == storage.AccessReadWrite || access == want, nil
+}
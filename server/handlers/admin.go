@@ -2,8 +2,12 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -12,77 +16,558 @@ import (
 	"pocketjson/utils"
 )
 
-func AdminOnly(store *storage.Store) func(http.HandlerFunc) http.HandlerFunc {
-	return func(next http.HandlerFunc) http.HandlerFunc {
-		return func(w http.ResponseWriter, r *http.Request) {
-			apiKey := r.Header.Get("X-API-Key")
-			isAuth, isAdmin, err := store.ValidateApiKey(r.Context(), apiKey)
+func CreateApiKey(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Description string     `json:"description"`
+			IsAdmin     bool       `json:"is_admin"`
+			Scopes      []string   `json:"scopes"`
+			IDPrefix    string     `json:"id_prefix"`
+			ExpiresAt   *time.Time `json:"expires_at"`
+			TenantID    string     `json:"tenant_id"`
+		}
 
-			if err != nil {
-				log.Printf("admin auth error: %v", err)
-				http.Error(w, "Server error", http.StatusInternalServerError)
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		ctx := r.Context()
+
+		var scopes []storage.Scope
+		if request.Scopes != nil {
+			var err error
+			if scopes, err = storage.ParseScopes(request.Scopes); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if request.IDPrefix != "" && !utils.IsValidCustomID(request.IDPrefix) {
+			http.Error(w, "Invalid id_prefix format", http.StatusBadRequest)
+			return
+		}
+
+		if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+			http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
+			return
+		}
+
+		caller, _ := authenticate(store, r)
+		if request.IsAdmin && !caller.IsAdmin {
+			http.Error(w, "Only admin keys can create admin keys", http.StatusForbidden)
+			return
+		}
+		if !caller.Covers(scopes) {
+			http.Error(w, "Cannot grant scopes the calling key does not hold", http.StatusForbidden)
+			return
+		}
+		// Keys created by non-admin keys stay in the creator's tenant and
+		// inherit its restrictions, which they can only narrow.
+		if !caller.IsAdmin {
+			if request.TenantID == "" {
+				request.TenantID = caller.TenantID
+			}
+			if request.Scopes == nil {
+				scopes = append([]storage.Scope(nil), caller.Scopes...)
+			}
+			if request.IDPrefix == "" {
+				request.IDPrefix = caller.IDPrefix
+			}
+			if request.ExpiresAt == nil {
+				request.ExpiresAt = caller.ExpiresAt
+			}
+			if err := checkIDPrefixRestriction(caller, request.IDPrefix); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			if err := checkExpiryRestriction(caller, request.ExpiresAt); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
 				return
 			}
+		}
 
-			if !isAuth || !isAdmin {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		namespace := ""
+		if request.TenantID != "" {
+			if !caller.IsAdmin && request.TenantID != caller.TenantID {
+				http.Error(w, "Cannot create keys in another tenant", http.StatusForbidden)
+				return
+			}
+			tenant, err := store.DB().GetTenant(ctx, request.TenantID)
+			if err != nil {
+				if strings.Contains(err.Error(), "not found") {
+					http.Error(w, "Tenant not found", http.StatusBadRequest)
+					return
+				}
+				log.Printf("failed to load tenant: %v", err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
 				return
 			}
+			namespace = tenant.Namespace()
+		}
 
-			next(w, r)
+		key, err := utils.GenerateRandomKey()
+		if err != nil {
+			log.Printf("failed to generate API key: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		clientID := utils.GetClientPrefix(key)
+		if namespace == "" {
+			namespace = clientID
 		}
+
+		apiKey := &storage.ApiKey{
+			Key:         key,
+			ClientID:    clientID,
+			Description: request.Description,
+			IsAdmin:     request.IsAdmin,
+			Scopes:      scopes,
+			IDPrefix:    request.IDPrefix,
+			CreatedAt:   time.Now(),
+			ExpiresAt:   request.ExpiresAt,
+			TenantID:    request.TenantID,
+			Namespace:   namespace,
+		}
+
+		if err := store.DB().CreateApiKey(ctx, apiKey); err != nil {
+			log.Printf("failed to create API key: %v", err)
+			http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+			return
+		}
+
+		setAuditTarget(r, apiKey.ClientID)
+		setAuditDetail(r, "tenant=%s is_admin=%t", apiKey.TenantID, apiKey.IsAdmin)
+
+		response := apiKeyResponse(apiKey)
+		response["key"] = key
+		json.NewEncoder(w).Encode(response)
 	}
 }
 
-func CreateApiKey(store *storage.Store) http.HandlerFunc {
+// RotateApiKey issues a new secret for an existing key. The key keeps its ID,
+// and therefore its namespace, and the old secret stays valid for a grace
+// period so clients can be updated without downtime. While that grace
+// period lasts the key can only be rotated again with grace_hours 0.
+func RotateApiKey(store *storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var request struct {
-			Description string `json:"description"`
-			IsAdmin     bool   `json:"is_admin"`
+			GraceHours *int `json:"grace_hours"`
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+
+		grace := store.Config().KeyRotationGrace
+		if request.GraceHours != nil {
+			if *request.GraceHours < 0 {
+				http.Error(w, "grace_hours cannot be negative", http.StatusBadRequest)
+				return
+			}
+			grace = time.Duration(*request.GraceHours) * time.Hour
+		}
+
+		apiKey, ok := loadManagedApiKey(store, w, r)
+		if !ok {
 			return
 		}
+		keyID := apiKey.ClientID
+		ctx := r.Context()
 
-		key, err := utils.GenerateRandomKey()
+		secret, err := utils.GenerateRandomKey()
 		if err != nil {
 			log.Printf("failed to generate API key: %v", err)
 			http.Error(w, "Server error", http.StatusInternalServerError)
 			return
 		}
 
-		if err := store.DB().CreateApiKey(r.Context(), key, request.Description, request.IsAdmin); err != nil {
-			log.Printf("failed to create API key: %v", err)
-			http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		var graceUntil time.Time
+		if grace > 0 {
+			graceUntil = time.Now().Add(grace)
+		}
+
+		if err := store.DB().RotateApiKey(ctx, keyID, secret, graceUntil); err != nil {
+			if strings.Contains(err.Error(), "grace period") {
+				http.Error(w, "Key was rotated recently: its "+err.Error()+"; rotate with grace_hours 0 to revoke it now", http.StatusConflict)
+				return
+			}
+			log.Printf("failed to rotate API key %s: %v", keyID, err)
+			http.Error(w, "Failed to rotate API key", http.StatusInternalServerError)
 			return
 		}
 
-		clientId := utils.GetClientPrefix(key)
+		store.InvalidateApiKeyCache(keyID)
 
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"key":         key,
-			"client_id":   clientId,
-			"description": request.Description,
-			"is_admin":    request.IsAdmin,
-			"created_at":  time.Now().Format(time.RFC3339),
-		})
+		response := map[string]interface{}{
+			"key":       secret,
+			"client_id": keyID,
+		}
+		if !graceUntil.IsZero() {
+			response["previous_key_expires_at"] = graceUntil.Format(time.RFC3339)
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// checkIDPrefixRestriction stops a non-admin key from giving a key a wider
+// ID prefix than its own.
+func checkIDPrefixRestriction(caller *storage.Permissions, idPrefix string) error {
+	if !caller.IsAdmin && !strings.HasPrefix(idPrefix, caller.IDPrefix) {
+		return fmt.Errorf("id_prefix must start with the calling key's prefix %s", caller.IDPrefix)
+	}
+	return nil
+}
+
+// checkExpiryRestriction stops a non-admin key from giving a key a later
+// expiry than its own.
+func checkExpiryRestriction(caller *storage.Permissions, expiresAt *time.Time) error {
+	if !caller.IsAdmin && caller.ExpiresAt != nil && (expiresAt == nil || expiresAt.After(*caller.ExpiresAt)) {
+		return errors.New("expires_at cannot be later than the calling key's expiry")
 	}
+	return nil
 }
 
+// DeleteApiKey deletes a key. ?documents= decides what happens to the
+// documents it created: keep (the default) leaves them orphaned, delete
+// removes them and transfer:<key-id> hands them over to another key.
 func DeleteApiKey(store *storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		keyToDelete := chi.URLParam(r, "key")
+		action, transferTo, ok := parseDocumentAction(r.URL.Query().Get("documents"))
+		if !ok {
+			http.Error(w, "documents must be one of delete, keep or transfer:<key-id>", http.StatusBadRequest)
+			return
+		}
+
+		apiKey, ok := loadManagedApiKey(store, w, r)
+		if !ok {
+			return
+		}
+		keyID := apiKey.ClientID
+		ctx := r.Context()
+
+		if action == storage.DocumentsTransfer {
+			if transferTo == keyID {
+				http.Error(w, "Cannot transfer documents to the key being deleted", http.StatusBadRequest)
+				return
+			}
+			caller, _ := authenticate(store, r)
+			target, err := store.DB().GetApiKeyByID(ctx, transferTo)
+			if err != nil || (!caller.IsAdmin && target.TenantID != caller.TenantID) {
+				http.Error(w, "Transfer target API key not found", http.StatusBadRequest)
+				return
+			}
+		}
 
-		if err := store.DB().DeleteApiKey(r.Context(), keyToDelete); err != nil {
-			log.Printf("failed to delete API key: %v", err)
+		affected, err := store.DB().DeleteApiKey(ctx, keyID, action, transferTo)
+		if err != nil {
+			if strings.Contains(err.Error(), "target api key not found") {
+				http.Error(w, "Transfer target API key not found", http.StatusBadRequest)
+				return
+			}
+			if strings.Contains(err.Error(), "not found") {
+				http.Error(w, "API key not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("failed to delete API key %s: %v", keyID, err)
 			http.Error(w, "Failed to delete API key", http.StatusInternalServerError)
 			return
 		}
 
-		store.InvalidateApiKeyCache(keyToDelete)
+		store.InvalidateApiKeyCache(keyID)
+		setAuditDetail(r, "documents=%s affected=%d", r.URL.Query().Get("documents"), affected)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"client_id":          keyID,
+			"documents":          action,
+			"documents_affected": affected,
+		})
+	}
+}
+
+func parseDocumentAction(value string) (storage.DocumentAction, string, bool) {
+	switch {
+	case value == "" || value == string(storage.DocumentsKeep):
+		return storage.DocumentsKeep, "", true
+	case value == string(storage.DocumentsDelete):
+		return storage.DocumentsDelete, "", true
+	case strings.HasPrefix(value, string(storage.DocumentsTransfer)+":"):
+		target := strings.TrimPrefix(value, string(storage.DocumentsTransfer)+":")
+		return storage.DocumentsTransfer, target, target != ""
+	}
+	return "", "", false
+}
+
+// ListApiKeys returns a page of keys, optionally filtered by description
+// substring, admin flag and tenant. Non-admin callers only see their tenant.
+func ListApiKeys(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit, offset, ok := parsePagination(w, r)
+		if !ok {
+			return
+		}
+
+		filter := storage.ApiKeyFilter{
+			Description: query.Get("description"),
+			TenantID:    query.Get("tenant_id"),
+		}
+		if v := query.Get("is_admin"); v != "" {
+			isAdmin, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "Invalid is_admin value", http.StatusBadRequest)
+				return
+			}
+			filter.IsAdmin = &isAdmin
+		}
+
+		caller, _ := authenticate(store, r)
+		if !caller.IsAdmin {
+			filter.TenantID = caller.TenantID
+		}
+
+		keys, total, err := store.DB().ListApiKeys(r.Context(), filter, limit, offset)
+		if err != nil {
+			log.Printf("failed to list API keys: %v", err)
+			http.Error(w, "Failed to list API keys", http.StatusInternalServerError)
+			return
+		}
+
+		items := make([]map[string]interface{}, len(keys))
+		for i, key := range keys {
+			items[i] = apiKeyResponse(key)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys":   items,
+			"total":  total,
+			"limit":  limit,
+			"offset": offset,
+		})
+	}
+}
+
+// GetApiKey describes a key along with the documents it has stored.
+func GetApiKey(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey, ok := loadManagedApiKey(store, w, r)
+		if !ok {
+			return
+		}
+
+		documents, bytes, err := store.DB().GetApiKeyStorage(r.Context(), apiKey.ClientID)
+		if err != nil {
+			log.Printf("failed to load storage of API key %s: %v", apiKey.ClientID, err)
+			http.Error(w, "Failed to load API key", http.StatusInternalServerError)
+			return
+		}
+
+		response := apiKeyResponse(apiKey)
+		response["document_count"] = documents
+		response["bytes_stored"] = bytes
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// PatchApiKey updates the description, admin flag, scopes, ID prefix or
+// expiry of a key. Cached permissions of the key are dropped right away.
+// Non-admin keys cannot set a prefix or expiry looser than their own.
+func PatchApiKey(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey, ok := loadManagedApiKey(store, w, r)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			Description *string         `json:"description"`
+			IsAdmin     *bool           `json:"is_admin"`
+			Scopes      *[]string       `json:"scopes"`
+			IDPrefix    *string         `json:"id_prefix"`
+			ExpiresAt   json.RawMessage `json:"expires_at"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		caller, _ := authenticate(store, r)
+		update := storage.ApiKeyUpdate{
+			Description: request.Description,
+			IsAdmin:     request.IsAdmin,
+			IDPrefix:    request.IDPrefix,
+		}
+
+		if request.IsAdmin != nil && !caller.IsAdmin {
+			http.Error(w, "Only admin keys can change is_admin", http.StatusForbidden)
+			return
+		}
+
+		if request.Scopes != nil {
+			scopes, err := storage.ParseScopes(*request.Scopes)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !caller.Covers(scopes) {
+				http.Error(w, "Cannot grant scopes the calling key does not hold", http.StatusForbidden)
+				return
+			}
+			update.Scopes = &scopes
+		}
+
+		if request.IDPrefix != nil && *request.IDPrefix != "" && !utils.IsValidCustomID(*request.IDPrefix) {
+			http.Error(w, "Invalid id_prefix format", http.StatusBadRequest)
+			return
+		}
+
+		if len(request.ExpiresAt) > 0 {
+			if string(request.ExpiresAt) == "null" {
+				update.ClearExpiresAt = true
+			} else {
+				var expiresAt time.Time
+				if err := json.Unmarshal(request.ExpiresAt, &expiresAt); err != nil {
+					http.Error(w, "Invalid expires_at, use RFC 3339", http.StatusBadRequest)
+					return
+				}
+				update.ExpiresAt = &expiresAt
+			}
+		}
+
+		// Non-admin keys cannot lift their own restrictions, and can only
+		// give other keys restrictions at least as tight as theirs.
+		changesRestrictions := request.IDPrefix != nil || len(request.ExpiresAt) > 0
+		if !caller.IsAdmin && changesRestrictions && apiKey.ClientID == caller.KeyID {
+			http.Error(w, "Cannot change the id_prefix or expires_at of the calling key", http.StatusForbidden)
+			return
+		}
+		if request.IDPrefix != nil {
+			if err := checkIDPrefixRestriction(caller, *request.IDPrefix); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		if len(request.ExpiresAt) > 0 {
+			if err := checkExpiryRestriction(caller, update.ExpiresAt); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+
+		ctx := r.Context()
+		if err := store.DB().PatchApiKey(ctx, apiKey.ClientID, update); err != nil {
+			log.Printf("failed to update API key %s: %v", apiKey.ClientID, err)
+			http.Error(w, "Failed to update API key", http.StatusInternalServerError)
+			return
+		}
+
+		store.InvalidateApiKeyCache(apiKey.ClientID)
+
+		updated, err := store.DB().GetApiKeyByID(ctx, apiKey.ClientID)
+		if err != nil {
+			log.Printf("failed to load API key %s: %v", apiKey.ClientID, err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(apiKeyResponse(updated))
+	}
+}
+
+// loadManagedApiKey loads the key named in the URL and checks that the
+// calling key may manage it: non-admin keys only manage non-admin keys of
+// their own tenant. On failure it writes the error response.
+func loadManagedApiKey(store *storage.Store, w http.ResponseWriter, r *http.Request) (*storage.ApiKey, bool) {
+	keyID := chi.URLParam(r, "id")
+
+	apiKey, err := store.DB().GetApiKeyByID(r.Context(), keyID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return nil, false
+		}
+		log.Printf("failed to load API key %s: %v", keyID, err)
+		http.Error(w, "Failed to load API key", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	caller, _ := authenticate(store, r)
+	if !caller.IsAdmin {
+		if apiKey.TenantID != caller.TenantID {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return nil, false
+		}
+		if apiKey.IsAdmin {
+			http.Error(w, "Only admin keys can manage admin keys", http.StatusForbidden)
+			return nil, false
+		}
+	}
+	return apiKey, true
+}
+
+// parsePagination reads ?limit= and ?offset=. On failure it writes the error
+// response.
+func parsePagination(w http.ResponseWriter, r *http.Request) (limit, offset int, ok bool) {
+	limit = 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return limit, offset, true
+}
+
+// apiKeyResponse describes a key without its secret.
+func apiKeyResponse(key *storage.ApiKey) map[string]interface{} {
+	response := map[string]interface{}{
+		"client_id":     key.ClientID,
+		"description":   key.Description,
+		"is_admin":      key.IsAdmin,
+		"scopes":        storage.EffectiveScopes(key),
+		"id_prefix":     key.IDPrefix,
+		"tenant_id":     key.TenantID,
+		"namespace":     key.Namespace,
+		"created_at":    key.CreatedAt.Format(time.RFC3339),
+		"expires_at":    formatOptionalTime(key.ExpiresAt),
+		"last_used_at":  formatOptionalTime(key.LastUsedAt),
+		"request_count": key.RequestCount,
+	}
+	if key.PreviousKeyExpiresAt != nil && key.PreviousKeyExpiresAt.After(time.Now()) {
+		response["previous_key_expires_at"] = key.PreviousKeyExpiresAt.Format(time.RFC3339)
+	}
+	return response
+}
+
+func formatOptionalTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Format(time.RFC3339)
+}
+
+func GetStats(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := store.DB().GetStats(r.Context())
+		if err != nil {
+			log.Printf("failed to load stats: %v", err)
+			http.Error(w, "Failed to load stats", http.StatusInternalServerError)
+			return
+		}
 
-		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(stats)
 	}
 }
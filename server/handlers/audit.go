@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"pocketjson/storage"
+)
+
+var auditCtxKey = &contextKey{"audit"}
+
+// Audited records an audit event for every request to the wrapped handler,
+// including rejected ones. The actor is whoever the handler authenticated,
+// and the target defaults to the {id} URL parameter; handlers can override
+// it and add detail with setAuditTarget and setAuditDetail.
+func Audited(store *storage.Store, action string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ev := &storage.AuditEvent{
+				Action:   action,
+				ClientIP: clientIP(r),
+				ActorKey: "guest",
+			}
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next(ww, r.WithContext(context.WithValue(r.Context(), auditCtxKey, ev)))
+
+			if ev.Target == "" {
+				ev.Target = chi.URLParam(r, "id")
+			}
+			ev.Timestamp = time.Now()
+			ev.Status = ww.Status()
+			if ev.Status == 0 {
+				ev.Status = http.StatusOK
+			}
+			ev.Outcome = storage.AuditSuccess
+			if ev.Status >= 400 {
+				ev.Outcome = storage.AuditFailure
+			}
+
+			// The request context may already be cancelled.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := store.DB().RecordAuditEvent(ctx, ev); err != nil {
+				log.Printf("failed to record audit event %s: %v", action, err)
+			}
+		}
+	}
+}
+
+func setAuditTarget(r *http.Request, target string) {
+	if ev, ok := r.Context().Value(auditCtxKey).(*storage.AuditEvent); ok {
+		ev.Target = target
+	}
+}
+
+func setAuditDetail(r *http.Request, format string, args ...interface{}) {
+	if ev, ok := r.Context().Value(auditCtxKey).(*storage.AuditEvent); ok {
+		ev.Detail = fmt.Sprintf(format, args...)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ListAuditEvents returns audit events filtered by actor, action (exact or
+// a prefix such as "key"), target, outcome, since and until. With
+// ?format=ndjson, or an Accept header asking for application/x-ndjson, every
+// matching event is streamed as newline-delimited JSON. Non-admin callers
+// only see events of their own tenant.
+func ListAuditEvents(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := storage.AuditFilter{
+			ActorKey: query.Get("actor"),
+			Action:   query.Get("action"),
+			Target:   query.Get("target"),
+			Outcome:  query.Get("outcome"),
+		}
+		for name, dest := range map[string]**time.Time{"since": &filter.Since, "until": &filter.Until} {
+			if v := query.Get(name); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					http.Error(w, "Invalid "+name+" value, use RFC 3339", http.StatusBadRequest)
+					return
+				}
+				*dest = &t
+			}
+		}
+
+		var after int64
+		if v := query.Get("after"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid after value", http.StatusBadRequest)
+				return
+			}
+			after = n
+		}
+
+		caller, _ := authenticate(store, r)
+		if !caller.IsAdmin {
+			filter.TenantID = caller.TenantID
+		}
+
+		if query.Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			enc := json.NewEncoder(w)
+			err := store.DB().ListAuditEvents(r.Context(), filter, after, 0, func(ev *storage.AuditEvent) error {
+				return enc.Encode(ev)
+			})
+			if err != nil {
+				log.Printf("failed to export audit events: %v", err)
+			}
+			return
+		}
+
+		limit, ok := parseLimit(w, r)
+		if !ok {
+			return
+		}
+
+		events := []*storage.AuditEvent{}
+		err := store.DB().ListAuditEvents(r.Context(), filter, after, limit, func(ev *storage.AuditEvent) error {
+			events = append(events, ev)
+			return nil
+		})
+		if err != nil {
+			log.Printf("failed to list audit events: %v", err)
+			http.Error(w, "Failed to list audit events", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"events":      events,
+			"next_cursor": nil,
+		}
+		if len(events) == limit {
+			response["next_cursor"] = events[len(events)-1].ID
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"pocketjson/storage"
+)
+
+type contextKey struct{ name string }
+
+var permissionsCtxKey = &contextKey{"permissions"}
+
+// authenticate resolves the permissions of the X-API-Key sent with the
+// request, of the signed URL it was made with, or of the X-Edit-Token of a
+// guest document. Guests get nil
+// permissions. The caller is recorded as the actor of the request's audit
+// event, if any.
+func authenticate(store *storage.Store, r *http.Request) (*storage.Permissions, error) {
+	if perms, ok := r.Context().Value(permissionsCtxKey).(*storage.Permissions); ok {
+		return perms, nil
+	}
+
+	var perms *storage.Permissions
+	var err error
+	query := r.URL.Query()
+	switch {
+	case query.Get(storage.SignatureParam) != "":
+		perms, err = store.VerifySignedURL(r.Context(), r.Method, r.URL.Path, chi.URLParam(r, "id"), query)
+	case r.Header.Get("X-API-Key") == "" && r.Header.Get("X-Edit-Token") != "":
+		perms, err = store.VerifyEditToken(r.Context(), chi.URLParam(r, "id"), r.Header.Get("X-Edit-Token"))
+	default:
+		perms, err = store.ValidateApiKey(r.Context(), r.Header.Get("X-API-Key"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ev, ok := r.Context().Value(auditCtxKey).(*storage.AuditEvent); ok && perms != nil {
+		ev.ActorKey = perms.KeyID
+		ev.TenantID = perms.TenantID
+		if perms.Guest {
+			ev.Detail = "edit token"
+		} else if perms.DocumentID != "" {
+			ev.Detail = "signed url"
+		}
+	}
+	return perms, nil
+}
+
+// RequireScope only lets requests through whose API key holds the scope.
+// The resolved permissions are stored in the request context.
+func RequireScope(store *storage.Store, scope storage.Scope) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			perms, err := authenticate(store, r)
+			if err != nil {
+				log.Printf("auth error: %v", err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+
+			if perms == nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			if !perms.Has(scope) {
+				http.Error(w, "Forbidden: missing scope "+string(scope), http.StatusForbidden)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), permissionsCtxKey, perms)
+			next(w, r.WithContext(ctx))
+		}
+	}
+}
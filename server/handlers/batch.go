@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"pocketjson/codec"
+	"pocketjson/storage"
+)
+
+// batchOp is one operation of a batch request.
+type batchOp struct {
+	Op         string          `json:"op"`
+	ID         string          `json:"id"`
+	Data       json.RawMessage `json:"data"`
+	Expiry     string          `json:"expiry"`
+	Visibility string          `json:"visibility"`
+}
+
+// batchResult reports the outcome of one operation.
+type batchResult struct {
+	Index     int             `json:"index"`
+	Op        string          `json:"op"`
+	ID        string          `json:"id,omitempty"`
+	Status    int             `json:"status"`
+	Error     string          `json:"error,omitempty"`
+	ExpiresAt string          `json:"expires_at,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// errBatchAborted rolls back an atomic batch after an operation failed.
+var errBatchAborted = errors.New("batch aborted")
+
+// Batch runs several document operations in one request. Operations run in
+// order and each gets its own status. With "atomic": true they share one
+// transaction, and a single failure rolls all of them back.
+func Batch(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := store.Config()
+		r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.BatchMaxBytes))
+
+		var request struct {
+			Atomic     bool      `json:"atomic"`
+			Operations []batchOp `json:"operations"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, fmt.Sprintf("Batch too large (max %d bytes)", cfg.BatchMaxBytes), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if len(request.Operations) == 0 {
+			http.Error(w, "operations must not be empty", http.StatusBadRequest)
+			return
+		}
+		if len(request.Operations) > cfg.BatchMaxOperations {
+			http.Error(w, fmt.Sprintf("Too many operations (max %d)", cfg.BatchMaxOperations), http.StatusBadRequest)
+			return
+		}
+
+		runBatch(store, w, r, request.Atomic, request.Operations)
+	}
+}
+
+// createNDJSONBatch creates one document with a random ID from every line
+// of an NDJSON body, as a batch of create operations. ?atomic=true creates
+// all of them or none, and ?expiry= and ?visibility= apply to each.
+func createNDJSONBatch(store *storage.Store, w http.ResponseWriter, r *http.Request) {
+	if format, reqErr := requestFormat(r); reqErr != nil || format != inputNDJSON {
+		http.Error(w, "ndjson=batch needs an application/x-ndjson body", http.StatusBadRequest)
+		return
+	}
+	if chi.URLParam(r, "id") != "" {
+		http.Error(w, "ndjson=batch creates documents with random IDs; post to / instead", http.StatusBadRequest)
+		return
+	}
+
+	cfg := store.Config()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(cfg.BatchMaxBytes)))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Batch too large (max %d bytes)", cfg.BatchMaxBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	lines, err := codec.DecodeNDJSON(body)
+	if err != nil {
+		http.Error(w, "Invalid NDJSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(lines) == 0 {
+		http.Error(w, "operations must not be empty", http.StatusBadRequest)
+		return
+	}
+	if len(lines) > cfg.BatchMaxOperations {
+		http.Error(w, fmt.Sprintf("Too many operations (max %d)", cfg.BatchMaxOperations), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	ops := make([]batchOp, len(lines))
+	for i, line := range lines {
+		ops[i] = batchOp{Op: "create", Data: line, Expiry: query.Get("expiry"), Visibility: query.Get("visibility")}
+	}
+	runBatch(store, w, r, query.Get("atomic") == "true", ops)
+}
+
+// runBatch runs the operations of a batch and writes the response.
+func runBatch(store *storage.Store, w http.ResponseWriter, r *http.Request, atomic bool, ops []batchOp) {
+	// Batches need an API key; signed URLs and edit tokens cover a
+	// single document.
+	perms, _ := authenticate(store, r)
+	if perms == nil || perms.DocumentID != "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ctx := r.Context()
+	results := make([]*batchResult, len(ops))
+	committed := true
+
+	if atomic {
+		err := store.DB().Atomic(ctx, func(tx *storage.Tx) error {
+			for i, op := range ops {
+				results[i] = runBatchOp(ctx, store, r, tx, perms, i, op)
+				if results[i].Status >= 400 {
+					return errBatchAborted
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			if err != errBatchAborted {
+				log.Printf("batch transaction failed: %v", err)
+			}
+			committed = false
+			rollBackResults(results, ops)
+		}
+	} else {
+		for i, op := range ops {
+			results[i] = runBatchOp(ctx, store, r, store.DB(), perms, i, op)
+		}
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Status >= 400 {
+			failed++
+		}
+	}
+	setAuditTarget(r, "")
+	setAuditDetail(r, "operations=%d failed=%d atomic=%t committed=%t", len(results), failed, atomic, committed)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"atomic":    atomic,
+		"committed": committed,
+		"results":   results,
+	})
+}
+
+// rollBackResults rewrites the results of an atomic batch that was rolled
+// back: operations that had succeeded were undone, and those after the
+// failing one never ran.
+func rollBackResults(results []*batchResult, ops []batchOp) {
+	for i, result := range results {
+		switch {
+		case result == nil:
+			results[i] = &batchResult{Index: i, Op: ops[i].Op, ID: ops[i].ID, Status: http.StatusFailedDependency, Error: "Not executed, batch rolled back"}
+		case result.Status < 400:
+			results[i] = &batchResult{Index: i, Op: result.Op, ID: result.ID, Status: http.StatusFailedDependency, Error: "Rolled back"}
+		}
+	}
+}
+
+func runBatchOp(ctx context.Context, store *storage.Store, r *http.Request, docs documentStore, perms *storage.Permissions, index int, op batchOp) *batchResult {
+	result := &batchResult{Index: index, Op: op.Op, ID: op.ID}
+	fail := func(status int, message string) *batchResult {
+		result.Status, result.Error = status, message
+		return result
+	}
+
+	var scope storage.Scope
+	switch op.Op {
+	case "get":
+		scope = storage.ScopeDocumentsRead
+	case "create", "put", "patch":
+		scope = storage.ScopeDocumentsWrite
+	case "delete":
+		scope = storage.ScopeDocumentsDelete
+	default:
+		return fail(http.StatusBadRequest, "op must be get, create, put, patch or delete")
+	}
+	if !perms.Has(scope) {
+		return fail(http.StatusForbidden, "Forbidden: missing scope "+string(scope))
+	}
+	if op.Op != "create" && op.ID == "" {
+		return fail(http.StatusBadRequest, "id is required")
+	}
+
+	var data []byte
+	if op.Op == "create" || op.Op == "put" || op.Op == "patch" {
+		var err error
+		if data, err = compactDocument(op.Data); err != nil {
+			return fail(http.StatusBadRequest, "data must be a JSON object or array")
+		}
+	}
+	maxSize := store.Config().AuthenticatedSize
+
+	if op.Op == "create" {
+		visibility := storage.VisibilityPublic
+		if op.Visibility != "" {
+			var err error
+			if visibility, err = storage.ParseVisibility(op.Visibility); err != nil {
+				return fail(http.StatusBadRequest, "visibility must be public, private or tenant")
+			}
+		}
+		id, reqErr := newDocumentID(ctx, docs, perms, op.ID)
+		if reqErr != nil {
+			return fail(reqErr.status, reqErr.message)
+		}
+		result.ID = id
+		if len(data) > maxSize {
+			return fail(http.StatusBadRequest, "JSON too large")
+		}
+
+		expiry := parseExpiryValue(op.Expiry, time.Now().Add(store.Config().DefaultExpiry))
+		if err := docs.CreateJSON(ctx, id, string(data), expiry, perms.KeyID, perms.TenantID, visibility, storage.KindDocument, ""); err != nil {
+			if isDuplicateID(err) {
+				return fail(http.StatusConflict, "ID already exists")
+			}
+			log.Printf("failed to store JSON: %v", err)
+			return fail(http.StatusInternalServerError, "Failed to store JSON")
+		}
+		result.Status = http.StatusOK
+		result.ExpiresAt = expiry.Format(time.RFC3339)
+		return result
+	}
+
+	doc, err := docs.GetDocument(ctx, op.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return fail(http.StatusNotFound, "JSON not found")
+		}
+		log.Printf("failed to load document: %v", err)
+		return fail(http.StatusInternalServerError, "Failed to retrieve JSON")
+	}
+	result.ID = doc.ID
+
+	// Documents the caller may not access are reported as missing, as in
+	// the single-document endpoints.
+	var allowed bool
+	switch op.Op {
+	case "get":
+		allowed, err = canReadDocument(store, r, perms, doc)
+	case "put", "patch":
+		allowed = perms.CanManageDocument(doc)
+		if !allowed {
+			allowed, err = hasGrant(store, r, perms, doc, storage.AccessReadWrite)
+		}
+	case "delete":
+		allowed = perms.CanManageDocument(doc)
+	}
+	if err != nil {
+		log.Printf("failed to check document access: %v", err)
+		return fail(http.StatusInternalServerError, "Server error")
+	}
+	if !allowed {
+		return fail(http.StatusNotFound, "JSON not found")
+	}
+
+	switch op.Op {
+	case "get":
+		current, err := docs.GetJSON(ctx, doc.ID)
+		if err != nil {
+			log.Printf("failed to read JSON: %v", err)
+			return fail(http.StatusInternalServerError, "Failed to retrieve JSON")
+		}
+		result.Data = json.RawMessage(current)
+		result.ExpiresAt = doc.ExpiresAt.Format(time.RFC3339)
+
+	case "put", "patch":
+		if op.Op == "patch" {
+			current, err := docs.GetJSON(ctx, doc.ID)
+			if err != nil {
+				log.Printf("failed to read JSON: %v", err)
+				return fail(http.StatusInternalServerError, "Failed to retrieve JSON")
+			}
+			if data, err = mergePatch([]byte(current), data); err != nil {
+				log.Printf("failed to patch JSON: %v", err)
+				return fail(http.StatusInternalServerError, "Failed to process JSON")
+			}
+		}
+		if len(data) > maxSize {
+			return fail(http.StatusBadRequest, "JSON too large")
+		}
+
+		expiry := parseExpiryValue(op.Expiry, doc.ExpiresAt)
+		if err := docs.UpdateJSON(ctx, doc.ID, string(data), expiry); err != nil {
+			log.Printf("failed to update JSON: %v", err)
+			return fail(http.StatusInternalServerError, "Failed to store JSON")
+		}
+		result.ExpiresAt = expiry.Format(time.RFC3339)
+
+	case "delete":
+		if err := docs.DeleteJSON(ctx, doc.ID); err != nil {
+			log.Printf("failed to delete JSON: %v", err)
+			return fail(http.StatusInternalServerError, "Failed to delete JSON")
+		}
+	}
+
+	result.Status = http.StatusOK
+	return result
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386) to a document: members
+// of the patch replace those of the document, objects are merged
+// recursively and null removes a member. An object patch turns an array
+// document into an object, and any other patch replaces the document.
+func mergePatch(doc, patch []byte) ([]byte, error) {
+	current, err := decodeJSONValue(doc)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := decodeJSONValue(patch)
+	if err != nil {
+		return nil, err
+	}
+	object, ok := changes.(map[string]interface{})
+	if !ok {
+		return json.Marshal(changes)
+	}
+	target, _ := current.(map[string]interface{})
+	return json.Marshal(mergeObjects(target, object))
+}
+
+func mergeObjects(target, patch map[string]interface{}) map[string]interface{} {
+	if target == nil {
+		target = map[string]interface{}{}
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(target, key)
+			continue
+		}
+		if sub, ok := value.(map[string]interface{}); ok {
+			existing, _ := target[key].(map[string]interface{})
+			target[key] = mergeObjects(existing, sub)
+			continue
+		}
+		target[key] = value
+	}
+	return target
+}
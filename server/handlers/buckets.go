@@ -0,0 +1,419 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+
+	"pocketjson/storage"
+	"pocketjson/utils"
+)
+
+// replayClient resends captured requests. It only connects to public
+// addresses, and redirects are returned to the caller rather than followed.
+var replayClient = func() *http.Client {
+	client := utils.PublicHTTPClient(10 * time.Second)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return client
+}()
+
+// replayResponseLimit caps how much of a replay target's answer is returned.
+const replayResponseLimit = 64 * 1024
+
+// hopHeaders are not copied when a captured request is replayed; they
+// describe the original connection rather than the request.
+var hopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Host":                true,
+	"Content-Length":      true,
+	"Accept-Encoding":     true,
+}
+
+// credentialHeaders are not copied either: a captured request may carry
+// someone's credentials, and replaying them to an arbitrary URL would hand
+// them over.
+var credentialHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	"X-Api-Key":     true,
+	"X-Auth-Token":  true,
+	"X-Edit-Token":  true,
+}
+
+// CreateBucket creates a catcher bucket for the calling key. Its URL
+// records any request sent to it until the bucket expires.
+func CreateBucket(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := authenticate(store, r)
+		if caller.DocumentID != "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		id, err := utils.GenerateRandomKey()
+		if err != nil {
+			log.Printf("failed to generate bucket id: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		bucket := &storage.Bucket{
+			ID:        id,
+			KeyID:     caller.KeyID,
+			TenantID:  caller.TenantID,
+			CreatedAt: now,
+			ExpiresAt: parseExpiry(r, now.Add(store.Config().DefaultExpiry)),
+		}
+		setAuditTarget(r, bucket.ID)
+
+		if err := store.DB().CreateBucket(r.Context(), bucket); err != nil {
+			log.Printf("failed to create bucket: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(bucketResponse(r, bucket))
+	}
+}
+
+// ListBuckets lists the buckets of the calling key.
+func ListBuckets(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := authenticate(store, r)
+		buckets, err := store.DB().ListBuckets(r.Context(), caller.KeyID)
+		if err != nil {
+			log.Printf("failed to list buckets: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		response := make([]map[string]interface{}, len(buckets))
+		for i, bucket := range buckets {
+			response[i] = bucketResponse(r, bucket)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"buckets": response})
+	}
+}
+
+// DeleteBucket removes a bucket and everything it recorded.
+func DeleteBucket(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket, ok := loadBucket(store, w, r)
+		if !ok {
+			return
+		}
+
+		if err := store.DB().DeleteBucket(r.Context(), bucket.ID); err != nil {
+			log.Printf("failed to delete bucket: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// CatchRequest records whatever is sent to a bucket's URL: any method, any
+// content type, and any path below it. Bodies above the configured limit
+// are cut off and marked as truncated.
+func CatchRequest(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		maxBody := store.Config().BucketMaxBody
+		body, err := io.ReadAll(io.LimitReader(r.Body, int64(maxBody)+1))
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		request := &storage.CapturedRequest{
+			Method:     r.Method,
+			Path:       "/" + chi.URLParam(r, "*"),
+			Query:      r.URL.Query(),
+			Headers:    r.Header.Clone(),
+			RemoteAddr: clientIP(r),
+			ReceivedAt: time.Now(),
+		}
+		request.Headers["Host"] = []string{r.Host}
+		if len(body) > maxBody {
+			body = body[:maxBody]
+			request.Truncated = true
+		}
+		request.BodySize = len(body)
+		if utf8.Valid(body) {
+			request.Body, request.BodyEncoding = string(body), storage.BodyText
+		} else {
+			request.Body, request.BodyEncoding = base64.StdEncoding.EncodeToString(body), storage.BodyBase64
+		}
+
+		err = store.DB().CaptureRequest(r.Context(), chi.URLParam(r, "id"), request, store.Config().BucketMaxRecords)
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				http.Error(w, "Bucket not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("failed to capture request: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": request.ID})
+	}
+}
+
+// ListCapturedRequests pages through the requests recorded by a bucket,
+// oldest first. With ?feed=eventsource new requests are streamed as
+// Server-Sent Events as they arrive.
+func ListCapturedRequests(store *storage.Store, streams *Streams) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket, ok := loadBucket(store, w, r)
+		if !ok {
+			return
+		}
+
+		var after int64
+		if v := r.URL.Query().Get("after"); v != "" {
+			var err error
+			if after, err = strconv.ParseInt(v, 10, 64); err != nil || after < 0 {
+				http.Error(w, "after must be a record id", http.StatusBadRequest)
+				return
+			}
+		}
+		limit, ok := parseLimit(w, r)
+		if !ok {
+			return
+		}
+
+		switch r.URL.Query().Get("feed") {
+		case "", "normal":
+			requests, err := store.DB().ListCapturedRequests(r.Context(), bucket.ID, after, limit)
+			if err != nil {
+				log.Printf("failed to list captured requests: %v", err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"requests": requests})
+		case "eventsource":
+			if v, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+				after = v
+			}
+			caller, _ := authenticate(store, r)
+			streamCapturedRequests(store, streams, w, r, caller, bucket, after, limit)
+		default:
+			http.Error(w, "feed must be normal or eventsource", http.StatusBadRequest)
+		}
+	}
+}
+
+// streamCapturedRequests sends every record after the given ID as a
+// "request" event whose ID is the record ID, then waits for new ones until
+// the bucket goes away.
+func streamCapturedRequests(store *storage.Store, streams *Streams, w http.ResponseWriter, r *http.Request, caller *storage.Permissions, bucket *storage.Bucket, after int64, limit int) {
+	release, ok := streams.acquire(clientIP(r), caller.KeyID)
+	if !ok {
+		http.Error(w, "Too many open streams", http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	stream, ok := startEventStream(w)
+	if !ok {
+		return
+	}
+
+	expiry := time.NewTimer(time.Until(bucket.ExpiresAt))
+	defer expiry.Stop()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		captured := store.DB().Captured()
+		requests, err := store.DB().ListCapturedRequests(r.Context(), bucket.ID, after, limit)
+		if err != nil {
+			log.Printf("failed to list captured requests: %v", err)
+			return
+		}
+		for _, request := range requests {
+			data, _ := json.Marshal(request)
+			if stream.send(strconv.FormatInt(request.ID, 10), "request", string(data)) != nil {
+				return
+			}
+			after = request.ID
+		}
+		if len(requests) == limit {
+			continue
+		}
+
+		for waiting := true; waiting; {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-streams.Done():
+				return
+			case <-expiry.C:
+				return
+			case <-heartbeat.C:
+				if stream.heartbeat() != nil {
+					return
+				}
+			case <-captured:
+				waiting = false
+			}
+		}
+	}
+}
+
+// ReplayRequest sends a captured request again, to the URL given in the
+// body, which has to be on a public address. Method, headers other than
+// credentials and body are copied; the captured query string is used unless
+// the URL has one of its own. The response reports what the target
+// answered.
+func ReplayRequest(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bucket, ok := loadBucket(store, w, r)
+		if !ok {
+			return
+		}
+
+		var request struct {
+			URL string `json:"url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		target, err := url.Parse(request.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+			return
+		}
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "recordID"), 10, 64)
+		if err != nil {
+			http.Error(w, "Record not found", http.StatusNotFound)
+			return
+		}
+		captured, err := store.DB().GetCapturedRequest(r.Context(), bucket.ID, id)
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				http.Error(w, "Record not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("failed to load captured request: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		setAuditDetail(r, "record=%d url=%s", id, target.Redacted())
+
+		if captured.Truncated {
+			http.Error(w, "The captured body was truncated and cannot be replayed", http.StatusConflict)
+			return
+		}
+		body := []byte(captured.Body)
+		if captured.BodyEncoding == storage.BodyBase64 {
+			if body, err = base64.StdEncoding.DecodeString(captured.Body); err != nil {
+				log.Printf("failed to decode captured body: %v", err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if target.RawQuery == "" {
+			target.RawQuery = url.Values(captured.Query).Encode()
+		}
+
+		outgoing, err := http.NewRequestWithContext(r.Context(), captured.Method, target.String(), bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, "Cannot replay this request", http.StatusBadRequest)
+			return
+		}
+		for name, values := range captured.Headers {
+			canonical := http.CanonicalHeaderKey(name)
+			if !hopHeaders[canonical] && !credentialHeaders[canonical] {
+				outgoing.Header[name] = values
+			}
+		}
+
+		resp, err := replayClient.Do(outgoing)
+		if err != nil {
+			http.Error(w, "Replay failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+
+		answer, err := io.ReadAll(io.LimitReader(resp.Body, replayResponseLimit+1))
+		if err != nil {
+			http.Error(w, "Replay failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		truncated := len(answer) > replayResponseLimit
+		if truncated {
+			answer = answer[:replayResponseLimit]
+		}
+		encoding, text := storage.BodyText, string(answer)
+		if !utf8.Valid(answer) {
+			encoding, text = storage.BodyBase64, base64.StdEncoding.EncodeToString(answer)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":        resp.StatusCode,
+			"headers":       resp.Header,
+			"body":          text,
+			"body_encoding": encoding,
+			"truncated":     truncated,
+		})
+	}
+}
+
+// loadBucket loads the bucket named in the URL. Buckets of other keys are
+// reported as missing, except to admins.
+func loadBucket(store *storage.Store, w http.ResponseWriter, r *http.Request) (*storage.Bucket, bool) {
+	bucket, err := store.DB().GetBucket(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Bucket not found", http.StatusNotFound)
+			return nil, false
+		}
+		log.Printf("failed to load bucket: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	caller, _ := authenticate(store, r)
+	if caller.DocumentID != "" || (bucket.KeyID != caller.KeyID && !caller.IsAdmin) {
+		http.Error(w, "Bucket not found", http.StatusNotFound)
+		return nil, false
+	}
+	return bucket, true
+}
+
+func bucketResponse(r *http.Request, bucket *storage.Bucket) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         bucket.ID,
+		"url":        baseURL(r) + "/catch/" + bucket.ID,
+		"key_id":     bucket.KeyID,
+		"created_at": bucket.CreatedAt.Format(time.RFC3339),
+		"expires_at": bucket.ExpiresAt.Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	_ "github.com/mattn/go-sqlite3"
+
+	"pocketjson/config"
+	"pocketjson/storage"
+)
+
+const testMasterKey = "test-master-key-0123456789abcdef"
+
+func TestReplayStripsCredentialsAndHopHeaders(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "test.db") + "?_fk=1&_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
+	db, err := storage.NewDB(dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	cfg := config.Load()
+	cfg.MasterAPIKey = testMasterKey
+	store := storage.New(db, cfg)
+	t.Cleanup(func() {
+		store.Shutdown()
+		db.Close()
+	})
+
+	// httptest servers listen on loopback, which the real client refuses.
+	previous := replayClient
+	replayClient = &http.Client{Timeout: 10 * time.Second}
+	t.Cleanup(func() { replayClient = previous })
+
+	var received *http.Request
+	var receivedBody string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received, receivedBody = r, string(body)
+		w.Header().Set("X-Answer", "yes")
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "thanks")
+	}))
+	defer target.Close()
+
+	ctx := context.Background()
+	bucket := &storage.Bucket{ID: "b1", KeyID: "k1", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	if err := db.CreateBucket(ctx, bucket); err != nil {
+		t.Fatalf("failed to create bucket: %v", err)
+	}
+	captured := &storage.CapturedRequest{
+		Method: http.MethodPut,
+		Path:   "/hook",
+		Query:  map[string][]string{"delivery": {"7"}},
+		Headers: map[string][]string{
+			"Content-Type":        {"application/json"},
+			"X-Hub-Signature":     {"sha256=abc"},
+			"Authorization":       {"Bearer secret"},
+			"Cookie":              {"session=secret"},
+			"X-Api-Key":           {"secret"},
+			"X-Auth-Token":        {"secret"},
+			"X-Edit-Token":        {"secret"},
+			"Proxy-Authorization": {"Basic secret"},
+			"Connection":          {"close"},
+			"Host":                {"catcher.example"},
+		},
+		Body:         `{"a":1}`,
+		BodyEncoding: storage.BodyText,
+		BodySize:     7,
+		ReceivedAt:   time.Now(),
+	}
+	if err := db.CaptureRequest(ctx, bucket.ID, captured, 10); err != nil {
+		t.Fatalf("failed to capture request: %v", err)
+	}
+
+	router := chi.NewRouter()
+	router.Post("/buckets/{id}/requests/{recordID}/replay", ReplayRequest(store))
+	req := httptest.NewRequest(http.MethodPost, "/buckets/b1/requests/1/replay", strings.NewReader(`{"url":"`+target.URL+`/elsewhere"}`))
+	req.Header.Set("X-API-Key", testMasterKey)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("replay: status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if received == nil {
+		t.Fatal("the target was not reached")
+	}
+	if received.Method != http.MethodPut || received.URL.Path != "/elsewhere" || received.URL.RawQuery != "delivery=7" || receivedBody != `{"a":1}` {
+		t.Errorf("target got %s %s?%s %q", received.Method, received.URL.Path, received.URL.RawQuery, receivedBody)
+	}
+	for _, name := range []string{"Content-Type", "X-Hub-Signature"} {
+		if received.Header.Get(name) != captured.Headers[name][0] {
+			t.Errorf("%s = %q, want it copied", name, received.Header.Get(name))
+		}
+	}
+	for _, name := range []string{"Authorization", "Cookie", "X-Api-Key", "X-Auth-Token", "X-Edit-Token", "Proxy-Authorization"} {
+		if got := received.Header.Get(name); got != "" {
+			t.Errorf("%s = %q, want it stripped", name, got)
+		}
+	}
+	if received.Host == "catcher.example" {
+		t.Error("the captured Host header was sent")
+	}
+
+	var answer struct {
+		Status  int         `json:"status"`
+		Headers http.Header `json:"headers"`
+		Body    string      `json:"body"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil {
+		t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+	}
+	if answer.Status != http.StatusAccepted || answer.Headers.Get("X-Answer") != "yes" || answer.Body != "thanks" {
+		t.Errorf("answer = %+v", answer)
+	}
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"pocketjson/storage"
+)
+
+// ListChanges serves the changes feed of the caller's tenant: every write
+// and deletion after ?since=, in order. ?feed=longpoll waits up to
+// ?timeout= seconds for the first change, and ?feed=eventsource keeps
+// streaming changes as Server-Sent Events.
+func ListChanges(store *storage.Store, streams *Streams) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		caller, _ := authenticate(store, r)
+		if caller.DocumentID != "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		filter := storage.ChangeFilter{
+			TenantID: caller.TenantID,
+			IDPrefix: query.Get("prefix"),
+		}
+		if caller.IsAdmin {
+			filter.TenantID = query.Get("tenant_id")
+		}
+		if filter.IDPrefix == "" {
+			filter.IDPrefix = caller.IDPrefix
+		}
+		if !caller.AllowsID(filter.IDPrefix) {
+			http.Error(w, "Forbidden: prefix must start with "+caller.IDPrefix, http.StatusForbidden)
+			return
+		}
+
+		limit, ok := parseLimit(w, r)
+		if !ok {
+			return
+		}
+
+		var since int64
+		switch v := query.Get("since"); v {
+		case "", "0":
+		case "now":
+			var err error
+			if since, err = store.DB().LastSeq(r.Context()); err != nil {
+				log.Printf("failed to read last sequence number: %v", err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+		default:
+			var err error
+			if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < 0 {
+				http.Error(w, "since must be a sequence number or now", http.StatusBadRequest)
+				return
+			}
+		}
+
+		switch query.Get("feed") {
+		case "", "normal":
+			pollChanges(store, w, r, filter, since, limit, 0)
+		case "longpoll":
+			timeout := 30 * time.Second
+			if v := query.Get("timeout"); v != "" {
+				seconds, err := strconv.Atoi(v)
+				if err != nil || seconds < 1 || seconds > 60 {
+					http.Error(w, "timeout must be between 1 and 60 seconds", http.StatusBadRequest)
+					return
+				}
+				timeout = time.Duration(seconds) * time.Second
+			}
+			pollChanges(store, w, r, filter, since, limit, timeout)
+		case "eventsource":
+			if v, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+				since = v
+			}
+			streamChanges(store, streams, w, r, caller, filter, since, limit)
+		default:
+			http.Error(w, "feed must be normal, longpoll or eventsource", http.StatusBadRequest)
+		}
+	}
+}
+
+// pollChanges answers with the changes after since. With a timeout it waits
+// for at least one change before answering, or until the timeout passes.
+func pollChanges(store *storage.Store, w http.ResponseWriter, r *http.Request, filter storage.ChangeFilter, since int64, limit int, timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		changed := store.DB().Changed()
+		changes, err := store.DB().ListChanges(r.Context(), filter, since, limit)
+		if err != nil {
+			log.Printf("failed to list changes: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		if len(changes) > 0 || timeout == 0 {
+			writeChanges(w, changes, since)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-deadline.C:
+			writeChanges(w, changes, since)
+			return
+		case <-changed:
+		}
+	}
+}
+
+func writeChanges(w http.ResponseWriter, changes []*storage.Change, since int64) {
+	lastSeq := since
+	if len(changes) > 0 {
+		lastSeq = changes[len(changes)-1].Seq
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results":  changes,
+		"last_seq": lastSeq,
+	})
+}
+
+// streamChanges sends every change after since as a "change" event whose
+// ID is its sequence number, then keeps the stream open for new ones.
+func streamChanges(store *storage.Store, streams *Streams, w http.ResponseWriter, r *http.Request, caller *storage.Permissions, filter storage.ChangeFilter, since int64, limit int) {
+	release, ok := streams.acquire(clientIP(r), caller.KeyID)
+	if !ok {
+		http.Error(w, "Too many open streams", http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	stream, ok := startEventStream(w)
+	if !ok {
+		return
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		changed := store.DB().Changed()
+		changes, err := store.DB().ListChanges(r.Context(), filter, since, limit)
+		if err != nil {
+			log.Printf("failed to list changes: %v", err)
+			return
+		}
+		for _, change := range changes {
+			data, _ := json.Marshal(change)
+			if stream.send(strconv.FormatInt(change.Seq, 10), "change", string(data)) != nil {
+				return
+			}
+			since = change.Seq
+		}
+		if len(changes) == limit {
+			continue
+		}
+
+		for waiting := true; waiting; {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-streams.Done():
+				return
+			case <-heartbeat.C:
+				if stream.heartbeat() != nil {
+					return
+				}
+			case <-changed:
+				waiting = false
+			}
+		}
+	}
+}
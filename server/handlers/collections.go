@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"pocketjson/storage"
+)
+
+// AppendItem adds the request body as a new item of a collection. Items are
+// stored on their own, so appending does not rewrite the collection. With
+// ?ttl= (seconds) the item expires before the collection does.
+func AppendItem(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jsonBytes, ok := readJSONBody(w, r)
+		if !ok {
+			return
+		}
+
+		var expiresAt *time.Time
+		if v := r.URL.Query().Get("ttl"); v != "" {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds < 1 {
+				http.Error(w, "ttl must be a positive number of seconds", http.StatusBadRequest)
+				return
+			}
+			t := time.Now().Add(time.Duration(seconds) * time.Second)
+			expiresAt = &t
+		}
+
+		doc, ok := loadWritableDocument(store, w, r)
+		if !ok {
+			return
+		}
+
+		perms, _ := authenticate(store, r)
+		cfg := store.Config()
+		maxSize := cfg.AuthenticatedSize
+		if perms.Guest {
+			maxSize = cfg.DefaultMaxSize
+		}
+		if len(jsonBytes) > maxSize {
+			http.Error(w, "JSON too large", http.StatusBadRequest)
+			return
+		}
+
+		limits := storage.CollectionLimits{MaxItems: cfg.CollectionMaxItems, MaxBytes: cfg.CollectionMaxBytes}
+		item, err := store.DB().AppendItem(r.Context(), doc.ID, string(jsonBytes), expiresAt, limits)
+		if err != nil {
+			switch {
+			case strings.Contains(err.Error(), "not found"):
+				http.Error(w, "JSON not found", http.StatusNotFound)
+			case strings.Contains(err.Error(), "not a collection"):
+				http.Error(w, "Document is not a collection", http.StatusConflict)
+			case strings.Contains(err.Error(), "collection is full"):
+				http.Error(w, "Collection is full"+strings.TrimPrefix(err.Error(), "collection is full"), http.StatusInsufficientStorage)
+			default:
+				log.Printf("failed to append item: %v", err)
+				http.Error(w, "Failed to store JSON", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		setAuditDetail(r, "item=%d", item.ID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(item)
+	}
+}
+
+// ListItems pages through the items of a collection, oldest first. Pass the
+// returned next_after as ?after= to get the following page. Anyone who may
+// read the collection may read its items.
+func ListItems(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var after int64
+		if v := r.URL.Query().Get("after"); v != "" {
+			var err error
+			if after, err = strconv.ParseInt(v, 10, 64); err != nil || after < 0 {
+				http.Error(w, "after must be an item id", http.StatusBadRequest)
+				return
+			}
+		}
+		limit, ok := parseLimit(w, r)
+		if !ok {
+			return
+		}
+
+		doc, _, ok := loadReadableDocument(store, w, r)
+		if !ok {
+			return
+		}
+		if doc.Kind != storage.KindCollection {
+			http.Error(w, "Document is not a collection", http.StatusConflict)
+			return
+		}
+
+		items, err := store.DB().ListItems(r.Context(), doc.ID, after, limit)
+		if err != nil {
+			log.Printf("failed to list items: %v", err)
+			http.Error(w, "Failed to retrieve JSON", http.StatusInternalServerError)
+			return
+		}
+		count, size, err := store.DB().CollectionUsage(r.Context(), doc.ID)
+		if err != nil {
+			log.Printf("failed to read collection usage: %v", err)
+			http.Error(w, "Failed to retrieve JSON", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"id":    doc.ID,
+			"items": items,
+			"count": count,
+			"bytes": size,
+		}
+		if len(items) == limit {
+			response["next_after"] = items[len(items)-1].ID
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
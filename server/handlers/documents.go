@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"pocketjson/storage"
+)
+
+// ListDocuments lists the metadata of stored documents, filtered by the
+// query parameters described in parseDocumentFilter. Results are ordered by
+// ID; pass the returned next_cursor as ?after= to get the following page.
+// Non-admin callers only see their tenant's documents, without the private
+// documents of other keys.
+func ListDocuments(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseDocumentFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		listDocuments(store, w, r, filter)
+	}
+}
+
+// ListOrphanedDocuments lists documents whose creator key has been deleted.
+func ListOrphanedDocuments(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseDocumentFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.Orphaned = true
+		listDocuments(store, w, r, filter)
+	}
+}
+
+func listDocuments(store *storage.Store, w http.ResponseWriter, r *http.Request, filter storage.DocumentFilter) {
+	limit, ok := parseLimit(w, r)
+	if !ok {
+		return
+	}
+
+	caller, _ := authenticate(store, r)
+	restrictToTenant(caller, &filter)
+	if !caller.IsAdmin {
+		filter.ReadableBy = caller.KeyID
+	}
+	filter.KnownKeys = []string{store.MasterKeyID()}
+
+	docs, err := store.DB().ListDocuments(r.Context(), filter, r.URL.Query().Get("after"), limit)
+	if err != nil {
+		log.Printf("failed to list documents: %v", err)
+		http.Error(w, "Failed to list documents", http.StatusInternalServerError)
+		return
+	}
+
+	items := make([]map[string]interface{}, len(docs))
+	for i, doc := range docs {
+		items[i] = documentResponse(doc)
+	}
+
+	response := map[string]interface{}{
+		"documents":   items,
+		"next_cursor": nil,
+	}
+	if len(docs) == limit {
+		response["next_cursor"] = docs[len(docs)-1].ID
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteDocuments deletes every document matching the same filters as
+// ListDocuments and reports how many were deleted. An empty filter is
+// rejected unless ?all=true is given.
+func DeleteDocuments(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := authenticate(store, r)
+		if !caller.Has(storage.ScopeDocumentsDelete) {
+			http.Error(w, "Forbidden: missing scope "+string(storage.ScopeDocumentsDelete), http.StatusForbidden)
+			return
+		}
+
+		filter, err := parseDocumentFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if filter.IsEmpty() && r.URL.Query().Get("all") != "true" {
+			http.Error(w, "Refusing to delete every document without ?all=true", http.StatusBadRequest)
+			return
+		}
+
+		restrictToTenant(caller, &filter)
+		filter.KnownKeys = []string{store.MasterKeyID()}
+
+		deleted, err := store.DB().DeleteDocuments(r.Context(), filter)
+		if err != nil {
+			log.Printf("failed to bulk delete documents: %v", err)
+			http.Error(w, "Failed to delete documents", http.StatusInternalServerError)
+			return
+		}
+
+		setAuditDetail(r, "filter=%s deleted=%d", r.URL.RawQuery, deleted)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"deleted": deleted,
+		})
+	}
+}
+
+// InspectDocument returns the metadata and data of any document the caller
+// may manage and whose visibility lets it read.
+func InspectDocument(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		doc, err := store.DB().GetDocument(ctx, chi.URLParam(r, "id"))
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				http.Error(w, "JSON not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("failed to load document: %v", err)
+			http.Error(w, "Failed to retrieve JSON", http.StatusInternalServerError)
+			return
+		}
+
+		caller, _ := authenticate(store, r)
+		if !caller.CanManageDocument(doc) || !caller.CanReadDocument(doc) {
+			http.Error(w, "JSON not found", http.StatusNotFound)
+			return
+		}
+
+		data, err := store.DB().GetJSON(ctx, doc.ID)
+		if err != nil {
+			log.Printf("failed to load document: %v", err)
+			http.Error(w, "Failed to retrieve JSON", http.StatusInternalServerError)
+			return
+		}
+
+		response := documentResponse(doc)
+		response["data"] = json.RawMessage(data)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// restrictToTenant limits non-admin callers to their own tenant and, for
+// keys with an ID prefix restriction, to the documents under that prefix.
+func restrictToTenant(caller *storage.Permissions, filter *storage.DocumentFilter) {
+	if !caller.IsAdmin {
+		filter.TenantID = caller.TenantID
+		filter.CustomIDPrefix = caller.IDPrefix
+	}
+}
+
+// parseDocumentFilter reads the document filters from the query string:
+// creator_key, tenant_id, guest (true/false), prefix, min_size, max_size
+// (bytes), and created_after, created_before, expires_after, expires_before
+// (RFC 3339).
+func parseDocumentFilter(r *http.Request) (storage.DocumentFilter, error) {
+	query := r.URL.Query()
+	filter := storage.DocumentFilter{
+		CreatorKey: query.Get("creator_key"),
+		TenantID:   query.Get("tenant_id"),
+		IDPrefix:   query.Get("prefix"),
+	}
+
+	if v := query.Get("visibility"); v != "" {
+		visibility, err := storage.ParseVisibility(v)
+		if err != nil {
+			return filter, err
+		}
+		filter.Visibility = visibility
+	}
+
+	if v := query.Get("guest"); v != "" {
+		guest, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid guest value")
+		}
+		filter.Guest = &guest
+	}
+
+	sizes := []struct {
+		name string
+		dest **int64
+	}{
+		{"min_size", &filter.MinSize},
+		{"max_size", &filter.MaxSize},
+	}
+	for _, size := range sizes {
+		if v := query.Get(size.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return filter, fmt.Errorf("invalid %s value", size.name)
+			}
+			*size.dest = &n
+		}
+	}
+
+	times := []struct {
+		name string
+		dest **time.Time
+	}{
+		{"created_after", &filter.CreatedAfter},
+		{"created_before", &filter.CreatedBefore},
+		{"expires_after", &filter.ExpiresAfter},
+		{"expires_before", &filter.ExpiresBefore},
+	}
+	for _, t := range times {
+		if v := query.Get(t.name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s value, use RFC 3339", t.name)
+			}
+			*t.dest = &parsed
+		}
+	}
+
+	return filter, nil
+}
+
+// documentResponse describes a document without its data.
+func documentResponse(doc *storage.Document) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          doc.ID,
+		"creator_key": doc.CreatorKey,
+		"tenant_id":   doc.TenantID,
+		"visibility":  doc.Visibility,
+		"kind":        doc.Kind,
+		"created_at":  formatOptionalTime(doc.CreatedAt),
+		"expires_at":  doc.ExpiresAt.Format(time.RFC3339),
+		"size":        doc.Size,
+	}
+}
+
+// parseLimit reads ?limit= for cursor-paginated listings. On failure it
+// writes the error response.
+func parseLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return 0, false
+		}
+		limit = n
+	}
+	return limit, true
+}
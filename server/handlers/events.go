@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"pocketjson/storage"
+)
+
+// WatchJSON streams a document as Server-Sent Events: the current version
+// first, then every new one. Event IDs are document versions, so a client
+// reconnecting with Last-Event-ID only gets the document again if it changed
+// in the meantime. The stream ends with a "deleted" or "expired" event.
+func WatchJSON(store *storage.Store, streams *Streams) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Take the change signal before loading the document so that a
+		// change in between is not missed.
+		changed := store.DB().Changed()
+
+		doc, perms, ok := loadReadableDocument(store, w, r)
+		if !ok {
+			return
+		}
+
+		keyID := ""
+		if perms != nil && !perms.Guest {
+			keyID = perms.KeyID
+		}
+		release, ok := streams.acquire(clientIP(r), keyID)
+		if !ok {
+			http.Error(w, "Too many open streams", http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+
+		var sent int64
+		if v, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+			sent = v
+		}
+
+		stream, ok := startEventStream(w)
+		if !ok {
+			return
+		}
+
+		expiry := time.NewTimer(time.Until(doc.ExpiresAt))
+		defer expiry.Stop()
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			if doc.Version != sent {
+				data, err := store.DB().GetJSON(r.Context(), doc.ID)
+				if err != nil && !strings.Contains(err.Error(), "not found") {
+					log.Printf("failed to load watched document: %v", err)
+					return
+				}
+				if err == nil {
+					if stream.send(strconv.FormatInt(doc.Version, 10), "document", data) != nil {
+						return
+					}
+					sent = doc.Version
+				}
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-streams.Done():
+				return
+			case <-heartbeat.C:
+				if stream.heartbeat() != nil {
+					return
+				}
+				continue
+			case <-changed:
+			case <-expiry.C:
+			}
+
+			changed = store.DB().Changed()
+			current, err := store.DB().GetDocument(r.Context(), doc.ID)
+			if err == nil {
+				var readable bool
+				if readable, err = canReadDocument(store, r, perms, current); err == nil && !readable {
+					// Access was taken away; end the stream like a deletion
+					// so nothing more is revealed.
+					err = fmt.Errorf("json not found")
+				}
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), "not found") {
+					log.Printf("failed to reload watched document: %v", err)
+					return
+				}
+				event := "deleted"
+				if !time.Now().Before(doc.ExpiresAt) {
+					event = "expired"
+				}
+				payload, _ := json.Marshal(map[string]interface{}{"id": doc.ID})
+				stream.send("", event, string(payload))
+				return
+			}
+
+			if !current.ExpiresAt.Equal(doc.ExpiresAt) {
+				expiry.Reset(time.Until(current.ExpiresAt))
+			}
+			doc = current
+		}
+	}
+}
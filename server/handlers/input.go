@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"pocketjson/codec"
+)
+
+// inputFormat is the format a document is sent in.
+type inputFormat int
+
+const (
+	inputJSON inputFormat = iota
+	inputJSONC
+	inputNDJSON
+	inputForm
+	inputCBOR
+	inputMsgPack
+)
+
+// requestFormat tells from the Content-Type how the body of r is to be
+// read. application/json and any */*+json type are plain JSON,
+// application/jsonc allows comments and trailing commas,
+// application/x-ndjson holds one value per line, and application/cbor and
+// application/msgpack are converted by the rules of package codec.
+// Form-encoded bodies are only accepted with ?form=true, so that a client
+// that forgot to set the Content-Type gets an error rather than a document
+// of form fields.
+func requestFormat(r *http.Request) (inputFormat, *requestError) {
+	unsupported := &requestError{http.StatusBadRequest, "Content-Type must be application/json"}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.Contains(mediaType, "/") {
+		return 0, unsupported
+	}
+	if charset := params["charset"]; charset != "" && !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "us-ascii") {
+		return 0, &requestError{http.StatusBadRequest, "charset must be utf-8"}
+	}
+
+	switch {
+	case mediaType == "application/json", strings.HasSuffix(mediaType, "+json"):
+		return inputJSON, nil
+	case mediaType == "application/jsonc":
+		return inputJSONC, nil
+	case mediaType == "application/x-ndjson":
+		return inputNDJSON, nil
+	case mediaType == "application/cbor":
+		return inputCBOR, nil
+	case mediaType == "application/msgpack", mediaType == "application/x-msgpack", mediaType == "application/vnd.msgpack":
+		return inputMsgPack, nil
+	case mediaType == "application/x-www-form-urlencoded" && r.URL.Query().Get("form") == "true":
+		return inputForm, nil
+	}
+	return 0, unsupported
+}
+
+// readJSONBody reads a document in any of the formats of requestFormat and
+// returns it as compact JSON. NDJSON becomes an array of its lines, form
+// fields a flat object, and CBOR and MessagePack their JSON equivalent.
+// Documents have to be objects or arrays. On failure it writes the error
+// response.
+func readJSONBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	format, reqErr := requestFormat(r)
+	if reqErr != nil {
+		http.Error(w, reqErr.message, reqErr.status)
+		return nil, false
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var raw []byte
+	switch format {
+	case inputJSON:
+		raw = body
+	case inputJSONC:
+		if raw, err = codec.StripJSONC(body); err != nil {
+			http.Error(w, "Invalid JSONC: "+err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+	case inputNDJSON:
+		lines, err := codec.DecodeNDJSON(body)
+		if err != nil {
+			http.Error(w, "Invalid NDJSON: "+err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		raw, _ = json.Marshal(lines)
+	case inputForm:
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			http.Error(w, "Invalid form data", http.StatusBadRequest)
+			return nil, false
+		}
+		raw, _ = json.Marshal(formObject(values))
+	case inputCBOR:
+		if raw, err = codec.CBORToJSON(body); err != nil {
+			http.Error(w, "Invalid CBOR: "+err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+	case inputMsgPack:
+		if raw, err = codec.MsgPackToJSON(body); err != nil {
+			http.Error(w, "Invalid MessagePack: "+err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+
+	jsonBytes, err := compactDocument(raw)
+	if err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return jsonBytes, true
+}
+
+// compactDocument checks that raw is a JSON object or array and returns it
+// compacted the way stored documents are. Numbers are kept as written, so
+// integers beyond the precision of a float64 are not rounded.
+func compactDocument(raw []byte) ([]byte, error) {
+	if !json.Valid(raw) {
+		return nil, fmt.Errorf("not valid JSON")
+	}
+	data, err := decodeJSONValue(raw)
+	if err != nil {
+		return nil, fmt.Errorf("not valid JSON")
+	}
+	switch data.(type) {
+	case map[string]interface{}, []interface{}:
+		return json.Marshal(data)
+	}
+	return nil, fmt.Errorf("a document must be a JSON object or array")
+}
+
+// formObject flattens form fields into an object. A field given once
+// becomes a string, a repeated field an array of strings.
+func formObject(values url.Values) map[string]interface{} {
+	object := make(map[string]interface{}, len(values))
+	for key, list := range values {
+		if len(list) == 1 {
+			object[key] = list[0]
+		} else {
+			object[key] = list
+		}
+	}
+	return object
+}
@@ -1,6 +1,9 @@
 package handlers
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -11,76 +14,86 @@ import (
 
 	"github.com/go-chi/chi/v5"
 
+	"pocketjson/codec"
 	"pocketjson/storage"
 	"pocketjson/utils"
 )
 
 func CreateJSON(store *storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
-			http.Error(w, "Content-Type must be application/json", http.StatusBadRequest)
+		if r.URL.Query().Get("ndjson") == "batch" {
+			createNDJSONBatch(store, w, r)
 			return
 		}
 
-		var data map[string]interface{}
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
-		}
-
-		jsonBytes, err := json.Marshal(data)
-		if err != nil {
-			http.Error(w, "Failed to process JSON", http.StatusInternalServerError)
+		jsonBytes, ok := readJSONBody(w, r)
+		if !ok {
 			return
 		}
 
 		ctx := r.Context()
-		apiKey := r.Header.Get("X-API-Key")
-		isAuth, _, err := store.ValidateApiKey(ctx, apiKey)
+		perms, err := authenticate(store, r)
 		if err != nil {
 			log.Printf("api key validation error: %v", err)
 			http.Error(w, "Server error", http.StatusInternalServerError)
 			return
 		}
 
+		visibility := storage.VisibilityPublic
+		if v := r.URL.Query().Get("visibility"); v != "" {
+			if visibility, err = storage.ParseVisibility(v); err != nil {
+				http.Error(w, "visibility must be public, private or tenant", http.StatusBadRequest)
+				return
+			}
+			if perms == nil && visibility != storage.VisibilityPublic {
+				http.Error(w, "Guests can only create public documents", http.StatusBadRequest)
+				return
+			}
+		}
+
+		kind := storage.KindDocument
+		if v := r.URL.Query().Get("kind"); v != "" {
+			if kind, err = storage.ParseKind(v); err != nil {
+				http.Error(w, "kind must be document or collection", http.StatusBadRequest)
+				return
+			}
+		}
+
 		cfg := store.Config()
 		maxSize := cfg.DefaultMaxSize
 		expiry := time.Now().Add(cfg.DefaultExpiry)
 		creatorKey := "guest"
-		var id string
+		tenantID := ""
+		var id, editToken string
 
-		if isAuth {
-			maxSize = cfg.AuthenticatedSize
-			creatorKey = apiKey
-			requestedID := chi.URLParam(r, "id")
-
-			if requestedID != "" {
-				if !utils.IsValidCustomID(requestedID) {
-					http.Error(w, "Invalid ID format. Use only alphanumeric characters, hyphens, and underscores (max 64 chars)", http.StatusBadRequest)
-					return
-				}
-				clientPrefix := utils.GetClientPrefix(apiKey)
-				id = fmt.Sprintf("%s_%s", clientPrefix, requestedID)
-			} else {
-				var err error
-				id, err = utils.GenerateRandomKey()
-				if err != nil {
-					log.Printf("failed to generate random key: %v", err)
-					http.Error(w, "Server error", http.StatusInternalServerError)
-					return
-				}
+		if perms != nil {
+			// Signed URLs and edit tokens only cover an existing document.
+			if perms.DocumentID != "" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if !perms.Has(storage.ScopeDocumentsWrite) {
+				http.Error(w, "Forbidden: missing scope "+string(storage.ScopeDocumentsWrite), http.StatusForbidden)
+				return
 			}
 
-			if exp := r.URL.Query().Get("expiry"); exp != "" {
-				if exp == "never" {
-					expiry = time.Now().AddDate(100, 0, 0)
-				} else if hours, err := strconv.Atoi(exp); err == nil {
-					expiry = time.Now().Add(time.Duration(hours) * time.Hour)
-				}
+			maxSize = cfg.AuthenticatedSize
+			creatorKey = perms.KeyID
+			tenantID = perms.TenantID
+
+			var reqErr *requestError
+			if id, reqErr = newDocumentID(ctx, store.DB(), perms, chi.URLParam(r, "id")); reqErr != nil {
+				http.Error(w, reqErr.message, reqErr.status)
+				return
 			}
+
+			expiry = parseExpiry(r, expiry)
 		} else {
 			var err error
 			id, err = utils.GenerateRandomKey()
+			if err == nil {
+				editToken, err = utils.GenerateRandomKey()
+			}
 			if err != nil {
 				log.Printf("failed to generate random key: %v", err)
 				http.Error(w, "Server error", http.StatusInternalServerError)
@@ -88,31 +101,53 @@ func CreateJSON(store *storage.Store) http.HandlerFunc {
 			}
 		}
 
+		setAuditTarget(r, id)
+
 		if len(jsonBytes) > maxSize {
 			http.Error(w, "JSON too large", http.StatusBadRequest)
 			return
 		}
 
-		if err := store.DB().CreateJSON(ctx, id, string(jsonBytes), expiry, creatorKey); err != nil {
+		var editTokenHash string
+		if editToken != "" {
+			editTokenHash = utils.HashToken(editToken)
+		}
+		if err := store.DB().CreateJSON(ctx, id, string(jsonBytes), expiry, creatorKey, tenantID, visibility, kind, editTokenHash); err != nil {
+			if isDuplicateID(err) {
+				http.Error(w, "ID already exists", http.StatusConflict)
+				return
+			}
 			log.Printf("failed to store JSON: %v", err)
 			http.Error(w, "Failed to store JSON", http.StatusInternalServerError)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]interface{}{
+		response := map[string]interface{}{
 			"id":         id,
 			"expires_at": expiry.Format(time.RFC3339),
-		})
+			"visibility": visibility,
+			"kind":       kind,
+		}
+		if editToken != "" {
+			response["edit_token"] = editToken
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
 	}
 }
 
+// GetJSON serves a document as JSON or, negotiated through the Accept
+// header or ?format=, as YAML, CSV, NDJSON, CBOR or MessagePack. The Digest
+// header carries the SHA-256 of the document's canonical form (RFC 8785),
+// which ?canonical=true returns as the body, for documents that have one.
 func GetJSON(store *storage.Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		id := chi.URLParam(r, "id")
-		ctx := r.Context()
+		doc, _, ok := loadReadableDocument(store, w, r)
+		if !ok {
+			return
+		}
 
-		data, err := store.DB().GetJSON(ctx, id)
+		data, err := store.DB().GetJSON(r.Context(), doc.ID)
 		if err != nil {
 			if strings.Contains(err.Error(), "not found") {
 				http.Error(w, "JSON not found", http.StatusNotFound)
@@ -122,7 +157,323 @@ func GetJSON(store *storage.Store) http.HandlerFunc {
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(data))
+		w.Header().Set("Vary", "Accept")
+		format, reqErr := negotiateFormat(r)
+		if reqErr != nil {
+			http.Error(w, reqErr.message, reqErr.status)
+			return
+		}
+
+		// The digest identifies the content whatever format it is served
+		// in, so it is taken over the canonical form. Documents with
+		// numbers beyond the range of a double have none and are served
+		// without it.
+		canonical, canonicalErr := codec.Canonicalize([]byte(data))
+		var digest string
+		if canonicalErr == nil {
+			sum := sha256.Sum256(canonical)
+			digest = base64.StdEncoding.EncodeToString(sum[:])
+			w.Header().Set("Digest", "sha-256="+digest)
+		}
+
+		var body []byte
+		if r.URL.Query().Get("canonical") == "true" {
+			if format.name != "json" {
+				http.Error(w, "Not acceptable: canonical output is JSON", http.StatusNotAcceptable)
+				return
+			}
+			if r.URL.Query().Get("indent") != "" {
+				http.Error(w, "canonical and indent cannot be combined", http.StatusBadRequest)
+				return
+			}
+			if canonicalErr != nil {
+				http.Error(w, "Document has no canonical form: "+canonicalErr.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			body = canonical
+			w.Header().Set("Content-Digest", "sha-256=:"+digest+":")
+		} else if body, reqErr = renderDocument(r, format, []byte(data)); reqErr != nil {
+			http.Error(w, reqErr.message, reqErr.status)
+			return
+		}
+
+		w.Header().Set("Content-Type", format.contentType())
+		w.Write(body)
+	}
+}
+
+// UpdateJSON replaces the content of a document owned by the calling key.
+// The expiry is kept unless a new one is given with ?expiry=. Guests holding
+// the document's edit token may only shorten it, and signed URLs cannot
+// change it.
+func UpdateJSON(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jsonBytes, ok := readJSONBody(w, r)
+		if !ok {
+			return
+		}
+
+		doc, ok := loadWritableDocument(store, w, r)
+		if !ok {
+			return
+		}
+
+		perms, _ := authenticate(store, r)
+		maxSize := store.Config().AuthenticatedSize
+		if perms.Guest {
+			maxSize = store.Config().DefaultMaxSize
+		}
+		if len(jsonBytes) > maxSize {
+			http.Error(w, "JSON too large", http.StatusBadRequest)
+			return
+		}
+
+		// A signed URL only covers the document's content: ?expiry= is not
+		// part of the signature, so whoever holds the URL could add it.
+		// Edit tokens are also bound to the document, but may shorten it.
+		if perms.DocumentID != "" && !perms.Guest && r.URL.Query().Has("expiry") {
+			http.Error(w, "Signed URLs cannot change the expiry", http.StatusForbidden)
+			return
+		}
+		expiry := parseExpiry(r, doc.ExpiresAt)
+		if perms.Guest && expiry.After(doc.ExpiresAt) {
+			http.Error(w, "Edit tokens can only shorten the expiry", http.StatusBadRequest)
+			return
+		}
+		if err := store.DB().UpdateJSON(r.Context(), doc.ID, string(jsonBytes), expiry); err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				http.Error(w, "JSON not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("failed to update JSON: %v", err)
+			http.Error(w, "Failed to store JSON", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":         doc.ID,
+			"expires_at": expiry.Format(time.RFC3339),
+		})
+	}
+}
+
+func DeleteJSON(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		doc, ok := loadManagedDocument(store, w, r)
+		if !ok {
+			return
+		}
+
+		if err := store.DB().DeleteJSON(r.Context(), doc.ID); err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				http.Error(w, "JSON not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("failed to delete JSON: %v", err)
+			http.Error(w, "Failed to delete JSON", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// loadReadableDocument loads the document named in the URL if the caller
+// may read it. Reading does not require a key, but a key or signed URL that
+// is sent has to be valid. Documents the caller may not read are reported as
+// missing so that guessing IDs reveals nothing.
+func loadReadableDocument(store *storage.Store, w http.ResponseWriter, r *http.Request) (*storage.Document, *storage.Permissions, bool) {
+	var perms *storage.Permissions
+	signed := r.URL.Query().Get(storage.SignatureParam) != ""
+	if r.Header.Get("X-API-Key") != "" || signed {
+		var err error
+		perms, err = authenticate(store, r)
+		if err != nil {
+			log.Printf("api key validation error: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return nil, nil, false
+		}
+		if perms == nil && signed {
+			http.Error(w, "Invalid or expired signature", http.StatusForbidden)
+			return nil, nil, false
+		}
+		if perms != nil && !perms.Has(storage.ScopeDocumentsRead) {
+			http.Error(w, "Forbidden: missing scope "+string(storage.ScopeDocumentsRead), http.StatusForbidden)
+			return nil, nil, false
+		}
+	}
+
+	doc, err := store.DB().GetDocument(r.Context(), chi.URLParam(r, "id"))
+	if err == nil {
+		var readable bool
+		readable, err = canReadDocument(store, r, perms, doc)
+		if err == nil && !readable {
+			err = fmt.Errorf("json not found")
+		}
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "JSON not found", http.StatusNotFound)
+			return nil, nil, false
+		}
+		log.Printf("failed to load document: %v", err)
+		http.Error(w, "Failed to retrieve JSON", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	return doc, perms, true
+}
+
+// canReadDocument checks the document's visibility and, failing that,
+// whether it was shared with the caller.
+func canReadDocument(store *storage.Store, r *http.Request, perms *storage.Permissions, doc *storage.Document) (bool, error) {
+	if perms.CanReadDocument(doc) {
+		return true, nil
+	}
+	return hasGrant(store, r, perms, doc, storage.AccessRead)
+}
+
+// loadManagedDocument loads the document named in the URL and checks that
+// the calling key may change it. Documents owned by someone else are
+// reported as missing so their existence is not revealed.
+func loadManagedDocument(store *storage.Store, w http.ResponseWriter, r *http.Request) (*storage.Document, bool) {
+	return loadDocument(store, w, r, false)
+}
+
+// loadWritableDocument is like loadManagedDocument but also accepts keys
+// that were granted read-write access to the document.
+func loadWritableDocument(store *storage.Store, w http.ResponseWriter, r *http.Request) (*storage.Document, bool) {
+	return loadDocument(store, w, r, true)
+}
+
+func loadDocument(store *storage.Store, w http.ResponseWriter, r *http.Request, shared bool) (*storage.Document, bool) {
+	doc, err := store.DB().GetDocument(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "JSON not found", http.StatusNotFound)
+			return nil, false
+		}
+		log.Printf("failed to load document: %v", err)
+		http.Error(w, "Failed to retrieve JSON", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	perms, _ := authenticate(store, r)
+	if perms.CanManageDocument(doc) {
+		return doc, true
+	}
+	if shared {
+		granted, err := hasGrant(store, r, perms, doc, storage.AccessReadWrite)
+		if err != nil {
+			log.Printf("failed to check document grant: %v", err)
+			http.Error(w, "Failed to retrieve JSON", http.StatusInternalServerError)
+			return nil, false
+		}
+		if granted {
+			return doc, true
+		}
+	}
+	http.Error(w, "JSON not found", http.StatusNotFound)
+	return nil, false
+}
+
+// requestError is a failure to be reported with an HTTP status, for code
+// that does not write the response itself.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// documentStore is implemented by *storage.DB and *storage.Tx, so document
+// operations can run on their own or inside a transaction.
+type documentStore interface {
+	CreateJSON(ctx context.Context, id, data string, expiresAt time.Time, creatorKey, tenantID string, visibility storage.Visibility, kind storage.Kind, editTokenHash string) error
+	GetJSON(ctx context.Context, id string) (string, error)
+	GetDocument(ctx context.Context, id string) (*storage.Document, error)
+	ResolveDocumentID(ctx context.Context, id string) (string, error)
+	UpdateJSON(ctx context.Context, id, data string, expiresAt time.Time) error
+	DeleteJSON(ctx context.Context, id string) error
+}
+
+// reservedIDs are the first path segments of the API's own routes. A
+// document created with one of them as its custom ID could never be
+// created through POST /{id}, since the static route wins, so they are
+// refused everywhere.
+var reservedIDs = map[string]bool{
+	"admin":    true,
+	"batch":    true,
+	"buckets":  true,
+	"catch":    true,
+	"changes":  true,
+	"health":   true,
+	"locks":    true,
+	"queues":   true,
+	"webhooks": true,
+}
+
+// newDocumentID picks the ID of a document created by an authenticated key:
+// the requested custom ID inside the key's namespace, or a random one.
+func newDocumentID(ctx context.Context, docs documentStore, perms *storage.Permissions, requestedID string) (string, *requestError) {
+	if requestedID == "" {
+		if perms.IDPrefix != "" {
+			return "", &requestError{http.StatusForbidden, "Forbidden: this key can only write custom IDs starting with " + perms.IDPrefix}
+		}
+		id, err := utils.GenerateRandomKey()
+		if err != nil {
+			log.Printf("failed to generate random key: %v", err)
+			return "", &requestError{http.StatusInternalServerError, "Server error"}
+		}
+		return id, nil
+	}
+
+	if !utils.IsValidCustomID(requestedID) {
+		return "", &requestError{http.StatusBadRequest, "Invalid ID format. Use only alphanumeric characters, hyphens, and underscores (max 64 chars)"}
+	}
+	if reservedIDs[requestedID] {
+		return "", &requestError{http.StatusBadRequest, "ID " + requestedID + " is reserved"}
+	}
+	if !perms.AllowsID(requestedID) {
+		return "", &requestError{http.StatusForbidden, "Forbidden: ID must start with " + perms.IDPrefix}
+	}
+	id := fmt.Sprintf("%s_%s", perms.Namespace(), requestedID)
+
+	// The same custom ID may already exist under the tenant's other prefix
+	// (its ID or its slug).
+	existing, err := docs.ResolveDocumentID(ctx, id)
+	if err != nil {
+		log.Printf("failed to resolve document id: %v", err)
+		return "", &requestError{http.StatusInternalServerError, "Server error"}
+	}
+	if existing != id {
+		return "", &requestError{http.StatusConflict, "ID already exists"}
+	}
+	return id, nil
+}
+
+// isDuplicateID reports whether a failed insert collided with an existing
+// document ID.
+func isDuplicateID(err error) bool {
+	return strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// parseExpiry reads the ?expiry= parameter (hours or "never") and falls back
+// to def when it is absent or invalid.
+func parseExpiry(r *http.Request, def time.Time) time.Time {
+	return parseExpiryValue(r.URL.Query().Get("expiry"), def)
+}
+
+func parseExpiryValue(exp string, def time.Time) time.Time {
+	if exp == "" {
+		return def
+	}
+	if exp == "never" {
+		return time.Now().AddDate(100, 0, 0)
+	}
+	if hours, err := strconv.Atoi(exp); err == nil {
+		return time.Now().Add(time.Duration(hours) * time.Hour)
 	}
+	return def
 }
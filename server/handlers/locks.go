@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"pocketjson/storage"
+)
+
+// lockRetryInterval is how often a blocking acquisition tries again.
+const lockRetryInterval = 250 * time.Millisecond
+
+// AcquireLock takes a lease on a name for ttl seconds (default 30). If the
+// lock is held, the request fails right away unless wait gives a number of
+// seconds to keep trying. The response carries the owner token needed to
+// renew or release the lease and the fencing token of this acquisition.
+func AcquireLock(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, name, ok := loadScopedName(store, w, r)
+		if !ok {
+			return
+		}
+
+		request := struct {
+			TTL  int `json:"ttl"`
+			Wait int `json:"wait"`
+		}{TTL: 30}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		ttl, ok := parseLockTTL(w, request.TTL)
+		if !ok {
+			return
+		}
+		if request.Wait < 0 || request.Wait > 30 {
+			http.Error(w, "wait must be between 0 and 30 seconds", http.StatusBadRequest)
+			return
+		}
+
+		deadline := time.Now().Add(time.Duration(request.Wait) * time.Second)
+		for {
+			lock, err := store.DB().AcquireLock(r.Context(), caller.TenantID, name, ttl)
+			if err == nil {
+				setAuditDetail(r, "fencing_token=%d", lock.FencingToken)
+				json.NewEncoder(w).Encode(lock)
+				return
+			}
+			if !strings.Contains(err.Error(), "lock is held") {
+				log.Printf("failed to acquire lock: %v", err)
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				seconds := math.Ceil(time.Until(lock.ExpiresAt).Seconds())
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(seconds, 1))))
+				http.Error(w, "Lock is held", http.StatusConflict)
+				return
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(min(remaining, lockRetryInterval)):
+			}
+		}
+	}
+}
+
+// RenewLock extends a lease still held by owner_token to ttl seconds from
+// now.
+func RenewLock(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, name, ok := loadScopedName(store, w, r)
+		if !ok {
+			return
+		}
+
+		request := struct {
+			OwnerToken string `json:"owner_token"`
+			TTL        int    `json:"ttl"`
+		}{TTL: 30}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		ttl, ok := parseLockTTL(w, request.TTL)
+		if !ok {
+			return
+		}
+
+		lock, err := store.DB().RenewLock(r.Context(), caller.TenantID, name, request.OwnerToken, ttl)
+		if err != nil {
+			if strings.Contains(err.Error(), "not held") {
+				http.Error(w, "Lock is not held with this owner token", http.StatusConflict)
+				return
+			}
+			log.Printf("failed to renew lock: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(lock)
+	}
+}
+
+// ReleaseLock frees a lease still held by ?owner_token=.
+func ReleaseLock(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, name, ok := loadScopedName(store, w, r)
+		if !ok {
+			return
+		}
+
+		if err := store.DB().ReleaseLock(r.Context(), caller.TenantID, name, r.URL.Query().Get("owner_token")); err != nil {
+			if strings.Contains(err.Error(), "not held") {
+				http.Error(w, "Lock is not held with this owner token", http.StatusConflict)
+				return
+			}
+			log.Printf("failed to release lock: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// GetLock shows the current lease on a name, without its owner token.
+func GetLock(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, name, ok := loadScopedName(store, w, r)
+		if !ok {
+			return
+		}
+
+		lock, err := store.DB().GetLock(r.Context(), caller.TenantID, name)
+		if err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				http.Error(w, "Lock is not held", http.StatusNotFound)
+				return
+			}
+			log.Printf("failed to load lock: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		lock.OwnerToken = ""
+		json.NewEncoder(w).Encode(lock)
+	}
+}
+
+func parseLockTTL(w http.ResponseWriter, seconds int) (time.Duration, bool) {
+	if seconds < 1 || seconds > 24*60*60 {
+		http.Error(w, "ttl must be between 1 and 86400 seconds", http.StatusBadRequest)
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
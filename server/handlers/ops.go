@@ -0,0 +1,436 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"pocketjson/storage"
+)
+
+// documentOp is the body of a POST /{id}/ops request.
+type documentOp struct {
+	Op        string          `json:"op"`
+	Path      string          `json:"path"`
+	Value     json.RawMessage `json:"value"`
+	MaxLength *int            `json:"max_length"`
+	From      string          `json:"from"`
+}
+
+// errOpNoChange ends the transaction of an operation that left the document
+// as it was, so that no new version is written.
+var errOpNoChange = errors.New("document unchanged")
+
+// ApplyOperation changes one value inside a document without a
+// read-modify-write cycle on the client: the document is read, changed and
+// written back in a single transaction, so concurrent operations do not
+// lose each other's updates. The response carries the value at the path
+// afterwards.
+func ApplyOperation(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if format, reqErr := requestFormat(r); reqErr != nil || format != inputJSON {
+			http.Error(w, "Content-Type must be application/json", http.StatusBadRequest)
+			return
+		}
+
+		var op documentOp
+		if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		path, err := parseOpPath(op.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var value interface{}
+		if len(op.Value) > 0 {
+			if value, err = decodeJSONValue(op.Value); err != nil {
+				http.Error(w, "Invalid value", http.StatusBadRequest)
+				return
+			}
+		}
+		if op.MaxLength != nil && *op.MaxLength < 1 {
+			http.Error(w, "max_length must be at least 1", http.StatusBadRequest)
+			return
+		}
+
+		result := map[string]interface{}{"op": op.Op, "path": op.Path}
+		apply, reqErr := newOpFunc(op, value, result)
+		if reqErr != nil {
+			http.Error(w, reqErr.message, reqErr.status)
+			return
+		}
+
+		doc, ok := loadWritableDocument(store, w, r)
+		if !ok {
+			return
+		}
+
+		perms, _ := authenticate(store, r)
+		maxSize := store.Config().AuthenticatedSize
+		if perms.Guest {
+			maxSize = store.Config().DefaultMaxSize
+		}
+
+		err = store.DB().Atomic(r.Context(), func(tx *storage.Tx) error {
+			current, err := tx.GetJSON(r.Context(), doc.ID)
+			if err != nil {
+				return err
+			}
+			root, err := decodeJSONValue(json.RawMessage(current))
+			if err != nil {
+				return err
+			}
+
+			changed := false
+			root, err = updatePath(root, path, apply.create, func(old interface{}, exists bool) (interface{}, bool, error) {
+				updated, keep, err := apply.fn(old, exists)
+				if err == nil {
+					changed = keep != exists || !reflect.DeepEqual(old, updated)
+				}
+				return updated, keep, err
+			})
+			if err != nil {
+				return err
+			}
+			result["changed"] = changed
+			if !changed {
+				return errOpNoChange
+			}
+
+			data, err := json.Marshal(root)
+			if err != nil {
+				return err
+			}
+			if len(data) > maxSize {
+				return &requestError{http.StatusBadRequest, "JSON too large"}
+			}
+			return tx.UpdateJSON(r.Context(), doc.ID, string(data), doc.ExpiresAt)
+		})
+
+		var opErr *requestError
+		switch {
+		case err == nil, err == errOpNoChange:
+		case errors.As(err, &opErr):
+			http.Error(w, opErr.message, opErr.status)
+			return
+		case strings.Contains(err.Error(), "not found"):
+			http.Error(w, "JSON not found", http.StatusNotFound)
+			return
+		default:
+			log.Printf("failed to apply %s operation: %v", op.Op, err)
+			http.Error(w, "Failed to store JSON", http.StatusInternalServerError)
+			return
+		}
+
+		setAuditDetail(r, "op=%s path=%s", op.Op, op.Path)
+		result["id"] = doc.ID
+		result["expires_at"] = doc.ExpiresAt.Format(time.RFC3339)
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// opFunc computes the new value at the path from the old one. Returning
+// keep=false removes the value.
+type opFunc struct {
+	fn     func(old interface{}, exists bool) (updated interface{}, keep bool, err error)
+	create bool
+}
+
+// newOpFunc builds the change made by an operation. The value left at the
+// path, and anything else the caller should see, is recorded in result.
+func newOpFunc(op documentOp, value interface{}, result map[string]interface{}) (*opFunc, *requestError) {
+	needsValue := func() *requestError {
+		if value == nil && len(op.Value) == 0 {
+			return &requestError{http.StatusBadRequest, "value is required for " + op.Op}
+		}
+		return nil
+	}
+
+	switch op.Op {
+	case "incr", "decr":
+		delta := json.Number("1")
+		if len(op.Value) > 0 {
+			number, ok := value.(json.Number)
+			if !ok {
+				return nil, &requestError{http.StatusBadRequest, "value must be a number"}
+			}
+			delta = number
+		}
+		return &opFunc{create: true, fn: func(old interface{}, exists bool) (interface{}, bool, error) {
+			current := json.Number("0")
+			if exists {
+				number, ok := old.(json.Number)
+				if !ok {
+					return nil, false, &requestError{http.StatusConflict, "Value at path is not a number"}
+				}
+				current = number
+			}
+			updated, err := addNumbers(current, delta, op.Op == "decr")
+			if err != nil {
+				return nil, false, err
+			}
+			result["value"] = updated
+			return updated, true, nil
+		}}, nil
+
+	case "push":
+		if err := needsValue(); err != nil {
+			return nil, err
+		}
+		if op.From != "" && op.From != "start" && op.From != "end" {
+			return nil, &requestError{http.StatusBadRequest, "from must be start or end"}
+		}
+		return &opFunc{create: true, fn: func(old interface{}, exists bool) (interface{}, bool, error) {
+			list, err := arrayAt(old, exists)
+			if err != nil {
+				return nil, false, err
+			}
+			if op.From == "start" {
+				list = append([]interface{}{value}, list...)
+			} else {
+				list = append(list, value)
+			}
+			// The oldest elements make room: those at the other end from
+			// where the value was pushed.
+			if op.MaxLength != nil && len(list) > *op.MaxLength {
+				if op.From == "start" {
+					list = list[:*op.MaxLength]
+				} else {
+					list = list[len(list)-*op.MaxLength:]
+				}
+			}
+			result["value"] = list
+			return list, true, nil
+		}}, nil
+
+	case "pop":
+		if op.From != "" && op.From != "start" && op.From != "end" {
+			return nil, &requestError{http.StatusBadRequest, "from must be start or end"}
+		}
+		return &opFunc{fn: func(old interface{}, exists bool) (interface{}, bool, error) {
+			list, err := arrayAt(old, exists)
+			if err != nil {
+				return nil, false, err
+			}
+			if len(list) == 0 {
+				return nil, false, &requestError{http.StatusConflict, "Array is empty"}
+			}
+			var popped interface{}
+			if op.From == "start" {
+				popped, list = list[0], list[1:]
+			} else {
+				popped, list = list[len(list)-1], list[:len(list)-1]
+			}
+			result["popped"] = popped
+			result["value"] = list
+			return list, true, nil
+		}}, nil
+
+	case "add_to_set":
+		if err := needsValue(); err != nil {
+			return nil, err
+		}
+		return &opFunc{create: true, fn: func(old interface{}, exists bool) (interface{}, bool, error) {
+			list, err := arrayAt(old, exists)
+			if err != nil {
+				return nil, false, err
+			}
+			for _, item := range list {
+				if reflect.DeepEqual(item, value) {
+					result["value"] = list
+					return list, true, nil
+				}
+			}
+			list = append(list, value)
+			result["value"] = list
+			return list, true, nil
+		}}, nil
+
+	case "set_if_absent":
+		if err := needsValue(); err != nil {
+			return nil, err
+		}
+		return &opFunc{create: true, fn: func(old interface{}, exists bool) (interface{}, bool, error) {
+			if exists {
+				result["value"] = old
+				return old, true, nil
+			}
+			result["value"] = value
+			return value, true, nil
+		}}, nil
+
+	case "unset":
+		return &opFunc{fn: func(old interface{}, exists bool) (interface{}, bool, error) {
+			return nil, false, nil
+		}}, nil
+	}
+
+	return nil, &requestError{http.StatusBadRequest, "op must be incr, decr, push, pop, add_to_set, set_if_absent or unset"}
+}
+
+// arrayAt returns the array found at a path, or an empty one if there is
+// nothing there yet.
+func arrayAt(old interface{}, exists bool) ([]interface{}, error) {
+	if !exists {
+		return []interface{}{}, nil
+	}
+	list, ok := old.([]interface{})
+	if !ok {
+		return nil, &requestError{http.StatusConflict, "Value at path is not an array"}
+	}
+	return list, nil
+}
+
+// addNumbers adds (or subtracts) two JSON numbers. Integers stay exact as
+// long as the result fits in 64 bits; anything else is computed as a float.
+func addNumbers(a, b json.Number, subtract bool) (json.Number, error) {
+	x, errX := a.Int64()
+	y, errY := b.Int64()
+	if errX == nil && errY == nil {
+		if subtract {
+			if y == math.MinInt64 {
+				return "", &requestError{http.StatusConflict, "Result out of range"}
+			}
+			y = -y
+		}
+		sum := x + y
+		if (y > 0 && sum < x) || (y < 0 && sum > x) {
+			return "", &requestError{http.StatusConflict, "Result out of range"}
+		}
+		return json.Number(strconv.FormatInt(sum, 10)), nil
+	}
+
+	fx, errX := a.Float64()
+	fy, errY := b.Float64()
+	if errX != nil || errY != nil {
+		return "", &requestError{http.StatusConflict, "Value at path is not a number"}
+	}
+	if subtract {
+		fy = -fy
+	}
+	sum := fx + fy
+	if math.IsInf(sum, 0) {
+		return "", &requestError{http.StatusConflict, "Result out of range"}
+	}
+	return json.Number(strconv.FormatFloat(sum, 'g', -1, 64)), nil
+}
+
+// parseOpPath splits a path into its segments. Paths are either dotted
+// ("stats.views", "items.0") or JSON Pointers ("/stats/views") for keys
+// that contain dots.
+func parseOpPath(path string) ([]string, error) {
+	if path == "" || path == "/" {
+		return nil, fmt.Errorf("path is required")
+	}
+
+	var segments []string
+	if strings.HasPrefix(path, "/") {
+		for _, segment := range strings.Split(path[1:], "/") {
+			segment = strings.ReplaceAll(segment, "~1", "/")
+			segments = append(segments, strings.ReplaceAll(segment, "~0", "~"))
+		}
+	} else {
+		segments = strings.Split(path, ".")
+	}
+
+	for _, segment := range segments {
+		if segment == "" {
+			return nil, fmt.Errorf("path must not contain empty segments")
+		}
+	}
+	return segments, nil
+}
+
+// updatePath replaces the value at path inside node with what fn returns,
+// and returns the changed node. Numeric segments index arrays. With create,
+// missing objects along the path are created; without it fn is told the
+// value does not exist and nothing is created.
+func updatePath(node interface{}, path []string, create bool, fn func(old interface{}, exists bool) (interface{}, bool, error)) (interface{}, error) {
+	segment, rest := path[0], path[1:]
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, exists := n[segment]
+		if len(rest) == 0 {
+			updated, keep, err := fn(child, exists)
+			if err != nil {
+				return nil, err
+			}
+			if keep {
+				n[segment] = updated
+			} else {
+				delete(n, segment)
+			}
+			return n, nil
+		}
+		if !exists {
+			if !create {
+				_, _, err := fn(nil, false)
+				return n, err
+			}
+			child = map[string]interface{}{}
+		}
+		updated, err := updatePath(child, rest, create, fn)
+		if err != nil {
+			return nil, err
+		}
+		n[segment] = updated
+		return n, nil
+
+	case []interface{}:
+		index, err := strconv.Atoi(segment)
+		if err != nil || index < 0 {
+			return nil, &requestError{http.StatusConflict, fmt.Sprintf("Path segment %q does not index an array", segment)}
+		}
+		if index >= len(n) {
+			if create {
+				return nil, &requestError{http.StatusConflict, fmt.Sprintf("Array index %d out of range", index)}
+			}
+			_, _, err := fn(nil, false)
+			return n, err
+		}
+		if len(rest) == 0 {
+			updated, keep, err := fn(n[index], true)
+			if err != nil {
+				return nil, err
+			}
+			if !keep {
+				return append(n[:index:index], n[index+1:]...), nil
+			}
+			n[index] = updated
+			return n, nil
+		}
+		updated, err := updatePath(n[index], rest, create, fn)
+		if err != nil {
+			return nil, err
+		}
+		n[index] = updated
+		return n, nil
+	}
+
+	return nil, &requestError{http.StatusConflict, fmt.Sprintf("Path segment %q is inside a value that is not an object or array", segment)}
+}
+
+// decodeJSONValue decodes JSON keeping numbers as json.Number, so that
+// large integers survive a round trip unchanged.
+func decodeJSONValue(data json.RawMessage) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"pocketjson/codec"
+)
+
+// outputFormat is a representation documents can be served in. The first
+// media type is the Content-Type of the response; the others are accepted
+// as aliases.
+type outputFormat struct {
+	name       string
+	mediaTypes []string
+}
+
+// outputFormats lists the representations of a document in order of
+// preference. JSON comes first, so it is chosen for wildcards.
+var outputFormats = []outputFormat{
+	{"json", []string{"application/json"}},
+	{"yaml", []string{"application/yaml", "application/x-yaml", "text/yaml"}},
+	{"csv", []string{"text/csv"}},
+	{"ndjson", []string{"application/x-ndjson"}},
+	{"cbor", []string{"application/cbor"}},
+	{"msgpack", []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"}},
+}
+
+// contentType is the Content-Type of responses in the format.
+func (f *outputFormat) contentType() string {
+	if strings.HasPrefix(f.mediaTypes[0], "text/") {
+		return f.mediaTypes[0] + "; charset=utf-8"
+	}
+	return f.mediaTypes[0]
+}
+
+// negotiateFormat picks the representation of a document from ?format= or,
+// failing that, the Accept header. Without either it is JSON.
+func negotiateFormat(r *http.Request) (*outputFormat, *requestError) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		for i := range outputFormats {
+			if outputFormats[i].name == name {
+				return &outputFormats[i], nil
+			}
+		}
+		return nil, &requestError{http.StatusNotAcceptable, "format must be one of " + formatNames()}
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return &outputFormats[0], nil
+	}
+
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	refused := map[string]bool{}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			refused[mediaType] = true
+			continue
+		}
+		ranges = append(ranges, mediaRange{mediaType, q})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	for _, accepted := range ranges {
+		for i, format := range outputFormats {
+			if refused[format.mediaTypes[0]] {
+				continue
+			}
+			for _, mediaType := range format.mediaTypes {
+				if mediaRangeMatches(accepted.mediaType, mediaType) {
+					return &outputFormats[i], nil
+				}
+			}
+		}
+	}
+
+	types := make([]string, len(outputFormats))
+	for i, format := range outputFormats {
+		types[i] = format.mediaTypes[0]
+	}
+	return nil, &requestError{http.StatusNotAcceptable, "Not acceptable: documents are available as " + strings.Join(types, ", ")}
+}
+
+// mediaRangeMatches reports whether an Accept media range such as text/*
+// covers mediaType.
+func mediaRangeMatches(mediaRange, mediaType string) bool {
+	if mediaRange == "*/*" || mediaRange == mediaType {
+		return true
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	return mediaRange == major+"/*"
+}
+
+func formatNames() string {
+	names := make([]string, len(outputFormats))
+	for i, format := range outputFormats {
+		names[i] = format.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// renderDocument converts a stored document to the negotiated format.
+// Query parameters tune the output: ?indent= pretty-prints JSON with a
+// number of spaces or "tab", and ?columns= and ?flatten=false shape CSV.
+// Documents the format cannot represent fail with 406.
+func renderDocument(r *http.Request, format *outputFormat, data []byte) ([]byte, *requestError) {
+	query := r.URL.Query()
+
+	var out []byte
+	var err error
+	switch format.name {
+	case "json":
+		indent := query.Get("indent")
+		if indent == "" {
+			return data, nil
+		}
+		if indent == "tab" {
+			indent = "\t"
+		} else {
+			n, convErr := strconv.Atoi(indent)
+			if convErr != nil || n < 0 || n > 8 {
+				return nil, &requestError{http.StatusBadRequest, "indent must be between 0 and 8 spaces or tab"}
+			}
+			indent = strings.Repeat(" ", n)
+		}
+		var buf bytes.Buffer
+		if err = json.Indent(&buf, data, "", indent); err == nil {
+			buf.WriteByte('\n')
+			out = buf.Bytes()
+		}
+	case "yaml":
+		out, err = codec.ToYAML(data)
+	case "csv":
+		options := codec.CSVOptions{Flatten: query.Get("flatten") != "false"}
+		if columns := query.Get("columns"); columns != "" {
+			for _, column := range strings.Split(columns, ",") {
+				options.Columns = append(options.Columns, strings.TrimSpace(column))
+			}
+		}
+		out, err = codec.ToCSV(data, options)
+	case "ndjson":
+		out, err = codec.ToNDJSON(data)
+	case "cbor":
+		out, err = codec.JSONToCBOR(data)
+	case "msgpack":
+		out, err = codec.JSONToMsgPack(data)
+	}
+
+	if err != nil {
+		var shapeErr *codec.ShapeError
+		if errors.As(err, &shapeErr) {
+			return nil, &requestError{http.StatusNotAcceptable, "Not acceptable: " + shapeErr.Error()}
+		}
+		log.Printf("failed to render document as %s: %v", format.name, err)
+		return nil, &requestError{http.StatusInternalServerError, "Failed to convert JSON"}
+	}
+	return out, nil
+}
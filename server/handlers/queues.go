@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"pocketjson/storage"
+)
+
+// SendMessage appends the request body to a queue of the caller's tenant.
+// ?delay= (seconds) keeps the message invisible for a while, and
+// ?max_receives= overrides how often it may be received before it becomes
+// a dead letter.
+func SendMessage(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, name, ok := loadScopedName(store, w, r)
+		if !ok {
+			return
+		}
+
+		jsonBytes, ok := readJSONBody(w, r)
+		if !ok {
+			return
+		}
+		cfg := store.Config()
+		if len(jsonBytes) > cfg.AuthenticatedSize {
+			http.Error(w, "JSON too large", http.StatusBadRequest)
+			return
+		}
+
+		query := r.URL.Query()
+		var delay time.Duration
+		if v := query.Get("delay"); v != "" {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds < 0 || seconds > 3600 {
+				http.Error(w, "delay must be between 0 and 3600 seconds", http.StatusBadRequest)
+				return
+			}
+			delay = time.Duration(seconds) * time.Second
+		}
+		maxReceives := cfg.QueueMaxReceives
+		if v := query.Get("max_receives"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 1000 {
+				http.Error(w, "max_receives must be between 1 and 1000", http.StatusBadRequest)
+				return
+			}
+			maxReceives = n
+		}
+
+		now := time.Now()
+		msg := &storage.Message{
+			Queue:       name,
+			TenantID:    caller.TenantID,
+			Data:        json.RawMessage(jsonBytes),
+			MaxReceives: maxReceives,
+			EnqueuedAt:  now,
+			VisibleAt:   now.Add(delay),
+			ExpiresAt:   now.Add(cfg.QueueRetention),
+		}
+		if err := store.DB().Enqueue(r.Context(), msg, cfg.QueueMaxMessages); err != nil {
+			if strings.Contains(err.Error(), "queue is full") {
+				http.Error(w, "Queue is full"+strings.TrimPrefix(err.Error(), "queue is full"), http.StatusInsufficientStorage)
+				return
+			}
+			log.Printf("failed to enqueue message: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		setAuditDetail(r, "message=%d", msg.ID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(msg)
+	}
+}
+
+// ReceiveMessages leases up to max_messages messages of a queue for
+// visibility_timeout seconds. Each comes with a receipt that acknowledges
+// it; messages not acknowledged in time are handed out again.
+func ReceiveMessages(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, name, ok := loadScopedName(store, w, r)
+		if !ok {
+			return
+		}
+
+		request := struct {
+			MaxMessages       int `json:"max_messages"`
+			VisibilityTimeout int `json:"visibility_timeout"`
+		}{MaxMessages: 1, VisibilityTimeout: 30}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if request.MaxMessages < 1 || request.MaxMessages > 100 {
+			http.Error(w, "max_messages must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+		if request.VisibilityTimeout < 1 || request.VisibilityTimeout > 12*60*60 {
+			http.Error(w, "visibility_timeout must be between 1 and 43200 seconds", http.StatusBadRequest)
+			return
+		}
+
+		visibility := time.Duration(request.VisibilityTimeout) * time.Second
+		messages, err := store.DB().ReceiveMessages(r.Context(), caller.TenantID, name, request.MaxMessages, visibility)
+		if err != nil {
+			log.Printf("failed to receive messages: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		setAuditDetail(r, "messages=%d", len(messages))
+		json.NewEncoder(w).Encode(map[string]interface{}{"messages": messages})
+	}
+}
+
+// DeleteMessage acknowledges a message with the receipt of its lease, given
+// as ?receipt=. Dead letters are deleted without a receipt.
+func DeleteMessage(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, name, ok := loadScopedName(store, w, r)
+		if !ok {
+			return
+		}
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "messageID"), 10, 64)
+		if err != nil {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		setAuditDetail(r, "message=%d", id)
+
+		if err := store.DB().DeleteMessage(r.Context(), caller.TenantID, name, id, r.URL.Query().Get("receipt")); err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				http.Error(w, "Message not found or receipt no longer valid", http.StatusNotFound)
+				return
+			}
+			log.Printf("failed to delete message: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListQueues lists the queues of the caller's tenant with their message
+// counts.
+func ListQueues(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := authenticate(store, r)
+		if caller.DocumentID != "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		queues, err := store.DB().ListQueues(r.Context(), caller.TenantID, "")
+		if err != nil {
+			log.Printf("failed to list queues: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		// Keys restricted to an ID prefix only see queues named with it.
+		visible := []*storage.QueueStats{}
+		for _, queue := range queues {
+			if caller.AllowsID(queue.Queue) {
+				visible = append(visible, queue)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"queues": visible})
+	}
+}
+
+// GetQueue returns the message counts of one queue. Queues without messages
+// report zeros.
+func GetQueue(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, name, ok := loadScopedName(store, w, r)
+		if !ok {
+			return
+		}
+
+		queues, err := store.DB().ListQueues(r.Context(), caller.TenantID, name)
+		if err != nil {
+			log.Printf("failed to read queue: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		stats := &storage.QueueStats{Queue: name}
+		if len(queues) > 0 {
+			stats = queues[0]
+		}
+		json.NewEncoder(w).Encode(stats)
+	}
+}
+
+// ListDeadMessages pages through the dead letters of a queue.
+func ListDeadMessages(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, name, ok := loadScopedName(store, w, r)
+		if !ok {
+			return
+		}
+
+		var after int64
+		if v := r.URL.Query().Get("after"); v != "" {
+			var err error
+			if after, err = strconv.ParseInt(v, 10, 64); err != nil || after < 0 {
+				http.Error(w, "after must be a message id", http.StatusBadRequest)
+				return
+			}
+		}
+		limit, ok := parseLimit(w, r)
+		if !ok {
+			return
+		}
+
+		messages, err := store.DB().ListDeadMessages(r.Context(), caller.TenantID, name, after, limit)
+		if err != nil {
+			log.Printf("failed to list dead messages: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"messages": messages})
+	}
+}
+
+// RetryMessage returns a dead letter to its queue.
+func RetryMessage(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, name, ok := loadScopedName(store, w, r)
+		if !ok {
+			return
+		}
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "messageID"), 10, 64)
+		if err != nil {
+			http.Error(w, "Dead message not found", http.StatusNotFound)
+			return
+		}
+		setAuditDetail(r, "message=%d", id)
+
+		if err := store.DB().RetryMessage(r.Context(), caller.TenantID, name, id); err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				http.Error(w, "Dead message not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("failed to retry message: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// loadScopedName validates the {name} URL parameter of a queue or lock and
+// checks that the caller may use it. Both are scoped to the caller's
+// tenant, and keys restricted to an ID prefix only use names starting with
+// it.
+func loadScopedName(store *storage.Store, w http.ResponseWriter, r *http.Request) (*storage.Permissions, string, bool) {
+	caller, _ := authenticate(store, r)
+	if caller.DocumentID != "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, "", false
+	}
+
+	name := chi.URLParam(r, "name")
+	if !validName(name) {
+		http.Error(w, "name must be 1 to 80 letters, digits, dots, dashes or underscores", http.StatusBadRequest)
+		return nil, "", false
+	}
+	if !caller.AllowsID(name) {
+		http.Error(w, "Forbidden: name must start with "+caller.IDPrefix, http.StatusForbidden)
+		return nil, "", false
+	}
+
+	setAuditTarget(r, name)
+	return caller, name, true
+}
+
+// validName reports whether name can name a queue or lock: 1 to 80 letters,
+// digits, dots, dashes or underscores.
+func validName(name string) bool {
+	if name == "" || len(name) > 80 {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"pocketjson/storage"
+)
+
+// SignDocumentURL issues a time-limited URL that lets anyone holding it read
+// or replace one document without an API key. The calling key must be able
+// to do the same itself.
+func SignDocumentURL(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Method    string `json:"method"`
+			ExpiresIn int    `json:"expires_in"`
+			MaxUses   int    `json:"max_uses"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		request.Method = strings.ToUpper(request.Method)
+		if request.Method == "" {
+			request.Method = http.MethodGet
+		}
+		var scope storage.Scope
+		switch request.Method {
+		case http.MethodGet:
+			scope = storage.ScopeDocumentsRead
+		case http.MethodPut:
+			scope = storage.ScopeDocumentsWrite
+		default:
+			http.Error(w, "method must be GET or PUT", http.StatusBadRequest)
+			return
+		}
+
+		maxTTL := store.Config().SignedURLMaxTTL
+		ttl := time.Duration(request.ExpiresIn) * time.Second
+		if request.ExpiresIn == 0 {
+			ttl = time.Hour
+		}
+		if ttl <= 0 || ttl > maxTTL {
+			http.Error(w, "expires_in must be between 1 and "+formatSeconds(maxTTL)+" seconds", http.StatusBadRequest)
+			return
+		}
+		if request.MaxUses < 0 {
+			http.Error(w, "max_uses must not be negative", http.StatusBadRequest)
+			return
+		}
+
+		perms, _ := authenticate(store, r)
+		if perms == nil || perms.Guest {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !perms.Has(scope) {
+			http.Error(w, "Forbidden: missing scope "+string(scope), http.StatusForbidden)
+			return
+		}
+
+		doc, ok := loadManagedDocument(store, w, r)
+		if !ok {
+			return
+		}
+		setAuditTarget(r, doc.ID)
+		setAuditDetail(r, "method=%s expires_in=%d max_uses=%d", request.Method, int(ttl.Seconds()), request.MaxUses)
+
+		signed := &storage.SignedURL{
+			Method:     request.Method,
+			Path:       "/" + doc.ID,
+			DocumentID: doc.ID,
+			ExpiresAt:  time.Now().Add(ttl).Truncate(time.Second),
+			MaxUses:    request.MaxUses,
+		}
+		query, err := store.SignURL(r.Context(), perms, signed)
+		if err != nil {
+			log.Printf("failed to sign url: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"url":        baseURL(r) + signed.Path + "?" + query.Encode(),
+			"method":     request.Method,
+			"expires_at": signed.ExpiresAt.Format(time.RFC3339),
+		}
+		if request.MaxUses > 0 {
+			response["max_uses"] = request.MaxUses
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// ListSigningSecrets lists the IDs of the secrets signed URLs are checked
+// against. The secrets themselves never leave the server.
+func ListSigningSecrets(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := authenticate(store, r)
+		if !caller.IsAdmin {
+			http.Error(w, "Only admin keys can manage signing secrets", http.StatusForbidden)
+			return
+		}
+
+		secrets, err := store.DB().ListSigningSecrets(r.Context())
+		if err != nil {
+			log.Printf("failed to list signing secrets: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		response := make([]map[string]interface{}, len(secrets))
+		for i, secret := range secrets {
+			response[i] = signingSecretResponse(secret)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"secrets": response})
+	}
+}
+
+// RotateSigningSecret replaces the signing secret. Every URL signed so far
+// stops working.
+func RotateSigningSecret(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := authenticate(store, r)
+		if !caller.IsAdmin {
+			http.Error(w, "Only admin keys can manage signing secrets", http.StatusForbidden)
+			return
+		}
+
+		secret, err := store.DB().RotateSigningSecret(r.Context())
+		if err != nil {
+			log.Printf("failed to rotate signing secret: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		setAuditTarget(r, secret.ID)
+
+		json.NewEncoder(w).Encode(signingSecretResponse(secret))
+	}
+}
+
+func signingSecretResponse(secret *storage.SigningSecret) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         secret.ID,
+		"created_at": secret.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+// baseURL reconstructs the scheme and host the request was made to, taking
+// a TLS-terminating proxy into account.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.Itoa(int(d.Seconds()))
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"pocketjson/config"
+)
+
+// Streams keeps track of open event streams. It caps how many a single IP
+// address or key may hold open, and ends them all when the server shuts
+// down, which would otherwise wait for them forever.
+type Streams struct {
+	perIP  int
+	perKey int
+
+	mutex  sync.Mutex
+	byIP   map[string]int
+	byKey  map[string]int
+	done   chan struct{}
+	closed bool
+}
+
+func NewStreams(cfg *config.Config) *Streams {
+	return &Streams{
+		perIP:  cfg.StreamsPerIP,
+		perKey: cfg.StreamsPerKey,
+		byIP:   make(map[string]int),
+		byKey:  make(map[string]int),
+		done:   make(chan struct{}),
+	}
+}
+
+// acquire registers a stream for an IP address and key (empty for guests).
+// It returns false if either is at its limit; otherwise release must be
+// called when the stream ends.
+func (s *Streams) acquire(ip, keyID string) (release func(), ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed || s.byIP[ip] >= s.perIP || (keyID != "" && s.byKey[keyID] >= s.perKey) {
+		return nil, false
+	}
+	s.byIP[ip]++
+	if keyID != "" {
+		s.byKey[keyID]++
+	}
+
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.byIP[ip]--; s.byIP[ip] <= 0 {
+			delete(s.byIP, ip)
+		}
+		if keyID != "" {
+			if s.byKey[keyID]--; s.byKey[keyID] <= 0 {
+				delete(s.byKey, keyID)
+			}
+		}
+	}, true
+}
+
+// Done is closed when the server shuts down.
+func (s *Streams) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close ends every open stream and refuses new ones.
+func (s *Streams) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+// eventStream writes Server-Sent Events to a response.
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// heartbeatInterval is how often idle streams send a comment line, which
+// keeps proxies from closing them.
+const heartbeatInterval = 15 * time.Second
+
+// startEventStream sends the event stream headers. It fails if the response
+// cannot be flushed incrementally.
+func startEventStream(w http.ResponseWriter) (*eventStream, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+	return &eventStream{w: w, flusher: flusher}, true
+}
+
+// send writes one event. data must not contain newlines, which holds for
+// the compact JSON stored by the server.
+func (s *eventStream) send(id, event, data string) error {
+	if id != "" {
+		if _, err := fmt.Fprintf(s.w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *eventStream) heartbeat() error {
+	if _, err := fmt.Fprint(s.w, ": heartbeat\n\n"); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"pocketjson/storage"
+	"pocketjson/utils"
+)
+
+// CreateTenant creates a tenant that keys can then be created in. Only admin
+// keys can create tenants.
+func CreateTenant(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := authenticate(store, r)
+		if !caller.IsAdmin {
+			http.Error(w, "Only admin keys can create tenants", http.StatusForbidden)
+			return
+		}
+
+		var request struct {
+			Slug        string `json:"slug"`
+			Description string `json:"description"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if request.Slug != "" && !utils.IsValidSlug(request.Slug) {
+			http.Error(w, "Invalid slug. Use 2-32 lowercase letters, digits and hyphens", http.StatusBadRequest)
+			return
+		}
+
+		id, err := utils.GenerateRandomKey()
+		if err != nil {
+			log.Printf("failed to generate tenant id: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		tenant := &storage.Tenant{
+			ID:          id[:10],
+			Slug:        request.Slug,
+			Description: request.Description,
+			CreatedAt:   time.Now(),
+		}
+
+		if err := store.DB().CreateTenant(r.Context(), tenant); err != nil {
+			if strings.Contains(err.Error(), "taken") {
+				http.Error(w, "Slug already taken", http.StatusConflict)
+				return
+			}
+			log.Printf("failed to create tenant: %v", err)
+			http.Error(w, "Failed to create tenant", http.StatusInternalServerError)
+			return
+		}
+
+		setAuditTarget(r, tenant.ID)
+		json.NewEncoder(w).Encode(tenantResponse(tenant))
+	}
+}
+
+// ListTenants returns all tenants to admin keys and only their own tenant to
+// other keys.
+func ListTenants(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := authenticate(store, r)
+
+		tenants, err := store.DB().ListTenants(r.Context())
+		if err != nil {
+			log.Printf("failed to list tenants: %v", err)
+			http.Error(w, "Failed to list tenants", http.StatusInternalServerError)
+			return
+		}
+
+		response := []map[string]interface{}{}
+		for _, tenant := range tenants {
+			if caller.IsAdmin || tenant.ID == caller.TenantID {
+				response = append(response, tenantResponse(tenant))
+			}
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// UpdateTenant changes the slug or description of a tenant. Documents keep
+// resolving under every prefix the tenant has had, and a replaced slug stays
+// reserved for it.
+func UpdateTenant(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenantID := chi.URLParam(r, "id")
+		ctx := r.Context()
+
+		caller, _ := authenticate(store, r)
+		if !caller.IsAdmin && tenantID != caller.TenantID {
+			http.Error(w, "Tenant not found", http.StatusNotFound)
+			return
+		}
+
+		var request struct {
+			Slug        *string `json:"slug"`
+			Description *string `json:"description"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if request.Slug != nil && *request.Slug != "" && !utils.IsValidSlug(*request.Slug) {
+			http.Error(w, "Invalid slug. Use 2-32 lowercase letters, digits and hyphens", http.StatusBadRequest)
+			return
+		}
+
+		if err := store.DB().UpdateTenant(ctx, tenantID, request.Slug, request.Description); err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				http.Error(w, "Tenant not found", http.StatusNotFound)
+				return
+			}
+			if strings.Contains(err.Error(), "taken") {
+				http.Error(w, "Slug already taken", http.StatusConflict)
+				return
+			}
+			log.Printf("failed to update tenant %s: %v", tenantID, err)
+			http.Error(w, "Failed to update tenant", http.StatusInternalServerError)
+			return
+		}
+
+		store.InvalidateTenantCache(tenantID)
+
+		tenant, err := store.DB().GetTenant(ctx, tenantID)
+		if err != nil {
+			log.Printf("failed to load tenant %s: %v", tenantID, err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(tenantResponse(tenant))
+	}
+}
+
+func tenantResponse(tenant *storage.Tenant) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          tenant.ID,
+		"slug":        tenant.Slug,
+		"namespace":   tenant.Namespace(),
+		"description": tenant.Description,
+		"created_at":  tenant.CreatedAt.Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"pocketjson/storage"
+	"pocketjson/utils"
+)
+
+// CreateWebhook subscribes the calling key to lifecycle events of its
+// tenant's documents. The secret used to sign deliveries is only returned
+// here.
+func CreateWebhook(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			URL      string   `json:"url"`
+			Events   []string `json:"events"`
+			IDPrefix string   `json:"id_prefix"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		target, err := url.Parse(request.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+			return
+		}
+		// Deliveries only ever connect to public addresses. Addresses given
+		// literally can be refused right away; names are checked when dialled.
+		if addr, err := netip.ParseAddr(target.Hostname()); err == nil && !utils.IsPublicIP(addr) {
+			http.Error(w, "url must point to a public address", http.StatusBadRequest)
+			return
+		}
+
+		events, err := storage.ParseEvents(request.Events)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		caller, _ := authenticate(store, r)
+		if caller.DocumentID != "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// Keys restricted to an ID prefix only hear about their own IDs.
+		idPrefix := request.IDPrefix
+		if idPrefix == "" {
+			idPrefix = caller.IDPrefix
+		}
+		if !caller.AllowsID(idPrefix) {
+			http.Error(w, "Forbidden: id_prefix must start with "+caller.IDPrefix, http.StatusForbidden)
+			return
+		}
+
+		id, err := utils.GenerateRandomKey()
+		if err != nil {
+			log.Printf("failed to generate webhook id: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		secret, err := utils.GenerateRandomKey()
+		if err != nil {
+			log.Printf("failed to generate webhook secret: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		webhook := &storage.Webhook{
+			ID:        id[:16],
+			KeyID:     caller.KeyID,
+			TenantID:  caller.TenantID,
+			URL:       target.String(),
+			Secret:    secret,
+			Events:    events,
+			IDPrefix:  idPrefix,
+			CreatedAt: time.Now(),
+		}
+		setAuditTarget(r, webhook.ID)
+		setAuditDetail(r, "url=%s", target.Redacted())
+
+		if err := store.DB().CreateWebhook(r.Context(), webhook); err != nil {
+			log.Printf("failed to create webhook: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		response := webhookResponse(webhook)
+		response["secret"] = webhook.Secret
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// ListWebhooks lists the webhooks of the calling key.
+func ListWebhooks(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := authenticate(store, r)
+		webhooks, err := store.DB().ListWebhooks(r.Context(), caller.KeyID)
+		if err != nil {
+			log.Printf("failed to list webhooks: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		response := make([]map[string]interface{}, len(webhooks))
+		for i, webhook := range webhooks {
+			response[i] = webhookResponse(webhook)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"webhooks": response})
+	}
+}
+
+// DeleteWebhook removes a webhook and drops its pending deliveries.
+func DeleteWebhook(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhook, ok := loadWebhook(store, w, r)
+		if !ok {
+			return
+		}
+
+		if err := store.DB().DeleteWebhook(r.Context(), webhook.ID); err != nil {
+			log.Printf("failed to delete webhook: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListDeliveries shows the recent deliveries of a webhook. Filtering with
+// ?status=dead lists the dead letters, deliveries that were given up on.
+func ListDeliveries(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhook, ok := loadWebhook(store, w, r)
+		if !ok {
+			return
+		}
+
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "", storage.DeliveryPending, storage.DeliveryDelivered, storage.DeliveryDead:
+		default:
+			http.Error(w, "status must be pending, delivered or dead", http.StatusBadRequest)
+			return
+		}
+		limit, ok := parseLimit(w, r)
+		if !ok {
+			return
+		}
+
+		deliveries, err := store.DB().ListDeliveries(r.Context(), webhook.ID, status, limit)
+		if err != nil {
+			log.Printf("failed to list deliveries: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"deliveries": deliveries})
+	}
+}
+
+// RetryDelivery puts a dead letter back into the outbox for another round
+// of attempts.
+func RetryDelivery(store *storage.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhook, ok := loadWebhook(store, w, r)
+		if !ok {
+			return
+		}
+
+		deliveryID, err := strconv.ParseInt(chi.URLParam(r, "deliveryID"), 10, 64)
+		if err != nil {
+			http.Error(w, "Delivery not found", http.StatusNotFound)
+			return
+		}
+		setAuditDetail(r, "delivery=%d", deliveryID)
+
+		if err := store.DB().RetryDelivery(r.Context(), webhook.ID, deliveryID); err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				http.Error(w, "Dead delivery not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("failed to retry delivery: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// loadWebhook loads the webhook named in the URL. Webhooks of other keys
+// are reported as missing, except to admins.
+func loadWebhook(store *storage.Store, w http.ResponseWriter, r *http.Request) (*storage.Webhook, bool) {
+	webhook, err := store.DB().GetWebhook(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return nil, false
+		}
+		log.Printf("failed to load webhook: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	caller, _ := authenticate(store, r)
+	if caller.DocumentID != "" || (webhook.KeyID != caller.KeyID && !caller.IsAdmin) {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return nil, false
+	}
+	return webhook, true
+}
+
+func webhookResponse(webhook *storage.Webhook) map[string]interface{} {
+	events := webhook.Events
+	if len(events) == 0 {
+		events = storage.AllEvents
+	}
+	return map[string]interface{}{
+		"id":         webhook.ID,
+		"key_id":     webhook.KeyID,
+		"url":        webhook.URL,
+		"events":     events,
+		"id_prefix":  webhook.IDPrefix,
+		"created_at": webhook.CreatedAt.Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestLargeIntegersAreStoredExactly(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	huge, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	encoded, err := cbor.Marshal(map[string]interface{}{"n": huge})
+	if err != nil {
+		t.Fatalf("failed to encode CBOR: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		want        string
+	}{
+		{"json", "application/json", []byte(`{"n": 9007199254740993, "m": 123456789012345678901234567890}`), `{"m":123456789012345678901234567890,"n":9007199254740993}`},
+		{"cbor", "application/cbor", encoded, `{"n":123456789012345678901234567890}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+"/big-"+tt.name, bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("X-API-Key", key)
+			var created struct {
+				ID string `json:"id"`
+			}
+			if status := send(t, req, &created); status != http.StatusOK {
+				t.Fatalf("create: status %d", status)
+			}
+
+			resp, err := http.Get(ts.URL + "/" + created.ID)
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			defer resp.Body.Close()
+			data, _ := io.ReadAll(resp.Body)
+			if got := string(bytes.TrimSpace(data)); got != tt.want {
+				t.Errorf("stored %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// post sends body as it is with the given Content-Type and decodes a JSON
+// response into out, if given.
+func (ts *testServer) post(t *testing.T, path, apiKey, contentType string, body []byte, out interface{}) int {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	return send(t, req, out)
+}
+
+// createFrom creates a document from body in the given format and returns
+// it as stored.
+func (ts *testServer) createFrom(t *testing.T, apiKey, path, contentType string, body []byte) string {
+	t.Helper()
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	if status := ts.post(t, path, apiKey, contentType, body, &created); status != http.StatusOK {
+		t.Fatalf("create from %s: status %d", contentType, status)
+	}
+	return ts.documentBody(t, created.ID)
+}
+
+func TestJSONCInput(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	body := "{\n  // the theme\n  \"theme\": \"dark\", /* or light */\n  \"url\": \"http://example.com/*x*/\",\n  \"langs\": [\"en\", \"de\",],\n}"
+	if got := ts.createFrom(t, key, "/settings", "application/jsonc", []byte(body)); got != `{"langs":["en","de"],"theme":"dark","url":"http://example.com/*x*/"}` {
+		t.Errorf("stored %s", got)
+	}
+	if got := ts.createFrom(t, key, "/api", "application/vnd.api+json; charset=UTF-8", []byte(`{"a":1}`)); got != `{"a":1}` {
+		t.Errorf("+json stored %s", got)
+	}
+
+	for _, tt := range []struct {
+		contentType, body string
+	}{
+		{"application/jsonc", `{"a":1 /* never closed`},
+		{"application/jsonc", `{"a":1,,}`},
+		{"application/json", `{"a":1,}`},
+		{"application/json; charset=latin1", `{"a":1}`},
+		{"text/plain", `{"a":1}`},
+		{"application/json", `"a string"`},
+	} {
+		if status := ts.post(t, "/", key, tt.contentType, []byte(tt.body), nil); status != http.StatusBadRequest {
+			t.Errorf("%s %s: status %d, want 400", tt.contentType, tt.body, status)
+		}
+	}
+}
+
+func TestNDJSONInput(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	body := "{\"a\":1}\n\n  [2]  \r\n3\n\"x\"\n"
+	if got := ts.createFrom(t, key, "/lines", "application/x-ndjson", []byte(body)); got != `[{"a":1},[2],3,"x"]` {
+		t.Errorf("stored %s", got)
+	}
+	if got := ts.createFrom(t, key, "/empty", "application/x-ndjson", []byte("\n\n")); got != `[]` {
+		t.Errorf("empty body stored %s", got)
+	}
+	if status := ts.post(t, "/", key, "application/x-ndjson", []byte("{\"a\":1}\n{\"a\":"), nil); status != http.StatusBadRequest {
+		t.Errorf("truncated line: status %d, want 400", status)
+	}
+}
+
+func TestNDJSONBatch(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	var batch struct {
+		Committed bool `json:"committed"`
+		Results   []struct {
+			ID     string `json:"id"`
+			Status int    `json:"status"`
+		} `json:"results"`
+	}
+	if status := ts.post(t, "/?ndjson=batch&visibility=private", key, "application/x-ndjson", []byte("{\"n\":1}\n[2]\n"), &batch); status != http.StatusOK {
+		t.Fatalf("batch: status %d", status)
+	}
+	if !batch.Committed || len(batch.Results) != 2 {
+		t.Fatalf("batch = %+v", batch)
+	}
+	for i, want := range []string{`{"n":1}`, `[2]`} {
+		result := batch.Results[i]
+		if result.Status != http.StatusOK || result.ID == "" {
+			t.Fatalf("result %d = %+v", i, result)
+		}
+		if status := ts.do(t, http.MethodGet, "/"+result.ID, "", nil, nil); status != http.StatusNotFound {
+			t.Errorf("anonymous read of %s: status %d, want 404 for a private document", result.ID, status)
+		}
+		var data json.RawMessage
+		if status := ts.do(t, http.MethodGet, "/"+result.ID, key, nil, &data); status != http.StatusOK || string(data) != want {
+			t.Errorf("line %d stored as %s (status %d), want %s", i+1, data, status, want)
+		}
+	}
+
+	// A line that is not a document fails the whole atomic batch.
+	batch.Results = nil
+	if status := ts.post(t, "/?ndjson=batch&atomic=true", key, "application/x-ndjson", []byte("{\"n\":3}\n4\n"), &batch); status != http.StatusOK {
+		t.Fatalf("atomic batch: status %d", status)
+	}
+	if batch.Committed || len(batch.Results) != 2 || batch.Results[1].Status != http.StatusBadRequest {
+		t.Errorf("atomic batch = %+v, want it rolled back at line 2", batch)
+	}
+	if status := ts.do(t, http.MethodGet, "/"+batch.Results[0].ID, key, nil, nil); status != http.StatusNotFound {
+		t.Errorf("rolled back line 1: status %d, want 404", status)
+	}
+
+	for path, contentType := range map[string]string{
+		"/?ndjson=batch":      "application/json",
+		"/named?ndjson=batch": "application/x-ndjson",
+	} {
+		if status := ts.post(t, path, key, contentType, []byte("{\"n\":1}\n"), nil); status != http.StatusBadRequest {
+			t.Errorf("POST %s as %s: status %d, want 400", path, contentType, status)
+		}
+	}
+	if status := ts.post(t, "/?ndjson=batch", "", "application/x-ndjson", []byte("{\"n\":1}\n"), nil); status != http.StatusUnauthorized {
+		t.Errorf("anonymous batch: status %d, want 401", status)
+	}
+}
+
+func TestFormInput(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	body := []byte("name=Ada+Lovelace&tag=x&tag=y&empty=")
+	if status := ts.post(t, "/", key, "application/x-www-form-urlencoded", body, nil); status != http.StatusBadRequest {
+		t.Errorf("form without form=true: status %d, want 400", status)
+	}
+	if got := ts.createFrom(t, key, "/signup?form=true", "application/x-www-form-urlencoded", body); got != `{"empty":"","name":"Ada Lovelace","tag":["x","y"]}` {
+		t.Errorf("stored %s", got)
+	}
+	if status := ts.post(t, "/?form=true", key, "application/x-www-form-urlencoded", []byte("a=%zz"), nil); status != http.StatusBadRequest {
+		t.Errorf("malformed form: status %d, want 400", status)
+	}
+}
+
+func TestBinaryInputIsConverted(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	// {"b": h'fbff', 1: 1(1700000000)}
+	cbor := []byte{0xa2, 0x61, 0x62, 0x42, 0xfb, 0xff, 0x01, 0xc1, 0x1a, 0x65, 0x53, 0xf1, 0x00}
+	if got := ts.createFrom(t, key, "/reading", "application/cbor", cbor); got != `{"1":"2023-11-14T22:13:20Z","b":"-_8"}` {
+		t.Errorf("CBOR stored as %s", got)
+	}
+	// {"n": 1.5}
+	msgpack := []byte{0x81, 0xa1, 0x6e, 0xca, 0x3f, 0xc0, 0x00, 0x00}
+	if got := ts.createFrom(t, key, "/sample", "application/vnd.msgpack", msgpack); got != `{"n":1.5}` {
+		t.Errorf("MessagePack stored as %s", got)
+	}
+
+	for _, tt := range []struct {
+		name, contentType string
+		body              []byte
+	}{
+		{"CBOR NaN", "application/cbor", []byte{0x81, 0xf9, 0x7e, 0x00}},
+		{"CBOR scalar", "application/cbor", []byte{0x01}},
+		{"MessagePack bin key", "application/msgpack", []byte{0x81, 0xc4, 0x01, 0x00, 0x01}},
+		{"MessagePack extension", "application/msgpack", []byte{0x91, 0xd4, 0x05, 0x00}},
+	} {
+		if status := ts.post(t, "/", key, tt.contentType, tt.body, nil); status != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", tt.name, status)
+		}
+	}
+}
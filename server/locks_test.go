@@ -0,0 +1,194 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"pocketjson/storage"
+)
+
+// acquire takes a lock and returns its lease, or nil with the status if it
+// is held.
+func (ts *testServer) acquire(t *testing.T, apiKey, name string, request map[string]interface{}) (*storage.Lock, int) {
+	t.Helper()
+
+	var lock storage.Lock
+	status := ts.do(t, http.MethodPost, "/locks/"+name, apiKey, request, &lock)
+	if status != http.StatusOK {
+		return nil, status
+	}
+	return &lock, status
+}
+
+func TestLockFencingTokens(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	var last int64
+	for i := 0; i < 3; i++ {
+		lock, status := ts.acquire(t, key, "report", nil)
+		if lock == nil {
+			t.Fatalf("acquire %d: status %d", i+1, status)
+		}
+		if lock.OwnerToken == "" || lock.FencingToken <= last {
+			t.Fatalf("acquire %d: owner %q, fencing token %d after %d", i+1, lock.OwnerToken, lock.FencingToken, last)
+		}
+		last = lock.FencingToken
+		if status := ts.do(t, http.MethodDelete, "/locks/report?owner_token="+lock.OwnerToken, key, nil, nil); status != http.StatusNoContent {
+			t.Fatalf("release %d: status %d", i+1, status)
+		}
+	}
+
+	// Fencing tokens keep growing across names, so a token never repeats.
+	lock, _ := ts.acquire(t, key, "other", nil)
+	if lock == nil || lock.FencingToken <= last {
+		t.Errorf("other lock = %+v, want a fencing token above %d", lock, last)
+	}
+}
+
+func TestLockIsExclusive(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	held, _ := ts.acquire(t, key, "report", map[string]interface{}{"ttl": 60})
+	if held == nil {
+		t.Fatal("acquire failed")
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/locks/report", nil)
+	req.Header.Set("X-API-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("second acquire: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("second acquire: status %d, Retry-After %q, want 409 with a Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	var current storage.Lock
+	if status := ts.do(t, http.MethodGet, "/locks/report", key, nil, &current); status != http.StatusOK {
+		t.Fatalf("get: status %d", status)
+	}
+	if current.OwnerToken != "" || current.FencingToken != held.FencingToken {
+		t.Errorf("get = %+v, want the lease without its owner token", current)
+	}
+
+	// Locks are per tenant.
+	other, _ := ts.createTenantKey(t, nil)
+	if lock, status := ts.acquire(t, other, "report", nil); lock == nil {
+		t.Errorf("acquire in another tenant: status %d, want 200", status)
+	}
+}
+
+func TestLockWrongOwnerToken(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	held, _ := ts.acquire(t, key, "report", nil)
+	if held == nil {
+		t.Fatal("acquire failed")
+	}
+
+	renew := map[string]interface{}{"owner_token": "not-the-owner", "ttl": 60}
+	if status := ts.do(t, http.MethodPost, "/locks/report/renew", key, renew, nil); status != http.StatusConflict {
+		t.Errorf("renew with the wrong owner token: status %d, want 409", status)
+	}
+	if status := ts.do(t, http.MethodDelete, "/locks/report?owner_token=not-the-owner", key, nil, nil); status != http.StatusConflict {
+		t.Errorf("release with the wrong owner token: status %d, want 409", status)
+	}
+	if status := ts.do(t, http.MethodDelete, "/locks/report", key, nil, nil); status != http.StatusConflict {
+		t.Errorf("release without an owner token: status %d, want 409", status)
+	}
+
+	var renewed storage.Lock
+	renew["owner_token"] = held.OwnerToken
+	if status := ts.do(t, http.MethodPost, "/locks/report/renew", key, renew, &renewed); status != http.StatusOK {
+		t.Fatalf("renew: status %d", status)
+	}
+	if !renewed.ExpiresAt.After(held.ExpiresAt) || renewed.FencingToken != held.FencingToken {
+		t.Errorf("renewed = %+v, want a later expiry and the same fencing token", renewed)
+	}
+	if status := ts.do(t, http.MethodDelete, "/locks/report?owner_token="+held.OwnerToken, key, nil, nil); status != http.StatusNoContent {
+		t.Errorf("release: status %d, want 204", status)
+	}
+	if status := ts.do(t, http.MethodGet, "/locks/report", key, nil, nil); status != http.StatusNotFound {
+		t.Errorf("get after release: status %d, want 404", status)
+	}
+}
+
+func TestLockExpiredLeaseIsTakenOver(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	stale, _ := ts.acquire(t, key, "report", map[string]interface{}{"ttl": 1})
+	if stale == nil {
+		t.Fatal("acquire failed")
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	lock, status := ts.acquire(t, key, "report", nil)
+	if lock == nil {
+		t.Fatalf("acquire after the lease ran out: status %d, want 200", status)
+	}
+	if lock.OwnerToken == stale.OwnerToken || lock.FencingToken <= stale.FencingToken {
+		t.Errorf("takeover = %+v, want a new owner and a larger fencing token than %d", lock, stale.FencingToken)
+	}
+
+	// The previous holder can no longer renew or release.
+	renew := map[string]interface{}{"owner_token": stale.OwnerToken, "ttl": 60}
+	if status := ts.do(t, http.MethodPost, "/locks/report/renew", key, renew, nil); status != http.StatusConflict {
+		t.Errorf("renew by the previous holder: status %d, want 409", status)
+	}
+	if status := ts.do(t, http.MethodDelete, "/locks/report?owner_token="+stale.OwnerToken, key, nil, nil); status != http.StatusConflict {
+		t.Errorf("release by the previous holder: status %d, want 409", status)
+	}
+}
+
+func TestLockWait(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	held, _ := ts.acquire(t, key, "report", map[string]interface{}{"ttl": 60})
+	if held == nil {
+		t.Fatal("acquire failed")
+	}
+
+	var wg sync.WaitGroup
+	var waited *storage.Lock
+	var status int
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		waited, status = ts.acquire(t, key, "report", map[string]interface{}{"wait": 5})
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	if status := ts.do(t, http.MethodDelete, "/locks/report?owner_token="+held.OwnerToken, key, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("release: status %d", status)
+	}
+	wg.Wait()
+	if waited == nil {
+		t.Fatalf("waiting acquire: status %d, want 200 once the lock was released", status)
+	}
+	if waited.FencingToken <= held.FencingToken {
+		t.Errorf("waiting acquire got fencing token %d, want more than %d", waited.FencingToken, held.FencingToken)
+	}
+
+	// A wait that runs out answers like a held lock.
+	start := time.Now()
+	if _, status := ts.acquire(t, key, "report", map[string]interface{}{"wait": 1}); status != http.StatusConflict {
+		t.Errorf("acquire with a short wait: status %d, want 409", status)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("acquire with a 1s wait returned after %v", elapsed)
+	}
+
+	for _, request := range []map[string]interface{}{{"ttl": 0}, {"ttl": 86401}, {"wait": -1}, {"wait": 31}} {
+		if _, status := ts.acquire(t, key, "bad", request); status != http.StatusBadRequest {
+			t.Errorf("acquire %v: status %d, want 400", request, status)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"pocketjson/storage"
+)
+
+// ContentDigest checks the Content-Digest header (RFC 9530) of requests
+// that send one against the body as received, before any handler reads
+// it. sha-256 and sha-512 digests are verified; a header with neither, or
+// a digest that does not match, fails the request. Requests caught by
+// buckets are recorded as they were sent and not checked.
+func ContentDigest(store *storage.Store) func(http.Handler) http.Handler {
+	cfg := store.Config()
+	maxBytes := max(cfg.AuthenticatedSize, cfg.BatchMaxBytes)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Content-Digest")
+			if header == "" || strings.HasPrefix(r.URL.Path, "/catch/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			digests, err := parseContentDigest(header)
+			if err != nil {
+				http.Error(w, "Invalid Content-Digest: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxBytes)))
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					http.Error(w, fmt.Sprintf("Request body too large (max %d bytes)", maxBytes), http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, "Failed to read request body", http.StatusBadRequest)
+				return
+			}
+
+			verified := false
+			for algorithm, expected := range digests {
+				var actual []byte
+				switch algorithm {
+				case "sha-256":
+					sum := sha256.Sum256(body)
+					actual = sum[:]
+				case "sha-512":
+					sum := sha512.Sum512(body)
+					actual = sum[:]
+				default:
+					continue
+				}
+				if subtle.ConstantTimeCompare(actual, expected) != 1 {
+					http.Error(w, "Content-Digest does not match the request body", http.StatusBadRequest)
+					return
+				}
+				verified = true
+			}
+			if !verified {
+				http.Error(w, "Content-Digest must include sha-256 or sha-512", http.StatusBadRequest)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// parseContentDigest reads a Content-Digest dictionary such as
+// sha-256=:base64:, sha-512=:base64: into digests by algorithm.
+func parseContentDigest(header string) (map[string][]byte, error) {
+	digests := map[string][]byte{}
+	for _, member := range strings.Split(header, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not algorithm=:digest:", member)
+		}
+		// Parameters are allowed but carry nothing for us.
+		value, _, _ = strings.Cut(value, ";")
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return nil, fmt.Errorf("the digest of %s must be enclosed in colons", name)
+		}
+		digest, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil {
+			return nil, fmt.Errorf("the digest of %s is not base64", name)
+		}
+		digests[strings.ToLower(name)] = digest
+	}
+	return digests, nil
+}
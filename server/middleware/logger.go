@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const redacted = "REDACTED"
+
+// sensitiveHeaders are never passed to the log formatter in clear text.
+var sensitiveHeaders = []string{"X-API-Key", "X-Edit-Token", "Authorization", "Cookie"}
+
+// sensitiveParams lists query parameters that may carry credentials.
+var sensitiveParams = map[string]bool{
+	"key":          true,
+	"api_key":      true,
+	"apikey":       true,
+	"token":        true,
+	"owner_token":  true,
+	"access_token": true,
+	"secret":       true,
+	"password":     true,
+	"sig":          true,
+	"signature":    true,
+}
+
+// keySecretPattern matches the format of generated API key secrets, which
+// older clients still put in /admin/keys/ paths.
+var keySecretPattern = regexp.MustCompile(`^/admin/keys/[0-9a-f]{32}`)
+
+// Logger logs every request like chi's middleware.Logger, but with
+// credentials removed from the request line and headers.
+var Logger = middleware.RequestLogger(&redactingFormatter{
+	next: &middleware.DefaultLogFormatter{
+		Logger:  log.New(os.Stdout, "", log.LstdFlags),
+		NoColor: !isTerminal(),
+	},
+})
+
+type redactingFormatter struct {
+	next middleware.LogFormatter
+}
+
+func (f *redactingFormatter) NewLogEntry(r *http.Request) middleware.LogEntry {
+	return f.next.NewLogEntry(RedactRequest(r))
+}
+
+// RedactRequest returns a shallow copy of r that is safe to log.
+func RedactRequest(r *http.Request) *http.Request {
+	clone := r.Clone(r.Context())
+
+	for _, name := range sensitiveHeaders {
+		if clone.Header.Get(name) != "" {
+			clone.Header.Set(name, redacted)
+		}
+	}
+
+	u := *r.URL
+	if keySecretPattern.MatchString(u.Path) {
+		u.Path = "/admin/keys/" + redacted + u.Path[len("/admin/keys/")+32:]
+		u.RawPath = ""
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for param := range query {
+			if sensitiveParams[strings.ToLower(param)] {
+				query.Set(param, redacted)
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+	clone.URL = &u
+	clone.RequestURI = u.RequestURI()
+
+	return clone
+}
+
+func isTerminal() bool {
+	fi, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const secret = "0123456789abcdef0123456789abcdef"
+
+func TestRedactRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{"query credentials", "/doc?API_KEY=" + secret + "&Sig=abc&expires=123", "/doc?API_KEY=REDACTED&Sig=REDACTED&expires=123"},
+		{"owner token", "/locks/deploy?owner_token=" + secret, "/locks/deploy?owner_token=REDACTED"},
+		{"key secret in path", "/admin/keys/" + secret + "/rotate?grace_hours=0", "/admin/keys/REDACTED/rotate?grace_hours=0"},
+		{"client ID in path", "/admin/keys/7f3d8", "/admin/keys/7f3d8"},
+		{"nothing to redact", "/doc?format=yaml", "/doc?format=yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			clone := RedactRequest(r)
+			if clone.RequestURI != tt.want || clone.URL.RequestURI() != tt.want {
+				t.Errorf("RequestURI = %q, URL = %q, want %q", clone.RequestURI, clone.URL.RequestURI(), tt.want)
+			}
+			if r.RequestURI != tt.target {
+				t.Errorf("the original request was changed to %q", r.RequestURI)
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/doc", nil)
+	for _, name := range sensitiveHeaders {
+		r.Header.Set(name, secret)
+	}
+	r.Header.Set("User-Agent", "curl")
+	clone := RedactRequest(r)
+	for _, name := range sensitiveHeaders {
+		if clone.Header.Get(name) != redacted || r.Header.Get(name) != secret {
+			t.Errorf("%s = %q in the copy and %q in the original", name, clone.Header.Get(name), r.Header.Get(name))
+		}
+	}
+	if clone.Header.Get("User-Agent") != "curl" {
+		t.Errorf("User-Agent = %q, want it kept", clone.Header.Get("User-Agent"))
+	}
+}
+
+func TestLoggerOmitsSecrets(t *testing.T) {
+	var out bytes.Buffer
+	logger := middleware.RequestLogger(&redactingFormatter{
+		next: &middleware.DefaultLogFormatter{Logger: log.New(&out, "", 0), NoColor: true},
+	})
+
+	var seen string
+	handler := logger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("X-API-Key") + " " + r.URL.Query().Get("token")
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/admin/keys/"+secret+"/rotate?token="+secret, nil)
+	r.Header.Set("X-API-Key", secret)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if seen != secret+" "+secret {
+		t.Errorf("the handler saw %q, want the request unchanged", seen)
+	}
+	if line := out.String(); strings.Contains(line, secret) || !strings.Contains(line, "/admin/keys/REDACTED/rotate?token=REDACTED") {
+		t.Errorf("logged %q", line)
+	}
+}
@@ -21,17 +21,18 @@ func RateLimit(store *storage.Store) func(http.Handler) http.Handler {
 
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			apiKey := r.Header.Get("X-API-Key")
-			isAuth, _, err := store.ValidateApiKey(r.Context(), apiKey)
+			perms, err := store.ValidateApiKey(r.Context(), apiKey)
 			if err != nil {
 				http.Error(w, "Server error", http.StatusInternalServerError)
 				return
 			}
 
-			if !isAuth {
+			if perms == nil {
 				limiter(next).ServeHTTP(w, r)
 				return
 			}
 
+			store.RecordKeyUsage(perms.KeyID)
 			next.ServeHTTP(w, r)
 		})
 	}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+type opStep struct {
+	op         map[string]interface{}
+	want       int
+	wantValue  string
+	wantPopped string
+	changed    bool
+}
+
+// runOps applies the operations in order to a fresh document holding data
+// and checks each response. It returns the document's ID.
+func runOps(t *testing.T, ts *testServer, key, data string, steps []opStep) string {
+	t.Helper()
+
+	id := ts.createDocument(t, key, "ops", "", json.RawMessage(data))
+	for _, step := range steps {
+		var result struct {
+			Value   json.RawMessage `json:"value"`
+			Popped  json.RawMessage `json:"popped"`
+			Changed bool            `json:"changed"`
+		}
+		status := ts.do(t, http.MethodPost, "/"+id+"/ops", key, step.op, &result)
+		if status != step.want {
+			t.Errorf("%v: status %d, want %d", step.op, status, step.want)
+			continue
+		}
+		if status != http.StatusOK {
+			continue
+		}
+		if string(result.Value) != step.wantValue {
+			t.Errorf("%v: value %s, want %s", step.op, result.Value, step.wantValue)
+		}
+		if string(result.Popped) != step.wantPopped {
+			t.Errorf("%v: popped %s, want %s", step.op, result.Popped, step.wantPopped)
+		}
+		if result.Changed != step.changed {
+			t.Errorf("%v: changed %v, want %v", step.op, result.Changed, step.changed)
+		}
+	}
+	return id
+}
+
+// documentBody returns a document as stored.
+func (ts *testServer) documentBody(t *testing.T, id string) string {
+	t.Helper()
+
+	_, body := ts.get(t, "/"+id)
+	return body
+}
+
+func TestOpsIncrDecr(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	id := runOps(t, ts, key, `{"n":5,"f":1.5,"big":9223372036854775806,"small":-9223372036854775807,"s":"x"}`, []opStep{
+		{op: map[string]interface{}{"op": "incr", "path": "n"}, want: http.StatusOK, wantValue: "6", changed: true},
+		{op: map[string]interface{}{"op": "decr", "path": "n", "value": 10}, want: http.StatusOK, wantValue: "-4", changed: true},
+		{op: map[string]interface{}{"op": "incr", "path": "f", "value": 0.25}, want: http.StatusOK, wantValue: "1.75", changed: true},
+		{op: map[string]interface{}{"op": "incr", "path": "n", "value": 0.5}, want: http.StatusOK, wantValue: "-3.5", changed: true},
+		{op: map[string]interface{}{"op": "incr", "path": "stats.views"}, want: http.StatusOK, wantValue: "1", changed: true},
+		{op: map[string]interface{}{"op": "incr", "path": "big"}, want: http.StatusOK, wantValue: "9223372036854775807", changed: true},
+		{op: map[string]interface{}{"op": "incr", "path": "big"}, want: http.StatusConflict},
+		{op: map[string]interface{}{"op": "decr", "path": "small"}, want: http.StatusOK, wantValue: "-9223372036854775808", changed: true},
+		{op: map[string]interface{}{"op": "decr", "path": "small"}, want: http.StatusConflict},
+		{op: map[string]interface{}{"op": "decr", "path": "big", "value": json.Number("-9223372036854775808")}, want: http.StatusConflict},
+		{op: map[string]interface{}{"op": "incr", "path": "f", "value": 1.7e308}, want: http.StatusOK, wantValue: "1.7e+308", changed: true},
+		{op: map[string]interface{}{"op": "incr", "path": "f", "value": 1.7e308}, want: http.StatusConflict},
+		{op: map[string]interface{}{"op": "incr", "path": "s"}, want: http.StatusConflict},
+		{op: map[string]interface{}{"op": "incr", "path": "n", "value": "1"}, want: http.StatusBadRequest},
+		{op: map[string]interface{}{"op": "incr", "path": "n", "value": 0}, want: http.StatusOK, wantValue: "-3.5", changed: false},
+	})
+
+	want := `{"big":9223372036854775807,"f":1.7e+308,"n":-3.5,"s":"x","small":-9223372036854775808,"stats":{"views":1}}`
+	if got := ts.documentBody(t, id); got != want {
+		t.Errorf("document = %s, want %s", got, want)
+	}
+}
+
+func TestOpsPush(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	runOps(t, ts, key, `{"log":[1,2,3],"n":1}`, []opStep{
+		{op: map[string]interface{}{"op": "push", "path": "log", "value": 4, "max_length": 3}, want: http.StatusOK, wantValue: "[2,3,4]", changed: true},
+		{op: map[string]interface{}{"op": "push", "path": "log", "value": 0, "from": "start", "max_length": 3}, want: http.StatusOK, wantValue: "[0,2,3]", changed: true},
+		{op: map[string]interface{}{"op": "push", "path": "log", "value": 9}, want: http.StatusOK, wantValue: "[0,2,3,9]", changed: true},
+		{op: map[string]interface{}{"op": "push", "path": "events.recent", "value": "a"}, want: http.StatusOK, wantValue: `["a"]`, changed: true},
+		{op: map[string]interface{}{"op": "push", "path": "log.0", "value": 1}, want: http.StatusConflict},
+		{op: map[string]interface{}{"op": "push", "path": "n", "value": 1}, want: http.StatusConflict},
+		{op: map[string]interface{}{"op": "push", "path": "log"}, want: http.StatusBadRequest},
+		{op: map[string]interface{}{"op": "push", "path": "log", "value": 1, "max_length": 0}, want: http.StatusBadRequest},
+		{op: map[string]interface{}{"op": "push", "path": "log", "value": 1, "from": "middle"}, want: http.StatusBadRequest},
+	})
+}
+
+func TestOpsPop(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	id := runOps(t, ts, key, `{"list":[1,2,3]}`, []opStep{
+		{op: map[string]interface{}{"op": "pop", "path": "list"}, want: http.StatusOK, wantValue: "[1,2]", wantPopped: "3", changed: true},
+		{op: map[string]interface{}{"op": "pop", "path": "list", "from": "start"}, want: http.StatusOK, wantValue: "[2]", wantPopped: "1", changed: true},
+		{op: map[string]interface{}{"op": "pop", "path": "list"}, want: http.StatusOK, wantValue: "[]", wantPopped: "2", changed: true},
+		{op: map[string]interface{}{"op": "pop", "path": "list"}, want: http.StatusConflict},
+		{op: map[string]interface{}{"op": "pop", "path": "missing.list"}, want: http.StatusConflict},
+	})
+
+	// pop does not create the objects along a missing path.
+	if got := ts.documentBody(t, id); got != `{"list":[]}` {
+		t.Errorf("document = %s, want %s", got, `{"list":[]}`)
+	}
+}
+
+func TestOpsSetsAndUnset(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	id := runOps(t, ts, key, `{"tags":["a"],"x":1,"gone":true,"list":[1,2,3]}`, []opStep{
+		{op: map[string]interface{}{"op": "add_to_set", "path": "tags", "value": "a"}, want: http.StatusOK, wantValue: `["a"]`, changed: false},
+		{op: map[string]interface{}{"op": "add_to_set", "path": "tags", "value": "b"}, want: http.StatusOK, wantValue: `["a","b"]`, changed: true},
+		{op: map[string]interface{}{"op": "add_to_set", "path": "members", "value": map[string]interface{}{"id": 1}}, want: http.StatusOK, wantValue: `[{"id":1}]`, changed: true},
+		{op: map[string]interface{}{"op": "add_to_set", "path": "members", "value": map[string]interface{}{"id": 1}}, want: http.StatusOK, wantValue: `[{"id":1}]`, changed: false},
+		{op: map[string]interface{}{"op": "add_to_set", "path": "x", "value": 1}, want: http.StatusConflict},
+		{op: map[string]interface{}{"op": "set_if_absent", "path": "x", "value": 2}, want: http.StatusOK, wantValue: "1", changed: false},
+		{op: map[string]interface{}{"op": "set_if_absent", "path": "y", "value": 2}, want: http.StatusOK, wantValue: "2", changed: true},
+		{op: map[string]interface{}{"op": "set_if_absent", "path": "z"}, want: http.StatusBadRequest},
+		{op: map[string]interface{}{"op": "unset", "path": "gone"}, want: http.StatusOK, changed: true},
+		{op: map[string]interface{}{"op": "unset", "path": "gone"}, want: http.StatusOK, changed: false},
+		{op: map[string]interface{}{"op": "unset", "path": "list.1"}, want: http.StatusOK, changed: true},
+		{op: map[string]interface{}{"op": "unset", "path": "nested.value"}, want: http.StatusOK, changed: false},
+		{op: map[string]interface{}{"op": "rename", "path": "x"}, want: http.StatusBadRequest},
+	})
+
+	want := `{"list":[1,3],"members":[{"id":1}],"tags":["a","b"],"x":1,"y":2}`
+	if got := ts.documentBody(t, id); got != want {
+		t.Errorf("document = %s, want %s", got, want)
+	}
+}
+
+func TestOpsConcurrentIncrements(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "counter", "", map[string]interface{}{"n": 0})
+
+	// Each operation reads and writes the document in one transaction.
+	// Opened with _txlock=immediate, as in production, they queue for the
+	// write lock instead of failing with SQLITE_BUSY or losing updates.
+	const workers, increments = 10, 10
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				if status := ts.do(t, http.MethodPost, "/"+id+"/ops", key, map[string]interface{}{"op": "incr", "path": "n"}, nil); status != http.StatusOK {
+					t.Errorf("incr: status %d", status)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := ts.documentBody(t, id); got != `{"n":100}` {
+		t.Errorf("document = %s, want %s", got, `{"n":100}`)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// getAs fetches path with the Accept header, if not empty, and returns the
+// status, Content-Type and body.
+func (ts *testServer) getAs(t *testing.T, path, accept string) (int, string, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get("Content-Type"), string(body)
+}
+
+func TestYAMLOutput(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "config", "", json.RawMessage(`{
+		"name": "web", "answer": "no", "on": "On", "ratio": 1.50, "big": 123456789012345678901234567890,
+		"list": [1, null, true], "nested": {"empty": {}, "text": "a: b"}
+	}`))
+
+	// Strings a YAML 1.1 reader would take for booleans are quoted, numbers
+	// are written as stored, and an integer too large for YAML readers to
+	// resolve as one keeps its tag.
+	const want = `answer: "no"
+big: !!int 123456789012345678901234567890
+list:
+  - 1
+  - null
+  - true
+name: web
+nested:
+  empty: {}
+  text: 'a: b'
+"on": "On"
+ratio: 1.50
+`
+	for _, accept := range []string{"application/yaml", "text/yaml", "application/x-yaml"} {
+		status, contentType, body := ts.getAs(t, "/"+id, accept)
+		if status != http.StatusOK || contentType != "application/yaml" {
+			t.Fatalf("Accept %s: status %d, Content-Type %q", accept, status, contentType)
+		}
+		if body != want {
+			t.Errorf("Accept %s: YAML =\n%s\nwant\n%s", accept, body, want)
+		}
+	}
+}
+
+func TestCSVOutput(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "orders", "", json.RawMessage(`[
+		{"id": 1, "customer": {"name": "Doe, Jane", "city": "Oslo"}, "tags": ["a", "b"], "paid": true},
+		{"id": 2, "customer": {"name": "Roe"}, "total": 9.5, "paid": null}
+	]`))
+
+	tests := []struct {
+		query, want string
+	}{
+		{"", "customer.city,customer.name,id,paid,tags,total\nOslo,\"Doe, Jane\",1,true,\"[\"\"a\"\",\"\"b\"\"]\",\n,Roe,2,,,9.5\n"},
+		{"&columns=id,customer.name,missing", "id,customer.name,missing\n1,\"Doe, Jane\",\n2,Roe,\n"},
+		{"&flatten=false&columns=id,customer", "id,customer\n1,\"{\"\"city\"\":\"\"Oslo\"\",\"\"name\"\":\"\"Doe, Jane\"\"}\"\n2,\"{\"\"name\"\":\"\"Roe\"\"}\"\n"},
+	}
+	for _, tt := range tests {
+		status, contentType, body := ts.getAs(t, "/"+id+"?format=csv"+tt.query, "")
+		if status != http.StatusOK || contentType != "text/csv; charset=utf-8" {
+			t.Fatalf("%s: status %d, Content-Type %q", tt.query, status, contentType)
+		}
+		if body != tt.want {
+			t.Errorf("%s: CSV =\n%s\nwant\n%s", tt.query, body, tt.want)
+		}
+	}
+}
+
+func TestNDJSONOutput(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "events", "", json.RawMessage(`[{"a": 1}, [2], "x", null]`))
+
+	status, contentType, body := ts.getAs(t, "/"+id, "application/x-ndjson")
+	if status != http.StatusOK || contentType != "application/x-ndjson" {
+		t.Fatalf("status %d, Content-Type %q", status, contentType)
+	}
+	if want := "{\"a\":1}\n[2]\n\"x\"\nnull\n"; body != want {
+		t.Errorf("NDJSON = %q, want %q", body, want)
+	}
+}
+
+func TestOutputNegotiation(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	object := ts.createDocument(t, key, "object", "", map[string]interface{}{"a": 1})
+	list := ts.createDocument(t, key, "list", "", json.RawMessage(`[{"a":1},2]`))
+
+	tests := []struct {
+		path, accept string
+		status       int
+		contentType  string
+	}{
+		{"/" + object, "", http.StatusOK, "application/json"},
+		{"/" + object, "*/*", http.StatusOK, "application/json"},
+		{"/" + object, "text/html, text/*;q=0.5", http.StatusOK, "application/yaml"},
+		{"/" + object, "application/json;q=0, */*", http.StatusOK, "application/yaml"},
+		{"/" + object, "application/yaml;q=0.2, application/cbor;q=0.8", http.StatusOK, "application/cbor"},
+		{"/" + object + "?format=json", "application/yaml", http.StatusOK, "application/json"},
+		{"/" + object, "text/html", http.StatusNotAcceptable, ""},
+		{"/" + object + "?format=xml", "", http.StatusNotAcceptable, ""},
+		{"/" + object + "?format=csv", "", http.StatusNotAcceptable, ""},
+		{"/" + object + "?format=ndjson", "", http.StatusNotAcceptable, ""},
+		{"/" + list + "?format=csv", "", http.StatusNotAcceptable, ""},
+		{"/" + object + "?format=yaml&canonical=true", "", http.StatusNotAcceptable, ""},
+	}
+	for _, tt := range tests {
+		status, contentType, body := ts.getAs(t, tt.path, tt.accept)
+		if status != tt.status || (tt.contentType != "" && contentType != tt.contentType) {
+			t.Errorf("GET %s, Accept %q: status %d, Content-Type %q (%s), want %d %s", tt.path, tt.accept, status, contentType, body, tt.status, tt.contentType)
+		}
+	}
+
+	resp, _ := ts.get(t, "/"+object)
+	if resp.Header.Get("Vary") != "Accept" {
+		t.Errorf("Vary = %q, want Accept", resp.Header.Get("Vary"))
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"pocketjson/storage"
+)
+
+// receive leases messages of a queue and returns them.
+func (ts *testServer) receive(t *testing.T, apiKey, queue string, request map[string]interface{}) []*storage.Message {
+	t.Helper()
+
+	var received struct {
+		Messages []*storage.Message `json:"messages"`
+	}
+	if status := ts.do(t, http.MethodPost, "/queues/"+queue+"/receive", apiKey, request, &received); status != http.StatusOK {
+		t.Fatalf("receive %v: status %d", request, status)
+	}
+	return received.Messages
+}
+
+// queueStats returns the message counts of a queue.
+func (ts *testServer) queueStats(t *testing.T, apiKey, queue string) storage.QueueStats {
+	t.Helper()
+
+	var stats storage.QueueStats
+	if status := ts.do(t, http.MethodGet, "/queues/"+queue, apiKey, nil, &stats); status != http.StatusOK {
+		t.Fatalf("queue %s: status %d", queue, status)
+	}
+	return stats
+}
+
+func TestQueueOrderAndLimits(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.Config().QueueMaxMessages = 3
+	key, _ := ts.createTenantKey(t, nil)
+
+	for i := 1; i <= 3; i++ {
+		if status := ts.do(t, http.MethodPost, "/queues/jobs", key, map[string]interface{}{"n": i}, nil); status != http.StatusCreated {
+			t.Fatalf("send %d: status %d, want 201", i, status)
+		}
+	}
+	if status := ts.do(t, http.MethodPost, "/queues/jobs", key, map[string]interface{}{"n": 4}, nil); status != http.StatusInsufficientStorage {
+		t.Errorf("send to a full queue: status %d, want 507", status)
+	}
+	for _, query := range []string{"delay=-1", "delay=3601", "max_receives=0", "max_receives=1001"} {
+		if status := ts.do(t, http.MethodPost, "/queues/other?"+query, key, map[string]interface{}{}, nil); status != http.StatusBadRequest {
+			t.Errorf("send with %s: status %d, want 400", query, status)
+		}
+	}
+
+	messages := ts.receive(t, key, "jobs", map[string]interface{}{"max_messages": 2})
+	if len(messages) != 2 || string(messages[0].Data) != `{"n":1}` || string(messages[1].Data) != `{"n":2}` {
+		t.Fatalf("received %v, want the first two messages in order", messages)
+	}
+	for _, msg := range messages {
+		if msg.Receipt == "" || msg.ReceiveCount != 1 {
+			t.Errorf("message %d: receipt %q, receive_count %d", msg.ID, msg.Receipt, msg.ReceiveCount)
+		}
+	}
+	// Leased messages stay invisible to other consumers.
+	messages = ts.receive(t, key, "jobs", map[string]interface{}{"max_messages": 10})
+	if len(messages) != 1 || string(messages[0].Data) != `{"n":3}` {
+		t.Errorf("second receive = %v, want only the third message", messages)
+	}
+	if stats := ts.queueStats(t, key, "jobs"); stats.Ready != 0 || stats.InFlight != 3 {
+		t.Errorf("stats = %+v, want 3 in flight", stats)
+	}
+
+	for _, request := range []map[string]interface{}{{"max_messages": 0}, {"max_messages": 101}, {"visibility_timeout": 43201}} {
+		if status := ts.do(t, http.MethodPost, "/queues/jobs/receive", key, request, nil); status != http.StatusBadRequest {
+			t.Errorf("receive %v: status %d, want 400", request, status)
+		}
+	}
+}
+
+func TestQueueDelay(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	if status := ts.do(t, http.MethodPost, "/queues/later?delay=1", key, map[string]interface{}{"n": 1}, nil); status != http.StatusCreated {
+		t.Fatalf("send: status %d", status)
+	}
+	if stats := ts.queueStats(t, key, "later"); stats.Delayed != 1 {
+		t.Errorf("stats = %+v, want 1 delayed", stats)
+	}
+	if messages := ts.receive(t, key, "later", nil); len(messages) != 0 {
+		t.Errorf("received %v before the delay passed", messages)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if messages := ts.receive(t, key, "later", nil); len(messages) != 1 {
+		t.Errorf("received %v after the delay, want the message", messages)
+	}
+}
+
+func TestQueueLeaseExpiry(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	if status := ts.do(t, http.MethodPost, "/queues/jobs", key, map[string]interface{}{"n": 1}, nil); status != http.StatusCreated {
+		t.Fatalf("send: status %d", status)
+	}
+	first := ts.receive(t, key, "jobs", map[string]interface{}{"visibility_timeout": 1})
+	if len(first) != 1 {
+		t.Fatalf("received %v, want one message", first)
+	}
+
+	// A consumer that misses its lease loses the message to the next one.
+	time.Sleep(1100 * time.Millisecond)
+	second := ts.receive(t, key, "jobs", map[string]interface{}{"visibility_timeout": 30})
+	if len(second) != 1 || second[0].ID != first[0].ID || second[0].ReceiveCount != 2 {
+		t.Fatalf("received %v after the lease ran out, want message %d again", second, first[0].ID)
+	}
+	if second[0].Receipt == first[0].Receipt {
+		t.Fatalf("the new lease kept the receipt %q", first[0].Receipt)
+	}
+
+	path := "/queues/jobs/messages/" + strconv.FormatInt(first[0].ID, 10)
+	if status := ts.do(t, http.MethodDelete, path+"?receipt="+first[0].Receipt, key, nil, nil); status != http.StatusNotFound {
+		t.Errorf("ack with the stale receipt: status %d, want 404", status)
+	}
+	if status := ts.do(t, http.MethodDelete, path, key, nil, nil); status != http.StatusNotFound {
+		t.Errorf("ack of a live message without a receipt: status %d, want 404", status)
+	}
+	if status := ts.do(t, http.MethodDelete, path+"?receipt="+second[0].Receipt, key, nil, nil); status != http.StatusNoContent {
+		t.Errorf("ack with the current receipt: status %d, want 204", status)
+	}
+	if status := ts.do(t, http.MethodDelete, path+"?receipt="+second[0].Receipt, key, nil, nil); status != http.StatusNotFound {
+		t.Errorf("second ack: status %d, want 404", status)
+	}
+	if stats := ts.queueStats(t, key, "jobs"); stats != (storage.QueueStats{Queue: "jobs"}) {
+		t.Errorf("stats = %+v, want an empty queue", stats)
+	}
+}
+
+func TestQueueDeadLetters(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	if status := ts.do(t, http.MethodPost, "/queues/jobs?max_receives=2", key, map[string]interface{}{"n": 1}, nil); status != http.StatusCreated {
+		t.Fatalf("send: status %d", status)
+	}
+	for i := 1; i <= 2; i++ {
+		if messages := ts.receive(t, key, "jobs", map[string]interface{}{"visibility_timeout": 1}); len(messages) != 1 {
+			t.Fatalf("receive %d: got %v, want the message", i, messages)
+		}
+		time.Sleep(1100 * time.Millisecond)
+	}
+
+	// The message used up its receives, so it is not handed out again.
+	if messages := ts.receive(t, key, "jobs", nil); len(messages) != 0 {
+		t.Fatalf("received %v after max_receives, want none", messages)
+	}
+	if stats := ts.queueStats(t, key, "jobs"); stats.Dead != 1 || stats.Ready != 0 {
+		t.Errorf("stats = %+v, want 1 dead", stats)
+	}
+	var dead struct {
+		Messages []*storage.Message `json:"messages"`
+	}
+	if status := ts.do(t, http.MethodGet, "/queues/jobs/dead", key, nil, &dead); status != http.StatusOK || len(dead.Messages) != 1 {
+		t.Fatalf("dead letters: status %d, %v", status, dead.Messages)
+	}
+	msg := dead.Messages[0]
+	if msg.Status != storage.MessageDead || msg.ReceiveCount != 2 || string(msg.Data) != `{"n":1}` {
+		t.Errorf("dead letter = %+v", msg)
+	}
+
+	id := strconv.FormatInt(msg.ID, 10)
+	if status := ts.do(t, http.MethodPost, "/queues/jobs/dead/"+id+"/retry", key, nil, nil); status != http.StatusAccepted {
+		t.Fatalf("retry: status %d, want 202", status)
+	}
+	if status := ts.do(t, http.MethodPost, "/queues/jobs/dead/"+id+"/retry", key, nil, nil); status != http.StatusNotFound {
+		t.Errorf("retry of a live message: status %d, want 404", status)
+	}
+	messages := ts.receive(t, key, "jobs", nil)
+	if len(messages) != 1 || messages[0].ID != msg.ID || messages[0].ReceiveCount != 1 {
+		t.Fatalf("received %v after the retry, want the message with a fresh count", messages)
+	}
+
+	// Dead letters are dropped without a receipt.
+	if status := ts.do(t, http.MethodPost, "/queues/poison?max_receives=1", key, map[string]interface{}{"n": 2}, nil); status != http.StatusCreated {
+		t.Fatalf("send: status %d", status)
+	}
+	poison := ts.receive(t, key, "poison", map[string]interface{}{"visibility_timeout": 1})
+	time.Sleep(1100 * time.Millisecond)
+	ts.receive(t, key, "poison", nil)
+	if status := ts.do(t, http.MethodDelete, "/queues/poison/messages/"+strconv.FormatInt(poison[0].ID, 10), key, nil, nil); status != http.StatusNoContent {
+		t.Errorf("drop dead letter: status %d, want 204", status)
+	}
+}
+
+func TestQueuesAreScopedToTenants(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	other, _ := ts.createTenantKey(t, nil)
+	scoped, _ := ts.createTenantKey(t, map[string]interface{}{"id_prefix": "team-"})
+
+	if status := ts.do(t, http.MethodPost, "/queues/jobs", key, map[string]interface{}{"n": 1}, nil); status != http.StatusCreated {
+		t.Fatalf("send: status %d", status)
+	}
+	if messages := ts.receive(t, other, "jobs", nil); len(messages) != 0 {
+		t.Errorf("another tenant received %v", messages)
+	}
+	if status := ts.do(t, http.MethodPost, "/queues/jobs", scoped, map[string]interface{}{"n": 1}, nil); status != http.StatusForbidden {
+		t.Errorf("send outside the ID prefix: status %d, want 403", status)
+	}
+	if status := ts.do(t, http.MethodPost, "/queues/team-jobs", scoped, map[string]interface{}{"n": 1}, nil); status != http.StatusCreated {
+		t.Errorf("send inside the ID prefix: status %d, want 201", status)
+	}
+}
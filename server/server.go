@@ -16,15 +16,17 @@ import (
 )
 
 type Server struct {
-	store  *storage.Store
-	router *chi.Mux
-	server *http.Server
+	store   *storage.Store
+	router  *chi.Mux
+	server  *http.Server
+	streams *handlers.Streams
 }
 
 func New(store *storage.Store) *Server {
 	s := &Server{
-		store:  store,
-		router: chi.NewRouter(),
+		store:   store,
+		router:  chi.NewRouter(),
+		streams: handlers.NewStreams(store.Config()),
 	}
 
 	s.setupMiddleware()
@@ -35,6 +37,8 @@ func New(store *storage.Store) *Server {
 		Addr:    ":" + cfg.Port,
 		Handler: s.router,
 	}
+	// Event streams never go idle, so Shutdown has to end them itself.
+	s.server.RegisterOnShutdown(s.streams.Close)
 
 	return s
 }
@@ -42,33 +46,92 @@ func New(store *storage.Store) *Server {
 func (s *Server) setupMiddleware() {
 	cfg := s.store.Config()
 
-	s.router.Use(middleware.Logger)
+	s.router.Use(custommw.Logger)
 	s.router.Use(middleware.Recoverer)
 
 	s.router.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{cfg.CORSOrigins},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-API-Key"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-API-Key", "X-Edit-Token", "Last-Event-ID", "Content-Digest"},
+		ExposedHeaders:   []string{"Link", "Digest", "Content-Digest"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
 
 	s.router.Use(custommw.RateLimit(s.store))
+	s.router.Use(custommw.ContentDigest(s.store))
 }
 
 func (s *Server) setupRoutes() {
-	adminOnly := handlers.AdminOnly(s.store)
+	readDocuments := handlers.RequireScope(s.store, storage.ScopeDocumentsRead)
+	requireWrite := handlers.RequireScope(s.store, storage.ScopeDocumentsWrite)
+	requireDelete := handlers.RequireScope(s.store, storage.ScopeDocumentsDelete)
+	manageKeys := handlers.RequireScope(s.store, storage.ScopeKeysManage)
+	readStats := handlers.RequireScope(s.store, storage.ScopeStatsRead)
+	audit := func(action string) func(http.HandlerFunc) http.HandlerFunc {
+		return handlers.Audited(s.store, action)
+	}
 
 	s.router.Get("/health", handlers.HealthCheck)
 	s.router.Get("/", handlers.ServeHomePage(s.store))
 
-	s.router.Post("/", handlers.CreateJSON(s.store))
-	s.router.Post("/{id}", handlers.CreateJSON(s.store))
+	s.router.Post("/", audit("document.create")(handlers.CreateJSON(s.store)))
+	s.router.Post("/{id}", audit("document.create")(handlers.CreateJSON(s.store)))
 	s.router.Get("/{id}", handlers.GetJSON(s.store))
-
-	s.router.Post("/admin/keys", adminOnly(handlers.CreateApiKey(s.store)))
-	s.router.Delete("/admin/keys/{key}", adminOnly(handlers.DeleteApiKey(s.store)))
+	s.router.Get("/{id}/events", handlers.WatchJSON(s.store, s.streams))
+	s.router.Put("/{id}", audit("document.update")(requireWrite(handlers.UpdateJSON(s.store))))
+	s.router.Delete("/{id}", audit("document.delete")(requireDelete(handlers.DeleteJSON(s.store))))
+	s.router.Get("/{id}/acl", handlers.ListGrants(s.store))
+	s.router.Put("/{id}/acl/{keyID}", audit("document.grant")(requireWrite(handlers.GrantAccess(s.store))))
+	s.router.Delete("/{id}/acl/{keyID}", audit("document.revoke")(requireWrite(handlers.RevokeAccess(s.store))))
+	s.router.Get("/{id}/items", handlers.ListItems(s.store))
+	s.router.Post("/{id}/items", audit("document.append")(requireWrite(handlers.AppendItem(s.store))))
+	s.router.Post("/{id}/ops", audit("document.op")(requireWrite(handlers.ApplyOperation(s.store))))
+	s.router.Post("/{id}/sign", audit("document.sign")(handlers.SignDocumentURL(s.store)))
+
+	s.router.Post("/batch", audit("document.batch")(handlers.Batch(s.store)))
+	s.router.Get("/changes", readDocuments(handlers.ListChanges(s.store, s.streams)))
+	s.router.Get("/queues", readDocuments(handlers.ListQueues(s.store)))
+	s.router.Get("/queues/{name}", readDocuments(handlers.GetQueue(s.store)))
+	s.router.Post("/queues/{name}", audit("queue.send")(requireWrite(handlers.SendMessage(s.store))))
+	s.router.Post("/queues/{name}/receive", audit("queue.receive")(requireWrite(handlers.ReceiveMessages(s.store))))
+	s.router.Delete("/queues/{name}/messages/{messageID}", audit("queue.ack")(requireWrite(handlers.DeleteMessage(s.store))))
+	s.router.Get("/queues/{name}/dead", readDocuments(handlers.ListDeadMessages(s.store)))
+	s.router.Post("/queues/{name}/dead/{messageID}/retry", audit("queue.retry")(requireWrite(handlers.RetryMessage(s.store))))
+	s.router.Get("/locks/{name}", readDocuments(handlers.GetLock(s.store)))
+	s.router.Post("/locks/{name}", audit("lock.acquire")(requireWrite(handlers.AcquireLock(s.store))))
+	s.router.Post("/locks/{name}/renew", audit("lock.renew")(requireWrite(handlers.RenewLock(s.store))))
+	s.router.Delete("/locks/{name}", audit("lock.release")(requireWrite(handlers.ReleaseLock(s.store))))
+	s.router.Post("/buckets", audit("bucket.create")(requireWrite(handlers.CreateBucket(s.store))))
+	s.router.Get("/buckets", readDocuments(handlers.ListBuckets(s.store)))
+	s.router.Delete("/buckets/{id}", audit("bucket.delete")(requireWrite(handlers.DeleteBucket(s.store))))
+	s.router.Get("/buckets/{id}/requests", readDocuments(handlers.ListCapturedRequests(s.store, s.streams)))
+	s.router.Post("/buckets/{id}/requests/{recordID}/replay", audit("bucket.replay")(requireWrite(handlers.ReplayRequest(s.store))))
+	s.router.HandleFunc("/catch/{id}", handlers.CatchRequest(s.store))
+	s.router.HandleFunc("/catch/{id}/*", handlers.CatchRequest(s.store))
+	s.router.Post("/webhooks", audit("webhook.create")(readDocuments(handlers.CreateWebhook(s.store))))
+	s.router.Get("/webhooks", readDocuments(handlers.ListWebhooks(s.store)))
+	s.router.Delete("/webhooks/{id}", audit("webhook.delete")(readDocuments(handlers.DeleteWebhook(s.store))))
+	s.router.Get("/webhooks/{id}/deliveries", readDocuments(handlers.ListDeliveries(s.store)))
+	s.router.Post("/webhooks/{id}/deliveries/{deliveryID}/retry", audit("webhook.retry")(readDocuments(handlers.RetryDelivery(s.store))))
+
+	s.router.Post("/admin/keys", audit("key.create")(manageKeys(handlers.CreateApiKey(s.store))))
+	s.router.Get("/admin/keys", manageKeys(handlers.ListApiKeys(s.store)))
+	s.router.Get("/admin/keys/{id}", manageKeys(handlers.GetApiKey(s.store)))
+	s.router.Patch("/admin/keys/{id}", audit("key.update")(manageKeys(handlers.PatchApiKey(s.store))))
+	s.router.Delete("/admin/keys/{id}", audit("key.delete")(manageKeys(handlers.DeleteApiKey(s.store))))
+	s.router.Post("/admin/keys/{id}/rotate", audit("key.rotate")(manageKeys(handlers.RotateApiKey(s.store))))
+	s.router.Get("/admin/documents", manageKeys(handlers.ListDocuments(s.store)))
+	s.router.Delete("/admin/documents", audit("admin.documents.delete")(manageKeys(handlers.DeleteDocuments(s.store))))
+	s.router.Get("/admin/documents/orphaned", manageKeys(handlers.ListOrphanedDocuments(s.store)))
+	s.router.Get("/admin/documents/{id}", manageKeys(handlers.InspectDocument(s.store)))
+	s.router.Post("/admin/tenants", audit("tenant.create")(manageKeys(handlers.CreateTenant(s.store))))
+	s.router.Get("/admin/tenants", manageKeys(handlers.ListTenants(s.store)))
+	s.router.Patch("/admin/tenants/{id}", audit("tenant.update")(manageKeys(handlers.UpdateTenant(s.store))))
+	s.router.Get("/admin/signing-secrets", manageKeys(handlers.ListSigningSecrets(s.store)))
+	s.router.Post("/admin/signing-secrets/rotate", audit("signing_secret.rotate")(manageKeys(handlers.RotateSigningSecret(s.store))))
+	s.router.Get("/admin/stats", readStats(handlers.GetStats(s.store)))
+	s.router.Get("/admin/audit", manageKeys(handlers.ListAuditEvents(s.store)))
 }
 
 func (s *Server) Start() error {
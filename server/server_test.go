@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"pocketjson/config"
+	"pocketjson/storage"
+)
+
+const testMasterKey = "test-master-key-0123456789abcdef"
+
+// testServer runs the full server against a fresh database.
+type testServer struct {
+	*httptest.Server
+	server *Server
+	store  *storage.Store
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	dsn := filepath.Join(t.TempDir(), "test.db") + "?_fk=1&_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
+	db, err := storage.NewDB(dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	cfg := config.Load()
+	cfg.MasterAPIKey = testMasterKey
+	cfg.RequestLimit = 1000
+	store := storage.New(db, cfg)
+	server := New(store)
+	// Serve with the server's own http.Server, so that Shutdown behaves as
+	// in production.
+	hts := httptest.NewUnstartedServer(server.router)
+	hts.Config = server.server
+	hts.Start()
+	ts := &testServer{Server: hts, server: server, store: store}
+	t.Cleanup(func() {
+		ts.Close()
+		store.Shutdown()
+		db.Close()
+	})
+	return ts
+}
+
+// do sends body, if any, as JSON with the API key and decodes a JSON
+// response into out, if given.
+func (ts *testServer) do(t *testing.T, method, path, apiKey string, body interface{}, out interface{}) int {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("failed to encode request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+
+	return send(t, req, out)
+}
+
+// send makes the request and decodes a JSON response into out, if given.
+func send(t *testing.T, req *http.Request, out interface{}) int {
+	t.Helper()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", req.Method, req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: invalid response %q: %v", req.Method, req.URL.Path, data, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// createKey creates an API key with the given creator and returns its
+// secret and ID.
+func (ts *testServer) createKey(t *testing.T, apiKey string, request map[string]interface{}) (string, string) {
+	t.Helper()
+
+	var created struct {
+		Key      string `json:"key"`
+		ClientID string `json:"client_id"`
+	}
+	if status := ts.do(t, http.MethodPost, "/admin/keys", apiKey, request, &created); status != http.StatusOK {
+		t.Fatalf("creating key %v: status %d", request, status)
+	}
+	return created.Key, created.ClientID
+}
+
+// createTenantKey creates a tenant and a non-admin key in it with the given
+// extra properties.
+func (ts *testServer) createTenantKey(t *testing.T, request map[string]interface{}) (string, string) {
+	t.Helper()
+
+	var tenant struct {
+		ID string `json:"id"`
+	}
+	if status := ts.do(t, http.MethodPost, "/admin/tenants", testMasterKey, map[string]interface{}{"description": "test"}, &tenant); status != http.StatusOK {
+		t.Fatalf("creating tenant: status %d", status)
+	}
+	if request == nil {
+		request = map[string]interface{}{}
+	}
+	request["tenant_id"] = tenant.ID
+	return ts.createKey(t, testMasterKey, request)
+}
+
+// createDocument stores data under a custom ID and returns the full
+// document ID. query is appended to the URL as it is.
+func (ts *testServer) createDocument(t *testing.T, apiKey, customID, query string, data interface{}) string {
+	t.Helper()
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	path := "/" + customID
+	if query != "" {
+		path += "?" + query
+	}
+	if status := ts.do(t, http.MethodPost, path, apiKey, data, &created); status != http.StatusOK && status != http.StatusCreated {
+		t.Fatalf("creating document %s: status %d", customID, status)
+	}
+	return created.ID
+}
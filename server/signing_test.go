@@ -0,0 +1,160 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signURL signs a URL for the document and returns it.
+func (ts *testServer) signURL(t *testing.T, apiKey, id string, request map[string]interface{}) string {
+	t.Helper()
+
+	var signed struct {
+		URL string `json:"url"`
+	}
+	if status := ts.do(t, http.MethodPost, "/"+id+"/sign", apiKey, request, &signed); status != http.StatusOK {
+		t.Fatalf("sign %v: status %d", request, status)
+	}
+	return signed.URL
+}
+
+// fetch sends a request without credentials to an absolute URL.
+func fetch(t *testing.T, method, rawURL, body string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, rawURL, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return send(t, req, nil)
+}
+
+func TestSignedURL(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "private", "visibility=private", map[string]interface{}{"a": 1})
+	other := ts.createDocument(t, key, "other", "visibility=private", map[string]interface{}{"a": 1})
+
+	if status := fetch(t, http.MethodGet, ts.URL+"/"+id, ""); status != http.StatusNotFound {
+		t.Fatalf("unsigned GET: status %d, want 404", status)
+	}
+
+	signed := ts.signURL(t, key, id, map[string]interface{}{"method": "GET"})
+	if status := fetch(t, http.MethodGet, signed, ""); status != http.StatusOK {
+		t.Errorf("signed GET: status %d, want 200", status)
+	}
+	if status := fetch(t, http.MethodPut, signed, `{"a":2}`); status == http.StatusOK {
+		t.Errorf("signed GET used for PUT: status %d, want it refused", status)
+	}
+
+	u, _ := url.Parse(signed)
+	query := u.Query()
+	query.Set("exp", "4102444800")
+	u.RawQuery = query.Encode()
+	if status := fetch(t, http.MethodGet, u.String(), ""); status != http.StatusForbidden {
+		t.Errorf("GET with altered exp: status %d, want 403", status)
+	}
+	u.Path = "/" + other
+	u.RawQuery = strings.SplitN(signed, "?", 2)[1]
+	if status := fetch(t, http.MethodGet, u.String(), ""); status != http.StatusForbidden {
+		t.Errorf("GET of another document: status %d, want 403", status)
+	}
+}
+
+func TestSignedURLIsBoundToItsPath(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "signups", "kind=collection&visibility=private", map[string]interface{}{"name": "signups"})
+	if status := ts.do(t, http.MethodPost, "/"+id+"/items", key, map[string]interface{}{"email": "a@example.com"}, nil); status != http.StatusOK && status != http.StatusCreated {
+		t.Fatalf("append: status %d", status)
+	}
+
+	signed := ts.signURL(t, key, id, map[string]interface{}{"method": "GET"})
+	if status := fetch(t, http.MethodGet, signed, ""); status != http.StatusOK {
+		t.Fatalf("signed GET: status %d, want 200", status)
+	}
+	// The same signature on another route of the document grants nothing.
+	swapped := strings.Replace(signed, "/"+id+"?", "/"+id+"/items?", 1)
+	if status := fetch(t, http.MethodGet, swapped, ""); status != http.StatusForbidden {
+		t.Errorf("signed GET of the items: status %d, want 403", status)
+	}
+}
+
+func TestSignedURLExpires(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "private", "visibility=private", map[string]interface{}{"a": 1})
+
+	signed := ts.signURL(t, key, id, map[string]interface{}{"method": "GET", "expires_in": 1})
+	if status := fetch(t, http.MethodGet, signed, ""); status != http.StatusOK {
+		t.Fatalf("fresh URL: status %d, want 200", status)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if status := fetch(t, http.MethodGet, signed, ""); status != http.StatusForbidden {
+		t.Errorf("expired URL: status %d, want 403", status)
+	}
+}
+
+func TestSignedURLMaxUses(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "private", "visibility=private", map[string]interface{}{"a": 1})
+
+	signed := ts.signURL(t, key, id, map[string]interface{}{"method": "GET", "max_uses": 2})
+	for i := 0; i < 2; i++ {
+		if status := fetch(t, http.MethodGet, signed, ""); status != http.StatusOK {
+			t.Fatalf("use %d: status %d, want 200", i+1, status)
+		}
+	}
+	if status := fetch(t, http.MethodGet, signed, ""); status != http.StatusForbidden {
+		t.Errorf("third use: status %d, want 403", status)
+	}
+}
+
+func TestSigningSecretRotationRevokesURLs(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "private", "visibility=private", map[string]interface{}{"a": 1})
+
+	before := ts.signURL(t, key, id, map[string]interface{}{"method": "GET"})
+	if status := ts.do(t, http.MethodPost, "/admin/signing-secrets/rotate", testMasterKey, nil, nil); status != http.StatusOK {
+		t.Fatalf("rotate: status %d", status)
+	}
+	if status := fetch(t, http.MethodGet, before, ""); status != http.StatusForbidden {
+		t.Errorf("URL signed before rotation: status %d, want 403", status)
+	}
+	after := ts.signURL(t, key, id, map[string]interface{}{"method": "GET"})
+	if status := fetch(t, http.MethodGet, after, ""); status != http.StatusOK {
+		t.Errorf("URL signed after rotation: status %d, want 200", status)
+	}
+}
+
+func TestSignedPutCannotChangeExpiry(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+	id := ts.createDocument(t, key, "doc", "expiry=1", map[string]interface{}{"a": 1})
+
+	signed := ts.signURL(t, key, id, map[string]interface{}{"method": "PUT"})
+	if status := fetch(t, http.MethodPut, signed+"&expiry=never", `{"a":2}`); status != http.StatusForbidden {
+		t.Errorf("signed PUT with expiry: status %d, want 403", status)
+	}
+	if status := fetch(t, http.MethodPut, signed, `{"a":3}`); status != http.StatusOK {
+		t.Errorf("signed PUT: status %d, want 200", status)
+	}
+
+	var inspected struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if status := ts.do(t, http.MethodGet, "/admin/documents/"+id, testMasterKey, nil, &inspected); status != http.StatusOK {
+		t.Fatalf("inspect: status %d", status)
+	}
+	if inspected.ExpiresAt.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expires_at = %v, want the original expiry", inspected.ExpiresAt)
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTenantSlugRenameKeepsDocumentsAndReservesSlug(t *testing.T) {
+	ts := newTestServer(t)
+
+	var tenant struct {
+		ID string `json:"id"`
+	}
+	if status := ts.do(t, http.MethodPost, "/admin/tenants", testMasterKey, map[string]interface{}{"slug": "alpha"}, &tenant); status != http.StatusOK {
+		t.Fatalf("create tenant: status %d", status)
+	}
+	key, _ := ts.createKey(t, testMasterKey, map[string]interface{}{"tenant_id": tenant.ID})
+	id := ts.createDocument(t, key, "doc", "", map[string]interface{}{"a": 1})
+	if id != "alpha_doc" {
+		t.Fatalf("document id = %q, want alpha_doc", id)
+	}
+
+	rename := func(tenantID, slug string) int {
+		return ts.do(t, http.MethodPatch, "/admin/tenants/"+tenantID, testMasterKey, map[string]interface{}{"slug": slug}, nil)
+	}
+	if status := rename(tenant.ID, "beta"); status != http.StatusOK {
+		t.Fatalf("rename to beta: status %d", status)
+	}
+	if status := rename(tenant.ID, "gamma"); status != http.StatusOK {
+		t.Fatalf("rename to gamma: status %d", status)
+	}
+
+	for _, path := range []string{"/alpha_doc", "/beta_doc", "/gamma_doc", "/" + tenant.ID + "_doc"} {
+		if status := ts.do(t, http.MethodGet, path, key, nil, nil); status != http.StatusOK {
+			t.Errorf("GET %s: status %d, want 200", path, status)
+		}
+	}
+
+	// The old slugs cannot be taken over by another tenant.
+	if status := ts.do(t, http.MethodPost, "/admin/tenants", testMasterKey, map[string]interface{}{"slug": "alpha"}, nil); status != http.StatusConflict {
+		t.Errorf("create tenant with a retired slug: status %d, want 409", status)
+	}
+	var other struct {
+		ID string `json:"id"`
+	}
+	if status := ts.do(t, http.MethodPost, "/admin/tenants", testMasterKey, map[string]interface{}{}, &other); status != http.StatusOK {
+		t.Fatalf("create tenant: status %d", status)
+	}
+	if status := rename(other.ID, "beta"); status != http.StatusConflict {
+		t.Errorf("rename to a retired slug: status %d, want 409", status)
+	}
+
+	// The tenant that gave a slug up can take it back.
+	if status := rename(tenant.ID, "alpha"); status != http.StatusOK {
+		t.Errorf("rename back to alpha: status %d, want 200", status)
+	}
+}
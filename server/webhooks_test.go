@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCreateWebhookRefusesNonPublicAddresses(t *testing.T) {
+	ts := newTestServer(t)
+	key, _ := ts.createTenantKey(t, nil)
+
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{"http://127.0.0.1:8080/hook", http.StatusBadRequest},
+		{"http://169.254.169.254/latest/meta-data/", http.StatusBadRequest},
+		{"http://[::1]/hook", http.StatusBadRequest},
+		{"http://10.0.0.5/hook", http.StatusBadRequest},
+		{"https://hooks.example.com/hook", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if status := ts.do(t, http.MethodPost, "/webhooks", key, map[string]interface{}{"url": tt.url}, nil); status != tt.want {
+			t.Errorf("create webhook for %s: status %d, want %d", tt.url, status, tt.want)
+		}
+	}
+}
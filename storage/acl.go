@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Access is the level of access a grant gives to a document.
+type Access string
+
+const (
+	AccessRead      Access = "read"
+	AccessReadWrite Access = "read-write"
+)
+
+// ParseAccess validates an access level name.
+func ParseAccess(name string) (Access, error) {
+	switch a := Access(name); a {
+	case AccessRead, AccessReadWrite:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown access %q", name)
+}
+
+// Grant gives a key other than the owner access to a document.
+type Grant struct {
+	DocumentID string    `json:"document_id"`
+	KeyID      string    `json:"key_id"`
+	Access     Access    `json:"access"`
+	GrantedBy  string    `json:"granted_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// GrantAccess adds a grant, or changes the access of an existing one.
+func (db *DB) GrantAccess(ctx context.Context, grant *Grant) error {
+	query := `
+	INSERT INTO document_acl (document_id, key_id, access, granted_by, created_at) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (document_id, key_id) DO UPDATE SET access = excluded.access, granted_by = excluded.granted_by`
+	_, err := db.conn.ExecContext(ctx, query, grant.DocumentID, grant.KeyID, grant.Access, grant.GrantedBy, grant.CreatedAt)
+	return err
+}
+
+func (db *DB) RevokeAccess(ctx context.Context, documentID, keyID string) error {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM document_acl WHERE document_id = ? AND key_id = ?`, documentID, keyID)
+	if err != nil {
+		return err
+	}
+	return expectRow(result, "grant not found")
+}
+
+// ListGrants returns the grants of a document, oldest first.
+func (db *DB) ListGrants(ctx context.Context, documentID string) ([]*Grant, error) {
+	query := `SELECT document_id, key_id, access, granted_by, created_at FROM document_acl WHERE document_id = ? ORDER BY created_at`
+	rows, err := db.conn.QueryContext(ctx, query, documentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []*Grant{}
+	for rows.Next() {
+		var g Grant
+		if err := rows.Scan(&g.DocumentID, &g.KeyID, &g.Access, &g.GrantedBy, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		grants = append(grants, &g)
+	}
+	return grants, rows.Err()
+}
+
+// GetAccess returns the access a key was granted to a document, or "" if it
+// has no grant.
+func (db *DB) GetAccess(ctx context.Context, documentID, keyID string) (Access, error) {
+	var access Access
+	query := `SELECT access FROM document_acl WHERE document_id = ? AND key_id = ?`
+	err := db.conn.QueryRowContext(ctx, query, documentID, keyID).Scan(&access)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return access, err
+}
@@ -0,0 +1,384 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ApiKey is a row of the api_keys table. Key holds the secret and is only
+// returned to the client once, on creation or rotation.
+type ApiKey struct {
+	Key                  string
+	ClientID             string
+	Description          string
+	IsAdmin              bool
+	Scopes               []Scope
+	IDPrefix             string
+	TenantID             string
+	Namespace            string
+	CreatedAt            time.Time
+	ExpiresAt            *time.Time
+	LastUsedAt           *time.Time
+	RequestCount         int64
+	PreviousKeyExpiresAt *time.Time
+}
+
+// ValidUntil returns how long secret, which must have been used to look the
+// key up, stays valid. The zero time means forever.
+func (k *ApiKey) ValidUntil(secret string) time.Time {
+	var until time.Time
+	if k.ExpiresAt != nil {
+		until = *k.ExpiresAt
+	}
+	if secret != k.Key && k.PreviousKeyExpiresAt != nil {
+		if until.IsZero() || k.PreviousKeyExpiresAt.Before(until) {
+			until = *k.PreviousKeyExpiresAt
+		}
+	}
+	return until
+}
+
+// CreateApiKey stores a new key. Keys without a tenant get a new tenant of
+// their own, with the key ID as tenant ID.
+func (db *DB) CreateApiKey(ctx context.Context, key *ApiKey) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if key.TenantID == "" {
+		key.TenantID = key.ClientID
+		query := `INSERT INTO tenants (id, created_at) VALUES (?, ?)`
+		if _, err := tx.ExecContext(ctx, query, key.TenantID, key.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	query := `INSERT INTO api_keys (key, client_id, description, is_admin, scopes, id_prefix, created_at, expires_at, tenant_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	var scopes sql.NullString
+	if key.Scopes != nil {
+		scopes = sql.NullString{String: encodeScopes(key.Scopes), Valid: true}
+	}
+	_, err = tx.ExecContext(ctx, query, key.Key, key.ClientID, key.Description, key.IsAdmin, scopes, key.IDPrefix, key.CreatedAt, key.ExpiresAt, key.TenantID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const apiKeyColumns = `k.key, k.client_id, COALESCE(k.description, ''), k.is_admin, k.scopes, k.id_prefix, k.created_at,
+	k.expires_at, k.last_used_at, k.request_count, k.previous_key_expires_at,
+	COALESCE(k.tenant_id, ''), COALESCE(t.slug, k.tenant_id, '')`
+
+const apiKeyTables = `api_keys k LEFT JOIN tenants t ON t.id = k.tenant_id`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanApiKey(row scanner) (*ApiKey, error) {
+	var (
+		key         ApiKey
+		scopes      sql.NullString
+		expiresAt   sql.NullTime
+		lastUsedAt  sql.NullTime
+		previousExp sql.NullTime
+	)
+	err := row.Scan(&key.Key, &key.ClientID, &key.Description, &key.IsAdmin, &scopes, &key.IDPrefix, &key.CreatedAt,
+		&expiresAt, &lastUsedAt, &key.RequestCount, &previousExp,
+		&key.TenantID, &key.Namespace)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("api key not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if scopes.Valid {
+		key.Scopes = decodeScopes(scopes.String)
+		if key.Scopes == nil {
+			key.Scopes = []Scope{}
+		}
+	}
+	key.ExpiresAt = nullTimePtr(expiresAt)
+	key.LastUsedAt = nullTimePtr(lastUsedAt)
+	key.PreviousKeyExpiresAt = nullTimePtr(previousExp)
+	return &key, nil
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// GetApiKey looks a key up by its secret. Secrets replaced by a rotation
+// keep matching until their grace period ends. Expired keys are not found.
+func (db *DB) GetApiKey(ctx context.Context, secret string) (*ApiKey, error) {
+	now := time.Now()
+	query := `SELECT ` + apiKeyColumns + ` FROM ` + apiKeyTables + `
+	WHERE (k.key = ? OR (k.previous_key = ? AND k.previous_key_expires_at > ?))
+	AND (k.expires_at IS NULL OR k.expires_at > ?)`
+	return scanApiKey(db.conn.QueryRowContext(ctx, query, secret, secret, now, now))
+}
+
+// GetApiKeyByID looks a key up by its public ID.
+func (db *DB) GetApiKeyByID(ctx context.Context, clientID string) (*ApiKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM ` + apiKeyTables + ` WHERE k.client_id = ?`
+	return scanApiKey(db.conn.QueryRowContext(ctx, query, clientID))
+}
+
+// RotateApiKey replaces the secret of a key. The old secret keeps working
+// until graceUntil; a zero graceUntil revokes it immediately. Only one old
+// secret is kept, so while the previous one is still in its grace period a
+// rotation with a grace period fails with a "grace period" error instead of
+// cutting it short. A zero graceUntil still goes through and revokes both.
+func (db *DB) RotateApiKey(ctx context.Context, clientID, newSecret string, graceUntil time.Time) error {
+	return db.withTx(ctx, func(tx *sql.Tx) error {
+		var previousUntil sql.NullTime
+		query := `SELECT previous_key_expires_at FROM api_keys WHERE client_id = ?`
+		err := tx.QueryRowContext(ctx, query, clientID).Scan(&previousUntil)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("api key not found")
+		}
+		if err != nil {
+			return err
+		}
+		if !graceUntil.IsZero() && previousUntil.Valid && previousUntil.Time.After(time.Now()) {
+			return fmt.Errorf("previous secret is in its grace period until %s", previousUntil.Time.UTC().Format(time.RFC3339))
+		}
+
+		var previousExp interface{}
+		if !graceUntil.IsZero() {
+			previousExp = graceUntil
+		}
+		query = `UPDATE api_keys
+		SET previous_key = CASE WHEN ? IS NULL THEN NULL ELSE key END,
+			previous_key_expires_at = ?,
+			key = ?
+		WHERE client_id = ?`
+		_, err = tx.ExecContext(ctx, query, previousExp, previousExp, newSecret, clientID)
+		return err
+	})
+}
+
+// RecordApiKeyUsage adds to the request counter of a key and moves its last
+// used timestamp forward.
+func (db *DB) RecordApiKeyUsage(ctx context.Context, clientID string, requests int64, lastUsed time.Time) error {
+	query := `UPDATE api_keys
+	SET request_count = request_count + ?,
+		last_used_at = CASE WHEN last_used_at IS NULL OR last_used_at < ? THEN ? ELSE last_used_at END
+	WHERE client_id = ?`
+	_, err := db.conn.ExecContext(ctx, query, requests, lastUsed, lastUsed, clientID)
+	return err
+}
+
+// ClearExpiredPreviousKeys forgets secrets whose rotation grace period is over.
+func (db *DB) ClearExpiredPreviousKeys(ctx context.Context) (int64, error) {
+	query := `UPDATE api_keys SET previous_key = NULL, previous_key_expires_at = NULL WHERE previous_key_expires_at < ?`
+	result, err := db.conn.ExecContext(ctx, query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DocumentAction decides what happens to a key's documents when the key is
+// deleted.
+type DocumentAction string
+
+const (
+	// DocumentsKeep leaves the documents in place, orphaned.
+	DocumentsKeep DocumentAction = "keep"
+	// DocumentsDelete deletes the documents along with the key.
+	DocumentsDelete DocumentAction = "delete"
+	// DocumentsTransfer hands the documents over to another key.
+	DocumentsTransfer DocumentAction = "transfer"
+)
+
+// DeleteApiKey removes the key with the given public ID and applies action to
+// the documents it created, in one transaction. transferTo names the key that
+// receives the documents for DocumentsTransfer. It returns the number of
+// documents deleted, transferred or left behind.
+func (db *DB) DeleteApiKey(ctx context.Context, clientID string, action DocumentAction, transferTo string) (int64, error) {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM api_keys WHERE client_id = ?`, clientID)
+	if err != nil {
+		return 0, err
+	}
+	if err := expectRow(result, "api key not found"); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM document_acl WHERE key_id = ?`, clientID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM webhooks WHERE key_id = ?`, clientID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM buckets WHERE key_id = ?`, clientID); err != nil {
+		return 0, err
+	}
+
+	var affected int64
+	switch action {
+	case DocumentsDelete:
+		if err := recordDocumentEvent(ctx, tx, EventDocumentDeleted, "creator_key = ?", clientID); err != nil {
+			return 0, err
+		}
+		result, err = tx.ExecContext(ctx, `DELETE FROM json_storage WHERE creator_key = ?`, clientID)
+	case DocumentsTransfer:
+		var tenantID string
+		err = tx.QueryRowContext(ctx, `SELECT COALESCE(tenant_id, '') FROM api_keys WHERE client_id = ?`, transferTo).Scan(&tenantID)
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("transfer target api key not found")
+		}
+		if err != nil {
+			return 0, err
+		}
+		query := `UPDATE json_storage SET creator_key = ?, tenant_id = ? WHERE creator_key = ?`
+		result, err = tx.ExecContext(ctx, query, transferTo, nullString(tenantID), clientID)
+	case DocumentsKeep:
+		result = nil
+		err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM json_storage WHERE creator_key = ?`, clientID).Scan(&affected)
+	default:
+		return 0, fmt.Errorf("unknown document action %q", action)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if result != nil {
+		if affected, err = result.RowsAffected(); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if action == DocumentsDelete {
+		db.notifyChanged()
+	}
+	return affected, nil
+}
+
+// ApiKeyFilter narrows down ListApiKeys. Zero values match everything.
+type ApiKeyFilter struct {
+	Description string
+	IsAdmin     *bool
+	TenantID    string
+}
+
+// ListApiKeys returns one page of keys ordered by creation time, along with
+// the total number of keys matching the filter.
+func (db *DB) ListApiKeys(ctx context.Context, filter ApiKeyFilter, limit, offset int) ([]*ApiKey, int, error) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if filter.Description != "" {
+		where = append(where, "k.description LIKE ? ESCAPE '\\'")
+		args = append(args, "%"+escapeLike(filter.Description)+"%")
+	}
+	if filter.IsAdmin != nil {
+		where = append(where, "k.is_admin = ?")
+		args = append(args, *filter.IsAdmin)
+	}
+	if filter.TenantID != "" {
+		where = append(where, "k.tenant_id = ?")
+		args = append(args, filter.TenantID)
+	}
+	cond := strings.Join(where, " AND ")
+
+	var total int
+	countQuery := `SELECT COUNT(*) FROM ` + apiKeyTables + ` WHERE ` + cond
+	if err := db.conn.QueryRowContext(ctx, countQuery, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `SELECT ` + apiKeyColumns + ` FROM ` + apiKeyTables + ` WHERE ` + cond + `
+	ORDER BY k.created_at, k.client_id LIMIT ? OFFSET ?`
+	rows, err := db.conn.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	keys := []*ApiKey{}
+	for rows.Next() {
+		key, err := scanApiKey(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, total, rows.Err()
+}
+
+// ApiKeyUpdate lists the fields PatchApiKey should change. Nil fields are
+// left untouched; ClearExpiresAt removes the expiry.
+type ApiKeyUpdate struct {
+	Description    *string
+	IsAdmin        *bool
+	Scopes         *[]Scope
+	IDPrefix       *string
+	ExpiresAt      *time.Time
+	ClearExpiresAt bool
+}
+
+func (db *DB) PatchApiKey(ctx context.Context, clientID string, update ApiKeyUpdate) error {
+	var (
+		set  []string
+		args []interface{}
+	)
+	if update.Description != nil {
+		set = append(set, "description = ?")
+		args = append(args, *update.Description)
+	}
+	if update.IsAdmin != nil {
+		set = append(set, "is_admin = ?")
+		args = append(args, *update.IsAdmin)
+	}
+	if update.Scopes != nil {
+		set = append(set, "scopes = ?")
+		args = append(args, encodeScopes(*update.Scopes))
+	}
+	if update.IDPrefix != nil {
+		set = append(set, "id_prefix = ?")
+		args = append(args, *update.IDPrefix)
+	}
+	if update.ExpiresAt != nil || update.ClearExpiresAt {
+		set = append(set, "expires_at = ?")
+		args = append(args, update.ExpiresAt)
+	}
+	if len(set) == 0 {
+		_, err := db.GetApiKeyByID(ctx, clientID)
+		return err
+	}
+
+	query := `UPDATE api_keys SET ` + strings.Join(set, ", ") + ` WHERE client_id = ?`
+	result, err := db.conn.ExecContext(ctx, query, append(args, clientID)...)
+	if err != nil {
+		return err
+	}
+	return expectRow(result, "api key not found")
+}
+
+// GetApiKeyStorage returns how many live documents a key created and how many
+// bytes they take up.
+func (db *DB) GetApiKeyStorage(ctx context.Context, clientID string) (documents, bytes int64, err error) {
+	query := `SELECT COUNT(*), COALESCE(SUM(LENGTH(data)), 0) FROM json_storage WHERE creator_key = ? AND expires_at > ?`
+	err = db.conn.QueryRowContext(ctx, query, clientID, time.Now()).Scan(&documents, &bytes)
+	return documents, bytes, err
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Audit outcomes.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditEvent is an entry of the append-only audit log.
+type AuditEvent struct {
+	ID        int64     `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	ActorKey  string    `json:"actor_key"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	ClientIP  string    `json:"client_ip"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Status    int       `json:"status"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// AuditFilter narrows down audit log queries. Zero values match everything.
+type AuditFilter struct {
+	ActorKey string
+	TenantID string
+	Action   string
+	Target   string
+	Outcome  string
+	Since    *time.Time
+	Until    *time.Time
+}
+
+func (f AuditFilter) where() (string, []interface{}) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		where = append(where, cond)
+		args = append(args, arg)
+	}
+
+	if f.ActorKey != "" {
+		add("actor_key = ?", f.ActorKey)
+	}
+	if f.TenantID != "" {
+		add("tenant_id = ?", f.TenantID)
+	}
+	if f.Action != "" {
+		// "key" matches key.create, key.delete and so on.
+		where = append(where, "(action = ? OR action LIKE ? ESCAPE '\\')")
+		args = append(args, f.Action, escapeLike(f.Action)+".%")
+	}
+	if f.Target != "" {
+		add("target = ?", f.Target)
+	}
+	if f.Outcome != "" {
+		add("outcome = ?", f.Outcome)
+	}
+	if f.Since != nil {
+		add("timestamp >= ?", *f.Since)
+	}
+	if f.Until != nil {
+		add("timestamp < ?", *f.Until)
+	}
+	return strings.Join(where, " AND "), args
+}
+
+func (db *DB) RecordAuditEvent(ctx context.Context, ev *AuditEvent) error {
+	query := `INSERT INTO audit_log (timestamp, actor_key, tenant_id, client_ip, action, target, outcome, status, detail)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.conn.ExecContext(ctx, query, ev.Timestamp, ev.ActorKey, nullString(ev.TenantID), ev.ClientIP,
+		ev.Action, ev.Target, ev.Outcome, ev.Status, ev.Detail)
+	return err
+}
+
+// ListAuditEvents returns events matching the filter in insertion order,
+// starting after the event with ID after. A limit of 0 returns all of them,
+// calling fn for each event instead of collecting them in memory.
+func (db *DB) ListAuditEvents(ctx context.Context, filter AuditFilter, after int64, limit int, fn func(*AuditEvent) error) error {
+	cond, args := filter.where()
+	query := `SELECT id, timestamp, actor_key, COALESCE(tenant_id, ''), client_ip, action, target, outcome, status, detail
+	FROM audit_log WHERE ` + cond + ` AND id > ? ORDER BY id`
+	args = append(args, after)
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ev AuditEvent
+		if err := rows.Scan(&ev.ID, &ev.Timestamp, &ev.ActorKey, &ev.TenantID, &ev.ClientIP, &ev.Action,
+			&ev.Target, &ev.Outcome, &ev.Status, &ev.Detail); err != nil {
+			return err
+		}
+		if err := fn(&ev); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// DeleteAuditEventsBefore enforces the audit retention period. It is the
+// only way rows ever leave the audit log.
+func (db *DB) DeleteAuditEventsBefore(ctx context.Context, before time.Time) (int64, error) {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM audit_log WHERE timestamp < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
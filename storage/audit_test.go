@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	for _, ev := range []*AuditEvent{
+		{Timestamp: now.Add(-100 * 24 * time.Hour), ActorKey: "k1", TenantID: "t1", Action: "key.create", Target: "k2", Outcome: AuditSuccess, Status: 201},
+		{Timestamp: now.Add(-time.Hour), ActorKey: "k1", TenantID: "t1", Action: "key.delete", Target: "k2", Outcome: AuditFailure, Status: 404},
+		{Timestamp: now.Add(-time.Minute), ActorKey: "k3", TenantID: "t2", Action: "keyring.update", Outcome: AuditSuccess, Status: 200},
+		{Timestamp: now, ActorKey: "guest", Action: "document.create", Target: "t1_doc", Outcome: AuditSuccess, Status: 200},
+	} {
+		if err := s.db.RecordAuditEvent(ctx, ev); err != nil {
+			t.Fatalf("RecordAuditEvent: %v", err)
+		}
+	}
+
+	list := func(filter AuditFilter, after int64, limit int) []int64 {
+		t.Helper()
+		var ids []int64
+		err := s.db.ListAuditEvents(ctx, filter, after, limit, func(ev *AuditEvent) error {
+			ids = append(ids, ev.ID)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("ListAuditEvents: %v", err)
+		}
+		return ids
+	}
+	since, until := now.Add(-2*time.Hour), now
+	tests := []struct {
+		name   string
+		filter AuditFilter
+		after  int64
+		limit  int
+		want   []int64
+	}{
+		{"all", AuditFilter{}, 0, 0, []int64{1, 2, 3, 4}},
+		{"page", AuditFilter{}, 1, 2, []int64{2, 3}},
+		// A prefix matches whole segments only: "key" is not "keyring".
+		{"action prefix", AuditFilter{Action: "key"}, 0, 0, []int64{1, 2}},
+		{"exact action", AuditFilter{Action: "key.delete"}, 0, 0, []int64{2}},
+		{"wildcards are literal", AuditFilter{Action: "k%"}, 0, 0, nil},
+		{"tenant", AuditFilter{TenantID: "t1"}, 0, 0, []int64{1, 2}},
+		{"actor and outcome", AuditFilter{ActorKey: "k1", Outcome: AuditFailure}, 0, 0, []int64{2}},
+		{"target", AuditFilter{Target: "t1_doc"}, 0, 0, []int64{4}},
+		{"since and until", AuditFilter{Since: &since, Until: &until}, 0, 0, []int64{2, 3}},
+	}
+	for _, tt := range tests {
+		if got := list(tt.filter, tt.after, tt.limit); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: events %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Retention removes only the events older than the cutoff.
+	pruned, err := s.db.DeleteAuditEventsBefore(ctx, now.Add(-90*24*time.Hour))
+	if err != nil {
+		t.Fatalf("DeleteAuditEventsBefore: %v", err)
+	}
+	if got := list(AuditFilter{}, 0, 0); pruned != 1 || !slices.Equal(got, []int64{2, 3, 4}) {
+		t.Errorf("after pruning %d: events %v, want 2, 3 and 4", pruned, got)
+	}
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Bucket is a catcher for arbitrary HTTP requests. Everything sent to its
+// URL is recorded, whatever the method or content type.
+type Bucket struct {
+	ID        string
+	KeyID     string
+	TenantID  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// CapturedRequest is a request recorded by a bucket. Bodies that are valid
+// UTF-8 are kept as text, anything else base64-encoded.
+type CapturedRequest struct {
+	ID           int64               `json:"id"`
+	Method       string              `json:"method"`
+	Path         string              `json:"path"`
+	Query        map[string][]string `json:"query"`
+	Headers      map[string][]string `json:"headers"`
+	Body         string              `json:"body"`
+	BodyEncoding string              `json:"body_encoding"`
+	BodySize     int                 `json:"body_size"`
+	Truncated    bool                `json:"truncated"`
+	RemoteAddr   string              `json:"remote_addr"`
+	ReceivedAt   time.Time           `json:"received_at"`
+}
+
+// Body encodings of captured requests.
+const (
+	BodyText   = "text"
+	BodyBase64 = "base64"
+)
+
+func (db *DB) CreateBucket(ctx context.Context, bucket *Bucket) error {
+	query := `INSERT INTO buckets (id, key_id, tenant_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`
+	_, err := db.conn.ExecContext(ctx, query, bucket.ID, bucket.KeyID, nullString(bucket.TenantID), bucket.CreatedAt, bucket.ExpiresAt)
+	return err
+}
+
+// GetBucket returns a bucket that has not expired.
+func (db *DB) GetBucket(ctx context.Context, id string) (*Bucket, error) {
+	query := `SELECT id, key_id, COALESCE(tenant_id, ''), created_at, expires_at FROM buckets WHERE id = ? AND expires_at > ?`
+	var bucket Bucket
+	err := db.conn.QueryRowContext(ctx, query, id, time.Now()).Scan(&bucket.ID, &bucket.KeyID, &bucket.TenantID, &bucket.CreatedAt, &bucket.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("bucket not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &bucket, nil
+}
+
+// ListBuckets returns the live buckets of a key, newest first.
+func (db *DB) ListBuckets(ctx context.Context, keyID string) ([]*Bucket, error) {
+	query := `SELECT id, key_id, COALESCE(tenant_id, ''), created_at, expires_at FROM buckets
+	WHERE key_id = ? AND expires_at > ? ORDER BY created_at DESC`
+	rows, err := db.conn.QueryContext(ctx, query, keyID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []*Bucket{}
+	for rows.Next() {
+		var bucket Bucket
+		if err := rows.Scan(&bucket.ID, &bucket.KeyID, &bucket.TenantID, &bucket.CreatedAt, &bucket.ExpiresAt); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, &bucket)
+	}
+	return buckets, rows.Err()
+}
+
+// DeleteBucket removes a bucket together with its records.
+func (db *DB) DeleteBucket(ctx context.Context, id string) error {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM buckets WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return expectRow(result, "bucket not found")
+}
+
+// CaptureRequest records a request in a live bucket. Once the bucket holds
+// maxRecords, the oldest records make room for new ones.
+func (db *DB) CaptureRequest(ctx context.Context, bucketID string, request *CapturedRequest, maxRecords int) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	err = db.withTx(ctx, func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM buckets WHERE id = ? AND expires_at > ?)`, bucketID, time.Now()).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("bucket not found")
+		}
+
+		result, err := tx.ExecContext(ctx, `INSERT INTO bucket_records (bucket_id, data, received_at) VALUES (?, ?, ?)`,
+			bucketID, string(data), request.ReceivedAt)
+		if err != nil {
+			return err
+		}
+		if request.ID, err = result.LastInsertId(); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM bucket_records WHERE bucket_id = ? AND id <= (
+			SELECT id FROM bucket_records WHERE bucket_id = ? ORDER BY id DESC LIMIT 1 OFFSET ?
+		)`, bucketID, bucketID, maxRecords)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	db.notifyCaptured()
+	return nil
+}
+
+// ListCapturedRequests returns up to limit records of a bucket with IDs
+// greater than after, oldest first.
+func (db *DB) ListCapturedRequests(ctx context.Context, bucketID string, after int64, limit int) ([]*CapturedRequest, error) {
+	query := `SELECT id, data FROM bucket_records WHERE bucket_id = ? AND id > ? ORDER BY id LIMIT ?`
+	rows, err := db.conn.QueryContext(ctx, query, bucketID, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []*CapturedRequest{}
+	for rows.Next() {
+		request, err := scanCapturedRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	return requests, rows.Err()
+}
+
+func (db *DB) GetCapturedRequest(ctx context.Context, bucketID string, id int64) (*CapturedRequest, error) {
+	row := db.conn.QueryRowContext(ctx, `SELECT id, data FROM bucket_records WHERE bucket_id = ? AND id = ?`, bucketID, id)
+	request, err := scanCapturedRequest(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("record not found")
+	}
+	return request, err
+}
+
+func scanCapturedRequest(row scanner) (*CapturedRequest, error) {
+	var (
+		id   int64
+		data string
+	)
+	if err := row.Scan(&id, &data); err != nil {
+		return nil, err
+	}
+	var request CapturedRequest
+	if err := json.Unmarshal([]byte(data), &request); err != nil {
+		return nil, err
+	}
+	request.ID = id
+	return &request, nil
+}
+
+// DeleteExpiredBuckets removes expired buckets and their records.
+func (db *DB) DeleteExpiredBuckets(ctx context.Context) (int64, error) {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM buckets WHERE expires_at <= ?`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Captured returns a channel that is closed the next time a bucket records
+// a request, like Changed does for documents.
+func (db *DB) Captured() <-chan struct{} {
+	db.changedMutex.Lock()
+	defer db.changedMutex.Unlock()
+	return db.captured
+}
+
+func (db *DB) notifyCaptured() {
+	db.changedMutex.Lock()
+	defer db.changedMutex.Unlock()
+	close(db.captured)
+	db.captured = make(chan struct{})
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Change is an entry of the changes feed. Every write and deletion of a
+// document gets the next sequence number; expirations are deletions too.
+type Change struct {
+	Seq        int64     `json:"seq"`
+	DocumentID string    `json:"id"`
+	Version    int64     `json:"version,omitempty"`
+	Deleted    bool      `json:"deleted,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// ChangeFilter narrows down the changes feed. Zero values match everything.
+type ChangeFilter struct {
+	TenantID string
+	// IDPrefix matches the custom part of document IDs, after the namespace.
+	IDPrefix string
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordDocumentEvent adds an entry to the changes feed and queues webhook
+// deliveries for every document matching cond, a condition on json_storage.
+// It must run in the transaction that makes the change: after writes, so
+// the new version is recorded, and before deletions.
+func recordDocumentEvent(ctx context.Context, tx execer, event, cond string, args ...interface{}) error {
+	now := time.Now()
+	deleted := event == EventDocumentDeleted || event == EventDocumentExpired
+
+	query := `
+	INSERT INTO changes (document_id, tenant_id, version, deleted, timestamp)
+	SELECT id, tenant_id, version, ?, ? FROM json_storage WHERE ` + cond
+	if _, err := tx.ExecContext(ctx, query, append([]interface{}{deleted, now}, args...)...); err != nil {
+		return err
+	}
+
+	query = `
+	INSERT INTO webhook_deliveries (webhook_id, event, document_id, payload, status, attempts, next_attempt_at, created_at)
+	SELECT w.id, ?, d.id,
+		json_object('event', ?, 'document_id', d.id, 'tenant_id', d.tenant_id, 'timestamp', ?),
+		'pending', 0, ?, ?
+	FROM (SELECT id, tenant_id FROM json_storage WHERE ` + cond + `) d
+	JOIN webhooks w ON w.tenant_id = d.tenant_id
+	WHERE (w.events = '' OR instr(',' || w.events || ',', ',' || ? || ',') > 0)
+	AND substr(substr(d.id, instr(d.id, '_') + 1), 1, length(w.id_prefix)) = w.id_prefix`
+
+	params := []interface{}{event, event, now.UTC().Format(time.RFC3339)}
+	params = append(params, now, now)
+	params = append(params, args...)
+	params = append(params, event)
+	_, err := tx.ExecContext(ctx, query, params...)
+	return err
+}
+
+// ListChanges returns up to limit changes with a sequence number above
+// since, in order.
+func (db *DB) ListChanges(ctx context.Context, filter ChangeFilter, since int64, limit int) ([]*Change, error) {
+	query := `
+	SELECT seq, document_id, version, deleted, timestamp FROM changes
+	WHERE seq > ?
+	AND (? = '' OR tenant_id = ?)
+	AND substr(substr(document_id, instr(document_id, '_') + 1), 1, length(?)) = ?
+	ORDER BY seq LIMIT ?`
+	rows, err := db.conn.QueryContext(ctx, query, since, filter.TenantID, filter.TenantID, filter.IDPrefix, filter.IDPrefix, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []*Change{}
+	for rows.Next() {
+		var c Change
+		if err := rows.Scan(&c.Seq, &c.DocumentID, &c.Version, &c.Deleted, &c.Timestamp); err != nil {
+			return nil, err
+		}
+		if c.Deleted {
+			c.Version = 0
+		}
+		changes = append(changes, &c)
+	}
+	return changes, rows.Err()
+}
+
+// LastSeq returns the sequence number of the latest change.
+func (db *DB) LastSeq(ctx context.Context) (int64, error) {
+	var seq int64
+	err := db.conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM changes`).Scan(&seq)
+	return seq, err
+}
+
+// CompactChanges drops changes that were superseded by a later change of
+// the same document. Followers catching up still end with the same state,
+// because only the latest change of each document matters to them.
+// Deletions recorded before tombstonesBefore are dropped as well, unless it
+// is zero; without that the deletion of every document ever stored would
+// stay in the feed forever.
+func (db *DB) CompactChanges(ctx context.Context, tombstonesBefore time.Time) (int64, error) {
+	query := `
+	DELETE FROM changes WHERE seq < (
+		SELECT MAX(c.seq) FROM changes c WHERE c.document_id = changes.document_id
+	)`
+	args := []interface{}{}
+	if !tombstonesBefore.IsZero() {
+		query += ` OR (deleted = 1 AND timestamp < ?)`
+		args = append(args, tombstonesBefore)
+	}
+	result, err := db.conn.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCompactChanges(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	expires := time.Now().Add(time.Hour)
+
+	for _, id := range []string{"t1_kept", "t1_gone"} {
+		if err := s.db.CreateJSON(ctx, id, `{"v":1}`, expires, "k1", "t1", VisibilityPublic, KindDocument, ""); err != nil {
+			t.Fatalf("CreateJSON(%s): %v", id, err)
+		}
+	}
+	if err := s.db.UpdateJSON(ctx, "t1_kept", `{"v":2}`, expires); err != nil {
+		t.Fatalf("UpdateJSON: %v", err)
+	}
+	if err := s.db.DeleteJSON(ctx, "t1_gone"); err != nil {
+		t.Fatalf("DeleteJSON: %v", err)
+	}
+
+	ids := func() []string {
+		changes, err := s.db.ListChanges(ctx, ChangeFilter{}, 0, 100)
+		if err != nil {
+			t.Fatalf("ListChanges: %v", err)
+		}
+		var ids []string
+		for _, change := range changes {
+			id := change.DocumentID
+			if change.Deleted {
+				id += " deleted"
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	if got := ids(); len(got) != 4 {
+		t.Fatalf("changes = %v, want 4 before compaction", got)
+	}
+
+	// Superseded changes go; the fresh deletion stays.
+	if _, err := s.db.CompactChanges(ctx, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("CompactChanges: %v", err)
+	}
+	if got := ids(); len(got) != 2 || got[0] != "t1_kept" || got[1] != "t1_gone deleted" {
+		t.Fatalf("changes = %v, want the update and the deletion", got)
+	}
+
+	// Without a retention tombstones are kept.
+	if _, err := s.db.CompactChanges(ctx, time.Time{}); err != nil {
+		t.Fatalf("CompactChanges: %v", err)
+	}
+	if got := ids(); len(got) != 2 {
+		t.Fatalf("changes = %v, want the deletion kept", got)
+	}
+
+	// Deletions older than the retention go, live documents stay.
+	if _, err := s.db.CompactChanges(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("CompactChanges: %v", err)
+	}
+	if got := ids(); len(got) != 1 || got[0] != "t1_kept" {
+		t.Errorf("changes = %v, want only the live document", got)
+	}
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Kind tells plain documents from collections.
+type Kind string
+
+const (
+	// KindDocument is a single JSON value that is read and written whole.
+	KindDocument Kind = "document"
+	// KindCollection additionally holds items that are appended one at a
+	// time and read page by page. Its own data describes the collection.
+	KindCollection Kind = "collection"
+)
+
+// ParseKind validates a document kind name.
+func ParseKind(name string) (Kind, error) {
+	switch k := Kind(name); k {
+	case KindDocument, KindCollection:
+		return k, nil
+	}
+	return "", fmt.Errorf("unknown kind %q", name)
+}
+
+// Item is one entry of a collection.
+type Item struct {
+	ID        int64           `json:"id"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+	ExpiresAt *time.Time      `json:"expires_at,omitempty"`
+}
+
+// CollectionLimits caps what a single collection may hold.
+type CollectionLimits struct {
+	MaxItems int
+	MaxBytes int
+}
+
+// AppendItem adds an item to a live collection. An item without expiresAt
+// lives as long as the collection. Items that would take the collection
+// past its limits are refused with a "collection is full" error. The
+// collection gets a new version and a document.updated event, so watchers,
+// the changes feed and webhooks see the append.
+func (db *DB) AppendItem(ctx context.Context, documentID, data string, expiresAt *time.Time, limits CollectionLimits) (*Item, error) {
+	item := &Item{
+		Data:      json.RawMessage(data),
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+
+	err := db.changeDocuments(ctx, func(tx *sql.Tx) error {
+		var kind Kind
+		query := `SELECT kind FROM json_storage WHERE id = ? AND expires_at > ?`
+		err := tx.QueryRowContext(ctx, query, documentID, item.CreatedAt).Scan(&kind)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("json not found")
+		}
+		if err != nil {
+			return err
+		}
+		if kind != KindCollection {
+			return fmt.Errorf("not a collection")
+		}
+
+		count, size, err := collectionUsage(ctx, tx, documentID)
+		if err != nil {
+			return err
+		}
+		if count >= int64(limits.MaxItems) {
+			return fmt.Errorf("collection is full: at most %d items", limits.MaxItems)
+		}
+		if size+int64(len(data)) > int64(limits.MaxBytes) {
+			return fmt.Errorf("collection is full: at most %d bytes", limits.MaxBytes)
+		}
+
+		var expires sql.NullTime
+		if expiresAt != nil {
+			expires = sql.NullTime{Time: *expiresAt, Valid: true}
+		}
+		result, err := tx.ExecContext(ctx,
+			`INSERT INTO collection_items (document_id, data, size, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+			documentID, data, len(data), item.CreatedAt, expires)
+		if err != nil {
+			return err
+		}
+		if item.ID, err = result.LastInsertId(); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `UPDATE json_storage SET version = version + 1 WHERE id = ?`, documentID); err != nil {
+			return err
+		}
+		return recordDocumentEvent(ctx, tx, EventDocumentUpdated, "id = ?", documentID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// ListItems returns up to limit live items of a collection with IDs greater
+// than after, oldest first.
+func (db *DB) ListItems(ctx context.Context, documentID string, after int64, limit int) ([]*Item, error) {
+	query := `SELECT id, data, created_at, expires_at FROM collection_items
+	WHERE document_id = ? AND id > ? AND (expires_at IS NULL OR expires_at > ?)
+	ORDER BY id LIMIT ?`
+	rows, err := db.conn.QueryContext(ctx, query, documentID, after, time.Now(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []*Item{}
+	for rows.Next() {
+		var (
+			item      Item
+			data      string
+			expiresAt sql.NullTime
+		)
+		if err := rows.Scan(&item.ID, &data, &item.CreatedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		item.Data = json.RawMessage(data)
+		item.ExpiresAt = nullTimePtr(expiresAt)
+		items = append(items, &item)
+	}
+	return items, rows.Err()
+}
+
+// CollectionUsage returns the number of live items in a collection and
+// their total size in bytes.
+func (db *DB) CollectionUsage(ctx context.Context, documentID string) (count, size int64, err error) {
+	return collectionUsage(ctx, db.conn, documentID)
+}
+
+func collectionUsage(ctx context.Context, q querier, documentID string) (count, size int64, err error) {
+	query := `SELECT COUNT(*), COALESCE(SUM(size), 0) FROM collection_items
+	WHERE document_id = ? AND (expires_at IS NULL OR expires_at > ?)`
+	err = q.QueryRowContext(ctx, query, documentID, time.Now()).Scan(&count, &size)
+	return count, size, err
+}
+
+// DeleteExpiredItems removes items whose TTL has passed. Items of deleted
+// collections go with them through the foreign key.
+func (db *DB) DeleteExpiredItems(ctx context.Context) (int64, error) {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM collection_items WHERE expires_at <= ?`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
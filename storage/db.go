@@ -2,13 +2,45 @@ package storage
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
+
+	"pocketjson/utils"
 )
 
 type DB struct {
 	conn *sql.DB
+
+	// changed and captured are closed and replaced to wake up watchers of
+	// documents and of bucket captures; changedMutex guards both.
+	changed      chan struct{}
+	captured     chan struct{}
+	changedMutex sync.Mutex
+}
+
+// Document holds the metadata of a stored JSON document.
+type Document struct {
+	ID         string
+	CreatorKey string
+	TenantID   string
+	Visibility Visibility
+	Kind       Kind
+	Version    int64
+	ExpiresAt  time.Time
+	CreatedAt  *time.Time
+	Size       int64
+}
+
+// Stats summarises what is stored on the instance.
+type Stats struct {
+	Documents      int64 `json:"documents"`
+	GuestDocuments int64 `json:"guest_documents"`
+	Bytes          int64 `json:"bytes"`
+	ApiKeys        int64 `json:"api_keys"`
 }
 
 func NewDB(dsn string) (*DB, error) {
@@ -21,7 +53,7 @@ func NewDB(dsn string) (*DB, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	db := &DB{conn: conn}
+	db := &DB{conn: conn, changed: make(chan struct{}), captured: make(chan struct{})}
 
 	if err := db.initSchema(); err != nil {
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
@@ -50,71 +82,459 @@ func (db *DB) initSchema() error {
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_api_keys_key ON api_keys(key);
+
+	CREATE TABLE IF NOT EXISTS tenants (
+		id TEXT PRIMARY KEY,
+		slug TEXT UNIQUE,
+		description TEXT,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	-- Slugs tenants have renamed away from. They stay reserved for their
+	-- tenant so that document IDs under the old prefix keep resolving.
+	CREATE TABLE IF NOT EXISTS tenant_slugs (
+		slug TEXT PRIMARY KEY,
+		tenant_id TEXT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+		retired_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp DATETIME NOT NULL,
+		actor_key TEXT NOT NULL,
+		tenant_id TEXT,
+		client_ip TEXT NOT NULL DEFAULT '',
+		action TEXT NOT NULL,
+		target TEXT NOT NULL DEFAULT '',
+		outcome TEXT NOT NULL,
+		status INTEGER NOT NULL DEFAULT 0,
+		detail TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_audit_log_timestamp ON audit_log(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_actor_key ON audit_log(actor_key);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_target ON audit_log(target);
+
+	-- Grants of access to a document for keys other than its owner. They go
+	-- away with the document, whether it is deleted or expires.
+	CREATE TABLE IF NOT EXISTS document_acl (
+		document_id TEXT NOT NULL REFERENCES json_storage(id) ON DELETE CASCADE,
+		key_id TEXT NOT NULL,
+		access TEXT NOT NULL,
+		granted_by TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (document_id, key_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_document_acl_key_id ON document_acl(key_id);
+
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id TEXT PRIMARY KEY,
+		key_id TEXT NOT NULL,
+		tenant_id TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL DEFAULT '',
+		id_prefix TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_webhooks_key_id ON webhooks(key_id);
+	CREATE INDEX IF NOT EXISTS idx_webhooks_tenant_id ON webhooks(tenant_id);
+
+	-- Outbox of webhook deliveries, written in the same transaction as the
+	-- document change they report.
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id TEXT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		event TEXT NOT NULL,
+		document_id TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at DATETIME,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		delivered_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id);
+
+	-- The changes feed. AUTOINCREMENT keeps sequence numbers from being
+	-- reused after compaction.
+	CREATE TABLE IF NOT EXISTS changes (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		document_id TEXT NOT NULL,
+		tenant_id TEXT,
+		version INTEGER NOT NULL,
+		deleted BOOLEAN NOT NULL DEFAULT 0,
+		timestamp DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_changes_document_id ON changes(document_id);
+	CREATE INDEX IF NOT EXISTS idx_changes_tenant_id ON changes(tenant_id, seq);
+
+	-- Items appended to collection documents. The autoincrement ID doubles
+	-- as the pagination cursor.
+	CREATE TABLE IF NOT EXISTS collection_items (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		document_id TEXT NOT NULL REFERENCES json_storage(id) ON DELETE CASCADE,
+		data TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_collection_items_document_id ON collection_items(document_id, id);
+	CREATE INDEX IF NOT EXISTS idx_collection_items_expires_at ON collection_items(expires_at);
+
+	-- Queue messages. Queues are named per tenant and exist implicitly.
+	CREATE TABLE IF NOT EXISTS queue_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tenant_id TEXT NOT NULL,
+		queue TEXT NOT NULL,
+		data TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'ready',
+		receipt TEXT,
+		receive_count INTEGER NOT NULL DEFAULT 0,
+		max_receives INTEGER NOT NULL,
+		enqueued_at DATETIME NOT NULL,
+		visible_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_queue_messages_queue ON queue_messages(tenant_id, queue, status, visible_at);
+	CREATE INDEX IF NOT EXISTS idx_queue_messages_expires_at ON queue_messages(expires_at);
+
+	-- Lease locks. Rows are removed on release or once the lease ran out.
+	CREATE TABLE IF NOT EXISTS locks (
+		tenant_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		owner_token TEXT NOT NULL,
+		fencing_token INTEGER NOT NULL,
+		acquired_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		PRIMARY KEY (tenant_id, name)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_locks_expires_at ON locks(expires_at);
+
+	-- Named counters that must never go back, such as lock fencing tokens.
+	CREATE TABLE IF NOT EXISTS counters (
+		name TEXT PRIMARY KEY,
+		value INTEGER NOT NULL
+	);
+
+	-- Catcher buckets record arbitrary requests sent to their URL.
+	CREATE TABLE IF NOT EXISTS buckets (
+		id TEXT PRIMARY KEY,
+		key_id TEXT NOT NULL,
+		tenant_id TEXT,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_buckets_key_id ON buckets(key_id);
+	CREATE INDEX IF NOT EXISTS idx_buckets_expires_at ON buckets(expires_at);
+
+	CREATE TABLE IF NOT EXISTS bucket_records (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		bucket_id TEXT NOT NULL REFERENCES buckets(id) ON DELETE CASCADE,
+		data TEXT NOT NULL,
+		received_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_bucket_records_bucket_id ON bucket_records(bucket_id, id);
+
+	CREATE TABLE IF NOT EXISTS signing_secrets (
+		id TEXT PRIMARY KEY,
+		secret BLOB NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS signed_url_uses (
+		signature TEXT PRIMARY KEY,
+		uses INTEGER NOT NULL DEFAULT 0,
+		expires_at DATETIME NOT NULL
+	);
+
+	-- The audit log is append-only; only the retention cleanup deletes rows.
+	CREATE TRIGGER IF NOT EXISTS audit_log_append_only
+	BEFORE UPDATE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit log is append-only');
+	END;
 	`
 
-	_, err := db.conn.Exec(schema)
+	if _, err := db.conn.Exec(schema); err != nil {
+		return err
+	}
+
+	return db.migrate()
+}
+
+// migrate brings databases created by older versions up to date. Every step
+// is idempotent so it can run on each startup.
+func (db *DB) migrate() error {
+	columns := []struct{ table, name, definition string }{
+		{"api_keys", "client_id", "TEXT"},
+		{"api_keys", "scopes", "TEXT"},
+		{"api_keys", "id_prefix", "TEXT NOT NULL DEFAULT ''"},
+		{"api_keys", "expires_at", "DATETIME"},
+		{"api_keys", "last_used_at", "DATETIME"},
+		{"api_keys", "request_count", "INTEGER NOT NULL DEFAULT 0"},
+		{"api_keys", "previous_key", "TEXT"},
+		{"api_keys", "previous_key_expires_at", "DATETIME"},
+		{"api_keys", "tenant_id", "TEXT"},
+		{"json_storage", "tenant_id", "TEXT"},
+		{"json_storage", "created_at", "DATETIME"},
+		{"json_storage", "visibility", "TEXT NOT NULL DEFAULT 'public'"},
+		{"json_storage", "edit_token_hash", "TEXT"},
+		{"json_storage", "version", "INTEGER NOT NULL DEFAULT 1"},
+		{"json_storage", "kind", "TEXT NOT NULL DEFAULT 'document'"},
+	}
+	for _, c := range columns {
+		if err := db.addColumnIfMissing(c.table, c.name, c.definition); err != nil {
+			return err
+		}
+	}
+
+	if err := db.backfillClientIDs(); err != nil {
+		return fmt.Errorf("failed to backfill key ids: %w", err)
+	}
+
+	// Documents used to record the full secret of their creator. Replace it
+	// with the public key ID so secrets are only ever stored in api_keys.
+	_, err := db.conn.Exec(`
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_api_keys_client_id ON api_keys(client_id);
+	CREATE INDEX IF NOT EXISTS idx_api_keys_previous_key ON api_keys(previous_key);
+	CREATE INDEX IF NOT EXISTS idx_json_storage_creator_key ON json_storage(creator_key);
+
+	UPDATE json_storage
+	SET creator_key = (SELECT client_id FROM api_keys WHERE api_keys.key = json_storage.creator_key)
+	WHERE creator_key IN (SELECT key FROM api_keys);
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Keys created before tenants existed each get a tenant of their own whose
+	// ID is the key ID, which keeps their namespace and document IDs intact.
+	_, err = db.conn.Exec(`
+	INSERT OR IGNORE INTO tenants (id, created_at)
+	SELECT client_id, created_at FROM api_keys WHERE tenant_id IS NULL;
+
+	UPDATE api_keys SET tenant_id = client_id WHERE tenant_id IS NULL;
+
+	UPDATE json_storage SET tenant_id = creator_key
+	WHERE tenant_id IS NULL AND creator_key != 'guest';
+
+	CREATE INDEX IF NOT EXISTS idx_api_keys_tenant_id ON api_keys(tenant_id);
+	CREATE INDEX IF NOT EXISTS idx_json_storage_tenant_id ON json_storage(tenant_id);
+	CREATE INDEX IF NOT EXISTS idx_json_storage_created_at ON json_storage(created_at);
+	`)
 	return err
 }
 
+func (db *DB) addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.conn.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   bool
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.conn.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func (db *DB) backfillClientIDs() error {
+	rows, err := db.conn.Query(`SELECT key FROM api_keys WHERE client_id IS NULL`)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if _, err := db.conn.Exec(`UPDATE api_keys SET client_id = ? WHERE key = ?`, utils.GetClientPrefix(key), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (db *DB) Close() error {
 	return db.conn.Close()
 }
 
-func (db *DB) CreateJSON(ctx context.Context, id, data string, expiresAt time.Time, creatorKey string) error {
-	query := `INSERT INTO json_storage (id, data, expires_at, creator_key) VALUES (?, ?, ?, ?)`
-	_, err := db.conn.ExecContext(ctx, query, id, data, expiresAt, creatorKey)
-	return err
+// CreateJSON stores a new document. tenantID is empty for guest documents,
+// and editTokenHash is only set for them.
+func (db *DB) CreateJSON(ctx context.Context, id, data string, expiresAt time.Time, creatorKey, tenantID string, visibility Visibility, kind Kind, editTokenHash string) error {
+	return db.changeDocuments(ctx, func(tx *sql.Tx) error {
+		return createJSON(ctx, tx, id, data, expiresAt, creatorKey, tenantID, visibility, kind, editTokenHash)
+	})
 }
 
-func (db *DB) GetJSON(ctx context.Context, id string) (string, error) {
-	query := `SELECT data FROM json_storage WHERE id = ? AND expires_at > ?`
-	var data string
-	err := db.conn.QueryRowContext(ctx, query, id, time.Now()).Scan(&data)
+// withTx runs fn in a transaction that is committed if fn succeeds.
+func (db *DB) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// changeDocuments is withTx for transactions that create, change or delete
+// documents. Watchers are woken up once the transaction is committed.
+func (db *DB) changeDocuments(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if err := db.withTx(ctx, fn); err != nil {
+		return err
+	}
+	db.notifyChanged()
+	return nil
+}
+
+// Changed returns a channel that is closed the next time documents change.
+// Watchers take the channel before reading a document and wait on it
+// afterwards, so that no change goes unnoticed.
+func (db *DB) Changed() <-chan struct{} {
+	db.changedMutex.Lock()
+	defer db.changedMutex.Unlock()
+	return db.changed
+}
+
+func (db *DB) notifyChanged() {
+	db.changedMutex.Lock()
+	defer db.changedMutex.Unlock()
+	close(db.changed)
+	db.changed = make(chan struct{})
+}
+
+// CheckEditToken reports whether tokenHash is the edit token hash of the
+// live document id.
+func (db *DB) CheckEditToken(ctx context.Context, id, tokenHash string) (bool, error) {
+	query := `SELECT COALESCE(edit_token_hash, '') FROM json_storage WHERE id = ? AND expires_at > ?`
+	var stored string
+	err := db.conn.QueryRowContext(ctx, query, id, time.Now()).Scan(&stored)
 	if err == sql.ErrNoRows {
-		return "", fmt.Errorf("json not found")
+		return false, nil
 	}
 	if err != nil {
-		return "", err
+		return false, err
 	}
-	return data, nil
+	return stored != "" && subtle.ConstantTimeCompare([]byte(stored), []byte(tokenHash)) == 1, nil
+}
+
+func (db *DB) GetJSON(ctx context.Context, id string) (string, error) {
+	return getJSON(ctx, db.conn, id)
 }
 
 func (db *DB) DeleteExpiredJSON(ctx context.Context) (int64, error) {
-	query := `DELETE FROM json_storage WHERE expires_at < ?`
-	result, err := db.conn.ExecContext(ctx, query, time.Now())
-	if err != nil {
-		return 0, err
-	}
-	return result.RowsAffected()
+	var deleted int64
+	err := db.changeDocuments(ctx, func(tx *sql.Tx) error {
+		now := time.Now()
+		if err := recordDocumentEvent(ctx, tx, EventDocumentExpired, "expires_at < ?", now); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, `DELETE FROM json_storage WHERE expires_at < ?`, now)
+		if err != nil {
+			return err
+		}
+		deleted, err = result.RowsAffected()
+		return err
+	})
+	return deleted, err
 }
 
-func (db *DB) CreateApiKey(ctx context.Context, key, description string, isAdmin bool) error {
-	query := `INSERT INTO api_keys (key, description, is_admin, created_at) VALUES (?, ?, ?, ?)`
-	_, err := db.conn.ExecContext(ctx, query, key, description, isAdmin, time.Now())
+// ReassignCreatorKey moves documents recorded under one creator to another.
+// It is used to replace the master key secret with its public ID.
+func (db *DB) ReassignCreatorKey(ctx context.Context, from, to string) error {
+	query := `UPDATE json_storage SET creator_key = ? WHERE creator_key = ?`
+	_, err := db.conn.ExecContext(ctx, query, to, from)
 	return err
 }
 
-func (db *DB) GetApiKey(ctx context.Context, key string) (isAdmin bool, createdAt time.Time, err error) {
-	query := `SELECT is_admin, created_at FROM api_keys WHERE key = ?`
-	err = db.conn.QueryRowContext(ctx, query, key).Scan(&isAdmin, &createdAt)
-	if err == sql.ErrNoRows {
-		return false, time.Time{}, fmt.Errorf("api key not found")
-	}
-	return isAdmin, createdAt, err
+// UpdateJSON replaces the data and expiry of an existing document.
+func (db *DB) UpdateJSON(ctx context.Context, id, data string, expiresAt time.Time) error {
+	return db.changeDocuments(ctx, func(tx *sql.Tx) error {
+		return updateJSON(ctx, tx, id, data, expiresAt)
+	})
+}
+
+func (db *DB) DeleteJSON(ctx context.Context, id string) error {
+	return db.changeDocuments(ctx, func(tx *sql.Tx) error {
+		return deleteJSON(ctx, tx, id)
+	})
+}
+
+// GetDocument returns the metadata of a live document without its data.
+func (db *DB) GetDocument(ctx context.Context, id string) (*Document, error) {
+	return getDocument(ctx, db.conn, id)
 }
 
-func (db *DB) DeleteApiKey(ctx context.Context, key string) error {
-	query := `DELETE FROM api_keys WHERE key = ?`
-	result, err := db.conn.ExecContext(ctx, query, key)
+func (db *DB) GetStats(ctx context.Context) (*Stats, error) {
+	query := `
+	SELECT
+		COUNT(*),
+		COALESCE(SUM(creator_key = 'guest'), 0),
+		COALESCE(SUM(LENGTH(data)), 0),
+		(SELECT COUNT(*) FROM api_keys)
+	FROM json_storage WHERE expires_at > ?`
+	var stats Stats
+	err := db.conn.QueryRowContext(ctx, query, time.Now()).Scan(&stats.Documents, &stats.GuestDocuments, &stats.Bytes, &stats.ApiKeys)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &stats, nil
+}
+
+// expectRow turns a statement that touched no rows into a not found error.
+func expectRow(result sql.Result, notFound string) error {
 	rows, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
 	if rows == 0 {
-		return fmt.Errorf("api key not found")
+		return errors.New(notFound)
 	}
 	return nil
 }
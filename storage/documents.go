@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Visibility controls who can read a document.
+type Visibility string
+
+const (
+	// VisibilityPublic documents can be read by anyone who knows the ID.
+	VisibilityPublic Visibility = "public"
+	// VisibilityPrivate documents can only be read by their creator key and
+	// admins.
+	VisibilityPrivate Visibility = "private"
+	// VisibilityTenant documents can be read by every key of their tenant.
+	VisibilityTenant Visibility = "tenant"
+)
+
+// ParseVisibility validates a visibility name.
+func ParseVisibility(name string) (Visibility, error) {
+	switch v := Visibility(name); v {
+	case VisibilityPublic, VisibilityPrivate, VisibilityTenant:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown visibility %q", name)
+}
+
+const documentColumns = `id, creator_key, COALESCE(tenant_id, ''), visibility, kind, version, expires_at, created_at, LENGTH(data)`
+
+func scanDocument(row scanner) (*Document, error) {
+	var (
+		doc       Document
+		createdAt sql.NullTime
+	)
+	err := row.Scan(&doc.ID, &doc.CreatorKey, &doc.TenantID, &doc.Visibility, &doc.Kind, &doc.Version, &doc.ExpiresAt, &createdAt, &doc.Size)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("json not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc.CreatedAt = nullTimePtr(createdAt)
+	return &doc, nil
+}
+
+// DocumentFilter selects live documents for the admin listing and bulk
+// deletion. Zero values match everything.
+type DocumentFilter struct {
+	CreatorKey string
+	TenantID   string
+	// Guest selects guest documents when true and authenticated ones when
+	// false.
+	Guest    *bool
+	IDPrefix string
+	// CustomIDPrefix selects documents whose custom ID, the part after the
+	// namespace, starts with it. It carries a key's id_prefix restriction.
+	CustomIDPrefix string
+	Visibility     Visibility
+	// ReadableBy leaves out private documents created by other keys than
+	// this one.
+	ReadableBy string
+	MinSize    *int64
+	MaxSize    *int64
+
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	ExpiresAfter  *time.Time
+	ExpiresBefore *time.Time
+
+	// Orphaned selects documents whose creator key no longer exists. Keys
+	// without a row in api_keys, like the master key, go in KnownKeys.
+	Orphaned  bool
+	KnownKeys []string
+}
+
+// IsEmpty reports whether the filter matches every document.
+func (f DocumentFilter) IsEmpty() bool {
+	return f.CreatorKey == "" && f.TenantID == "" && f.Guest == nil && f.IDPrefix == "" &&
+		f.CustomIDPrefix == "" && f.Visibility == "" && f.ReadableBy == "" &&
+		f.MinSize == nil && f.MaxSize == nil && f.CreatedAfter == nil && f.CreatedBefore == nil &&
+		f.ExpiresAfter == nil && f.ExpiresBefore == nil && !f.Orphaned
+}
+
+func (f DocumentFilter) where() (string, []interface{}) {
+	where := []string{"expires_at > ?"}
+	args := []interface{}{time.Now()}
+
+	add := func(cond string, arg ...interface{}) {
+		where = append(where, cond)
+		args = append(args, arg...)
+	}
+
+	if f.CreatorKey != "" {
+		add("creator_key = ?", f.CreatorKey)
+	}
+	if f.TenantID != "" {
+		add("tenant_id = ?", f.TenantID)
+	}
+	if f.Guest != nil {
+		if *f.Guest {
+			add("creator_key = 'guest'")
+		} else {
+			add("creator_key != 'guest'")
+		}
+	}
+	if f.IDPrefix != "" {
+		add("id LIKE ? ESCAPE '\\'", escapeLike(f.IDPrefix)+"%")
+	}
+	if f.CustomIDPrefix != "" {
+		add("INSTR(id, '_') > 0 AND SUBSTR(id, INSTR(id, '_') + 1) LIKE ? ESCAPE '\\'", escapeLike(f.CustomIDPrefix)+"%")
+	}
+	if f.Visibility != "" {
+		add("visibility = ?", f.Visibility)
+	}
+	if f.ReadableBy != "" {
+		add("(visibility != 'private' OR creator_key = ?)", f.ReadableBy)
+	}
+	if f.MinSize != nil {
+		add("LENGTH(data) >= ?", *f.MinSize)
+	}
+	if f.MaxSize != nil {
+		add("LENGTH(data) <= ?", *f.MaxSize)
+	}
+	if f.CreatedAfter != nil {
+		add("created_at >= ?", *f.CreatedAfter)
+	}
+	if f.CreatedBefore != nil {
+		add("created_at < ?", *f.CreatedBefore)
+	}
+	if f.ExpiresAfter != nil {
+		add("expires_at >= ?", *f.ExpiresAfter)
+	}
+	if f.ExpiresBefore != nil {
+		add("expires_at < ?", *f.ExpiresBefore)
+	}
+	if f.Orphaned {
+		add("creator_key != 'guest'")
+		add("creator_key NOT IN (SELECT client_id FROM api_keys)")
+		for _, key := range f.KnownKeys {
+			add("creator_key != ?", key)
+		}
+	}
+
+	return strings.Join(where, " AND "), args
+}
+
+// ListDocuments returns the metadata of documents matching the filter,
+// ordered by ID and starting after the given ID.
+func (db *DB) ListDocuments(ctx context.Context, filter DocumentFilter, after string, limit int) ([]*Document, error) {
+	cond, args := filter.where()
+	query := `SELECT ` + documentColumns + ` FROM json_storage WHERE ` + cond + ` AND id > ? ORDER BY id LIMIT ?`
+	rows, err := db.conn.QueryContext(ctx, query, append(args, after, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := []*Document{}
+	for rows.Next() {
+		doc, err := scanDocument(rows)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, rows.Err()
+}
+
+// DeleteDocuments deletes every document matching the filter and returns
+// how many were deleted.
+func (db *DB) DeleteDocuments(ctx context.Context, filter DocumentFilter) (int64, error) {
+	var deleted int64
+	err := db.changeDocuments(ctx, func(tx *sql.Tx) error {
+		cond, args := filter.where()
+		if err := recordDocumentEvent(ctx, tx, EventDocumentDeleted, cond, args...); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, `DELETE FROM json_storage WHERE `+cond, args...)
+		if err != nil {
+			return err
+		}
+		deleted, err = result.RowsAffected()
+		return err
+	})
+	return deleted, err
+}
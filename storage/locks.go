@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"pocketjson/utils"
+)
+
+// Lock is a lease on a name within a tenant. Only the holder knows the
+// owner token. The fencing token grows with every acquisition, so a
+// resource guarded by the lock can reject writes carrying an older token
+// from a holder whose lease ran out.
+type Lock struct {
+	Name         string    `json:"name"`
+	TenantID     string    `json:"-"`
+	OwnerToken   string    `json:"owner_token,omitempty"`
+	FencingToken int64     `json:"fencing_token"`
+	AcquiredAt   time.Time `json:"acquired_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// AcquireLock takes the lock if it is free or its lease ran out. If someone
+// else holds it, the current lease is returned (without its owner token)
+// together with a "lock is held" error.
+func (db *DB) AcquireLock(ctx context.Context, tenantID, name string, ttl time.Duration) (*Lock, error) {
+	owner, err := utils.GenerateRandomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var lock *Lock
+	err = db.withTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now()
+		current, err := getLock(ctx, tx, tenantID, name)
+		if err == nil {
+			current.OwnerToken = ""
+			lock = current
+			return fmt.Errorf("lock is held")
+		}
+		if err.Error() != "lock not found" {
+			return err
+		}
+
+		// The counter is shared by all locks so that it never goes back,
+		// even after a lock's row has been cleaned up.
+		var fencing int64
+		err = tx.QueryRowContext(ctx, `INSERT INTO counters (name, value) VALUES ('lock_fencing', 1)
+		ON CONFLICT(name) DO UPDATE SET value = value + 1 RETURNING value`).Scan(&fencing)
+		if err != nil {
+			return err
+		}
+
+		lock = &Lock{
+			Name:         name,
+			TenantID:     tenantID,
+			OwnerToken:   owner,
+			FencingToken: fencing,
+			AcquiredAt:   now,
+			ExpiresAt:    now.Add(ttl),
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO locks (tenant_id, name, owner_token, fencing_token, acquired_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(tenant_id, name) DO UPDATE SET owner_token = excluded.owner_token, fencing_token = excluded.fencing_token,
+			acquired_at = excluded.acquired_at, expires_at = excluded.expires_at`,
+			tenantID, name, lock.OwnerToken, lock.FencingToken, lock.AcquiredAt, lock.ExpiresAt)
+		return err
+	})
+	return lock, err
+}
+
+// RenewLock extends a lease that is still held by owner to ttl from now.
+func (db *DB) RenewLock(ctx context.Context, tenantID, name, owner string, ttl time.Duration) (*Lock, error) {
+	var lock *Lock
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now()
+		result, err := tx.ExecContext(ctx, `UPDATE locks SET expires_at = ?
+		WHERE tenant_id = ? AND name = ? AND owner_token = ? AND expires_at > ?`,
+			now.Add(ttl), tenantID, name, owner, now)
+		if err != nil {
+			return err
+		}
+		if err := expectRow(result, "lock not held"); err != nil {
+			return err
+		}
+		lock, err = getLock(ctx, tx, tenantID, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// ReleaseLock frees a lease that is still held by owner.
+func (db *DB) ReleaseLock(ctx context.Context, tenantID, name, owner string) error {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM locks
+	WHERE tenant_id = ? AND name = ? AND owner_token = ? AND expires_at > ?`,
+		tenantID, name, owner, time.Now())
+	if err != nil {
+		return err
+	}
+	return expectRow(result, "lock not held")
+}
+
+// GetLock returns the current lease on a name, including its owner token.
+func (db *DB) GetLock(ctx context.Context, tenantID, name string) (*Lock, error) {
+	return getLock(ctx, db.conn, tenantID, name)
+}
+
+func getLock(ctx context.Context, q querier, tenantID, name string) (*Lock, error) {
+	lock := &Lock{Name: name, TenantID: tenantID}
+	query := `SELECT owner_token, fencing_token, acquired_at, expires_at FROM locks
+	WHERE tenant_id = ? AND name = ? AND expires_at > ?`
+	err := q.QueryRowContext(ctx, query, tenantID, name, time.Now()).Scan(&lock.OwnerToken, &lock.FencingToken, &lock.AcquiredAt, &lock.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("lock not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// DeleteExpiredLocks reclaims leases that ran out without being released.
+func (db *DB) DeleteExpiredLocks(ctx context.Context) (int64, error) {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM locks WHERE expires_at <= ?`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Scope is a single capability that can be granted to an API key.
+type Scope string
+
+const (
+	ScopeDocumentsRead   Scope = "documents:read"
+	ScopeDocumentsWrite  Scope = "documents:write"
+	ScopeDocumentsDelete Scope = "documents:delete"
+	ScopeKeysManage      Scope = "keys:manage"
+	ScopeStatsRead       Scope = "stats:read"
+)
+
+// AllScopes lists every scope known to the server. Admin keys hold all of them.
+var AllScopes = []Scope{
+	ScopeDocumentsRead,
+	ScopeDocumentsWrite,
+	ScopeDocumentsDelete,
+	ScopeKeysManage,
+	ScopeStatsRead,
+}
+
+// DefaultScopes are granted to non-admin keys created without explicit scopes,
+// which matches what every key could do before scopes existed.
+var DefaultScopes = []Scope{
+	ScopeDocumentsRead,
+	ScopeDocumentsWrite,
+	ScopeDocumentsDelete,
+}
+
+// ParseScopes validates scope names and removes duplicates.
+func ParseScopes(names []string) ([]Scope, error) {
+	seen := make(map[Scope]bool, len(names))
+	scopes := make([]Scope, 0, len(names))
+	for _, name := range names {
+		scope := Scope(strings.TrimSpace(name))
+		if !scope.valid() {
+			return nil, fmt.Errorf("unknown scope %q", name)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+func (s Scope) valid() bool {
+	for _, scope := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeScopes and decodeScopes convert between the slice form and the
+// comma-separated form stored in api_keys.scopes.
+func encodeScopes(scopes []Scope) string {
+	names := make([]string, len(scopes))
+	for i, scope := range scopes {
+		names[i] = string(scope)
+	}
+	return strings.Join(names, ",")
+}
+
+func decodeScopes(value string) []Scope {
+	if value == "" {
+		return nil
+	}
+	var scopes []Scope
+	for _, name := range strings.Split(value, ",") {
+		if scope := Scope(name); scope.valid() {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// Permissions describes what an authenticated API key may do. A nil
+// *Permissions stands for an unauthenticated (guest) request, and all
+// methods are safe to call on it.
+type Permissions struct {
+	KeyID    string
+	TenantID string
+	IsAdmin  bool
+	Scopes   []Scope
+	IDPrefix string
+	// ExpiresAt is when the key stops working, or nil if it never does.
+	ExpiresAt *time.Time
+	// DocumentID limits the permissions to a single document. It is set for
+	// requests authorised by a signed URL.
+	DocumentID string
+	// Guest is set for requests authorised by the edit token of a guest
+	// document. KeyID is "guest" and DocumentID names the document.
+	Guest bool
+
+	namespace string
+}
+
+func newPermissions(key *ApiKey) *Permissions {
+	p := &Permissions{
+		KeyID:     key.ClientID,
+		TenantID:  key.TenantID,
+		IsAdmin:   key.IsAdmin,
+		Scopes:    key.Scopes,
+		IDPrefix:  key.IDPrefix,
+		ExpiresAt: key.ExpiresAt,
+		namespace: key.Namespace,
+	}
+	if key.IsAdmin {
+		p.Scopes = AllScopes
+	} else if key.Scopes == nil {
+		p.Scopes = DefaultScopes
+	}
+	return p
+}
+
+// Has reports whether the key was granted the scope.
+func (p *Permissions) Has(scope Scope) bool {
+	if p == nil {
+		return false
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsID reports whether the key may operate on a custom ID, i.e. the part
+// of a document ID after the namespace prefix.
+func (p *Permissions) AllowsID(customID string) bool {
+	if p == nil {
+		return false
+	}
+	return p.IDPrefix == "" || strings.HasPrefix(customID, p.IDPrefix)
+}
+
+// Namespace returns the prefix used for custom document IDs: the tenant
+// slug, or the tenant ID when the tenant has no slug.
+func (p *Permissions) Namespace() string {
+	if p == nil {
+		return ""
+	}
+	return p.namespace
+}
+
+// CanManageDocument reports whether the document belongs to the key's
+// tenant, or the key is an admin that may act on any document. Keys with an
+// ID prefix restriction only manage documents under that prefix, and private
+// documents are managed by their creator alone.
+func (p *Permissions) CanManageDocument(doc *Document) bool {
+	if p == nil {
+		return false
+	}
+	if p.DocumentID != "" && p.DocumentID != doc.ID {
+		return false
+	}
+	if p.Guest {
+		return doc.CreatorKey == "guest"
+	}
+	if p.IsAdmin {
+		return true
+	}
+	if doc.TenantID == "" || doc.TenantID != p.TenantID {
+		return false
+	}
+	if doc.Visibility == VisibilityPrivate && doc.CreatorKey != p.KeyID {
+		return false
+	}
+	if p.IDPrefix == "" {
+		return true
+	}
+	_, customID, ok := strings.Cut(doc.ID, "_")
+	return ok && p.AllowsID(customID)
+}
+
+// CanReadDocument reports whether the document's visibility lets the key
+// read it. Public documents can be read by anyone, including guests.
+func (p *Permissions) CanReadDocument(doc *Document) bool {
+	if doc.Visibility == VisibilityPublic || doc.Visibility == "" {
+		return true
+	}
+	if !p.Has(ScopeDocumentsRead) {
+		return false
+	}
+	if p.DocumentID != "" && p.DocumentID != doc.ID {
+		return false
+	}
+	if p.IsAdmin {
+		return true
+	}
+	switch doc.Visibility {
+	case VisibilityPrivate:
+		return doc.CreatorKey == p.KeyID
+	case VisibilityTenant:
+		return doc.TenantID != "" && doc.TenantID == p.TenantID
+	}
+	return false
+}
+
+// Covers reports whether p holds every scope in scopes. It is used to stop
+// keys from handing out more than they have.
+func (p *Permissions) Covers(scopes []Scope) bool {
+	for _, scope := range scopes {
+		if !p.Has(scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// EffectiveScopes returns the scopes a key actually holds, taking the admin
+// flag and the defaults for keys without explicit scopes into account.
+func EffectiveScopes(key *ApiKey) []Scope {
+	return newPermissions(key).Scopes
+}
@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"pocketjson/utils"
+)
+
+// Message states. Ready messages are either waiting, delayed or leased to a
+// consumer (in flight), depending on visible_at and receipt.
+const (
+	MessageReady = "ready"
+	MessageDead  = "dead"
+)
+
+// Message is an entry of a queue. Queues belong to a tenant and exist as
+// long as they hold messages.
+type Message struct {
+	ID           int64           `json:"id"`
+	Queue        string          `json:"queue"`
+	TenantID     string          `json:"-"`
+	Data         json.RawMessage `json:"data"`
+	Status       string          `json:"status"`
+	Receipt      string          `json:"receipt,omitempty"`
+	ReceiveCount int             `json:"receive_count"`
+	MaxReceives  int             `json:"max_receives"`
+	EnqueuedAt   time.Time       `json:"enqueued_at"`
+	VisibleAt    time.Time       `json:"visible_at"`
+	ExpiresAt    time.Time       `json:"expires_at"`
+}
+
+// QueueStats counts the messages of a queue by state.
+type QueueStats struct {
+	Queue    string `json:"queue"`
+	Ready    int64  `json:"ready"`
+	Delayed  int64  `json:"delayed"`
+	InFlight int64  `json:"in_flight"`
+	Dead     int64  `json:"dead"`
+}
+
+const messageColumns = `id, queue, tenant_id, data, status, COALESCE(receipt, ''), receive_count, max_receives, enqueued_at, visible_at, expires_at`
+
+func scanMessage(row scanner) (*Message, error) {
+	var (
+		msg  Message
+		data string
+	)
+	err := row.Scan(&msg.ID, &msg.Queue, &msg.TenantID, &data, &msg.Status, &msg.Receipt, &msg.ReceiveCount, &msg.MaxReceives, &msg.EnqueuedAt, &msg.VisibleAt, &msg.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("message not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	msg.Data = json.RawMessage(data)
+	return &msg, nil
+}
+
+// Enqueue adds a message to the end of its queue, refusing it with a "queue
+// is full" error if the queue already holds maxMessages.
+func (db *DB) Enqueue(ctx context.Context, msg *Message, maxMessages int) error {
+	return db.withTx(ctx, func(tx *sql.Tx) error {
+		var count int
+		query := `SELECT COUNT(*) FROM queue_messages WHERE tenant_id = ? AND queue = ?`
+		if err := tx.QueryRowContext(ctx, query, msg.TenantID, msg.Queue).Scan(&count); err != nil {
+			return err
+		}
+		if count >= maxMessages {
+			return fmt.Errorf("queue is full: at most %d messages", maxMessages)
+		}
+
+		result, err := tx.ExecContext(ctx,
+			`INSERT INTO queue_messages (tenant_id, queue, data, status, receive_count, max_receives, enqueued_at, visible_at, expires_at)
+			VALUES (?, ?, ?, ?, 0, ?, ?, ?, ?)`,
+			msg.TenantID, msg.Queue, string(msg.Data), MessageReady, msg.MaxReceives, msg.EnqueuedAt, msg.VisibleAt, msg.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		msg.Status = MessageReady
+		msg.ID, err = result.LastInsertId()
+		return err
+	})
+}
+
+// ReceiveMessages leases up to limit visible messages of a queue, oldest
+// first. Each one gets a new receipt and stays invisible to other consumers
+// until the visibility timeout passes; a consumer that does not acknowledge
+// it in time loses it to the next one. Messages that were already received
+// max_receives times become dead letters instead of being handed out again.
+func (db *DB) ReceiveMessages(ctx context.Context, tenantID, queue string, limit int, visibility time.Duration) ([]*Message, error) {
+	messages := []*Message{}
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now()
+		if _, err := deadLetterMessages(ctx, tx, "tenant_id = ? AND queue = ?", tenantID, queue); err != nil {
+			return err
+		}
+
+		query := `SELECT ` + messageColumns + ` FROM queue_messages
+		WHERE tenant_id = ? AND queue = ? AND status = 'ready' AND visible_at <= ? AND expires_at > ?
+		ORDER BY id LIMIT ?`
+		rows, err := tx.QueryContext(ctx, query, tenantID, queue, now, now, limit)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			msg, err := scanMessage(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			messages = append(messages, msg)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, msg := range messages {
+			receipt, err := utils.GenerateRandomKey()
+			if err != nil {
+				return err
+			}
+			msg.Receipt = receipt
+			msg.ReceiveCount++
+			msg.VisibleAt = now.Add(visibility)
+
+			_, err = tx.ExecContext(ctx, `UPDATE queue_messages SET receipt = ?, receive_count = ?, visible_at = ? WHERE id = ?`,
+				msg.Receipt, msg.ReceiveCount, msg.VisibleAt, msg.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// DeleteMessage acknowledges a message. Leased messages need the receipt of
+// their latest lease; dead letters are deleted without one.
+func (db *DB) DeleteMessage(ctx context.Context, tenantID, queue string, id int64, receipt string) error {
+	query := `DELETE FROM queue_messages WHERE id = ? AND tenant_id = ? AND queue = ? AND `
+	args := []interface{}{id, tenantID, queue}
+	if receipt == "" {
+		query += `status = 'dead'`
+	} else {
+		query += `status = 'ready' AND receipt = ?`
+		args = append(args, receipt)
+	}
+
+	result, err := db.conn.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	return expectRow(result, "message not found")
+}
+
+// ListDeadMessages returns dead letters of a queue with IDs greater than
+// after, oldest first.
+func (db *DB) ListDeadMessages(ctx context.Context, tenantID, queue string, after int64, limit int) ([]*Message, error) {
+	query := `SELECT ` + messageColumns + ` FROM queue_messages
+	WHERE tenant_id = ? AND queue = ? AND status = 'dead' AND id > ?
+	ORDER BY id LIMIT ?`
+	rows, err := db.conn.QueryContext(ctx, query, tenantID, queue, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*Message{}
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// RetryMessage puts a dead letter back at its place in the queue with a
+// fresh receive count.
+func (db *DB) RetryMessage(ctx context.Context, tenantID, queue string, id int64) error {
+	query := `UPDATE queue_messages SET status = 'ready', receipt = NULL, receive_count = 0, visible_at = ?
+	WHERE id = ? AND tenant_id = ? AND queue = ? AND status = 'dead'`
+	result, err := db.conn.ExecContext(ctx, query, time.Now(), id, tenantID, queue)
+	if err != nil {
+		return err
+	}
+	return expectRow(result, "dead message not found")
+}
+
+// ListQueues counts the messages of every queue of a tenant. With a
+// non-empty name only that queue is reported.
+func (db *DB) ListQueues(ctx context.Context, tenantID, name string) ([]*QueueStats, error) {
+	now := time.Now()
+	// Messages whose last lease ran out after their final receive count as
+	// dead already; the next receive or sweep marks them.
+	query := `SELECT queue,
+		COALESCE(SUM(status = 'ready' AND visible_at <= ? AND receive_count < max_receives), 0),
+		COALESCE(SUM(status = 'ready' AND visible_at > ? AND receipt IS NULL), 0),
+		COALESCE(SUM(status = 'ready' AND visible_at > ? AND receipt IS NOT NULL), 0),
+		COALESCE(SUM(status = 'dead' OR (visible_at <= ? AND receive_count >= max_receives)), 0)
+	FROM queue_messages WHERE tenant_id = ? AND expires_at > ?`
+	args := []interface{}{now, now, now, now, tenantID, now}
+	if name != "" {
+		query += ` AND queue = ?`
+		args = append(args, name)
+	}
+	query += ` GROUP BY queue ORDER BY queue`
+
+	rows, err := db.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queues := []*QueueStats{}
+	for rows.Next() {
+		var stats QueueStats
+		if err := rows.Scan(&stats.Queue, &stats.Ready, &stats.Delayed, &stats.InFlight, &stats.Dead); err != nil {
+			return nil, err
+		}
+		queues = append(queues, &stats)
+	}
+	return queues, rows.Err()
+}
+
+// deadLetterMessages turns ready messages that used up their receives and
+// whose last lease ran out into dead letters.
+func deadLetterMessages(ctx context.Context, q execer, cond string, args ...interface{}) (int64, error) {
+	query := `UPDATE queue_messages SET status = 'dead', receipt = NULL
+	WHERE status = 'ready' AND receive_count >= max_receives AND visible_at <= ?`
+	if cond != "" {
+		query += ` AND ` + cond
+	}
+	result, err := q.ExecContext(ctx, query, append([]interface{}{time.Now()}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SweepQueues dead-letters messages whose last lease ran out and deletes
+// messages past their retention.
+func (db *DB) SweepQueues(ctx context.Context) (deadLettered, expired int64, err error) {
+	if deadLettered, err = deadLetterMessages(ctx, db.conn, ""); err != nil {
+		return 0, 0, err
+	}
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM queue_messages WHERE expires_at <= ?`, time.Now())
+	if err != nil {
+		return deadLettered, 0, err
+	}
+	expired, err = result.RowsAffected()
+	return deadLettered, expired, err
+}
+
+func (s *Store) startQueueRoutine() {
+	s.cleanup.Add(1)
+	go func() {
+		defer s.cleanup.Done()
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(s.ctx, 1*time.Minute)
+				deadLettered, expired, err := s.db.SweepQueues(ctx)
+				cancel()
+				if err != nil {
+					log.Printf("queue sweep error: %v", err)
+				} else if deadLettered > 0 || expired > 0 {
+					log.Printf("queue sweep: %d dead-lettered, %d expired", deadLettered, expired)
+				}
+			}
+		}
+	}()
+}
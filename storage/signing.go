@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SigningSecret is an HMAC key used to sign document URLs. Only the newest
+// secret signs; older ones are removed when the secrets are rotated, which
+// invalidates every URL they signed.
+type SigningSecret struct {
+	ID        string
+	Secret    []byte
+	CreatedAt time.Time
+}
+
+func newSigningSecret() (*SigningSecret, error) {
+	b := make([]byte, 36)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate signing secret: %w", err)
+	}
+	return &SigningSecret{
+		ID:        hex.EncodeToString(b[:4]),
+		Secret:    b[4:],
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// ActiveSigningSecret returns the secret new URLs are signed with, creating
+// one if none exists yet.
+func (db *DB) ActiveSigningSecret(ctx context.Context) (*SigningSecret, error) {
+	query := `SELECT id, secret, created_at FROM signing_secrets ORDER BY created_at DESC LIMIT 1`
+	var s SigningSecret
+	err := db.conn.QueryRowContext(ctx, query).Scan(&s.ID, &s.Secret, &s.CreatedAt)
+	if err == sql.ErrNoRows {
+		return db.RotateSigningSecret(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (db *DB) GetSigningSecret(ctx context.Context, id string) (*SigningSecret, error) {
+	query := `SELECT id, secret, created_at FROM signing_secrets WHERE id = ?`
+	var s SigningSecret
+	err := db.conn.QueryRowContext(ctx, query, id).Scan(&s.ID, &s.Secret, &s.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("signing secret not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// ListSigningSecrets returns the IDs and creation times of all secrets,
+// newest first. The secrets themselves are left out.
+func (db *DB) ListSigningSecrets(ctx context.Context) ([]*SigningSecret, error) {
+	rows, err := db.conn.QueryContext(ctx, `SELECT id, created_at FROM signing_secrets ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	secrets := []*SigningSecret{}
+	for rows.Next() {
+		var s SigningSecret
+		if err := rows.Scan(&s.ID, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, &s)
+	}
+	return secrets, rows.Err()
+}
+
+// RotateSigningSecret replaces all signing secrets with a new one. URLs
+// signed with the old secrets stop working immediately.
+func (db *DB) RotateSigningSecret(ctx context.Context) (*SigningSecret, error) {
+	secret, err := newSigningSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM signing_secrets`); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM signed_url_uses`); err != nil {
+		return nil, err
+	}
+	query := `INSERT INTO signing_secrets (id, secret, created_at) VALUES (?, ?, ?)`
+	if _, err := tx.ExecContext(ctx, query, secret.ID, secret.Secret, secret.CreatedAt); err != nil {
+		return nil, err
+	}
+	return secret, tx.Commit()
+}
+
+// ConsumeSignedURLUse counts one use of a signed URL and reports whether it
+// was still within maxUses.
+func (db *DB) ConsumeSignedURLUse(ctx context.Context, signature string, maxUses int, expiresAt time.Time) (bool, error) {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT OR IGNORE INTO signed_url_uses (signature, uses, expires_at) VALUES (?, 0, ?)`
+	if _, err := tx.ExecContext(ctx, query, signature, expiresAt); err != nil {
+		return false, err
+	}
+	result, err := tx.ExecContext(ctx, `UPDATE signed_url_uses SET uses = uses + 1 WHERE signature = ? AND uses < ?`, signature, maxUses)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, tx.Commit()
+}
+
+// DeleteExpiredSignedURLUses forgets use counters of URLs that expired.
+func (db *DB) DeleteExpiredSignedURLUses(ctx context.Context) (int64, error) {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM signed_url_uses WHERE expires_at < ?`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SignedURL describes what a signed URL grants: one method on one document,
+// on behalf of the key that signed it, until it expires. Path is the URL
+// path the signature is bound to, so it cannot be replayed against other
+// routes of the same document.
+type SignedURL struct {
+	Method     string
+	Path       string
+	DocumentID string
+	KeyID      string
+	ExpiresAt  time.Time
+	MaxUses    int
+}
+
+// Query parameters carried by signed URLs.
+const (
+	SignatureParam = "sig"
+	expiresParam   = "exp"
+	keyIDParam     = "by"
+	secretIDParam  = "kid"
+	maxUsesParam   = "max"
+)
+
+func (u *SignedURL) payload(secretID string) string {
+	return strings.Join([]string{
+		u.Method,
+		u.Path,
+		u.DocumentID,
+		u.KeyID,
+		strconv.FormatInt(u.ExpiresAt.Unix(), 10),
+		strconv.Itoa(u.MaxUses),
+		secretID,
+	}, "\n")
+}
+
+func sign(secret *SigningSecret, payload string) string {
+	mac := hmac.New(sha256.New, secret.Secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the query parameters that authorise the request described by u.
+func (u *SignedURL) Sign(secret *SigningSecret) url.Values {
+	values := url.Values{}
+	values.Set(expiresParam, strconv.FormatInt(u.ExpiresAt.Unix(), 10))
+	values.Set(keyIDParam, u.KeyID)
+	values.Set(secretIDParam, secret.ID)
+	if u.MaxUses > 0 {
+		values.Set(maxUsesParam, strconv.Itoa(u.MaxUses))
+	}
+	values.Set(SignatureParam, sign(secret, u.payload(secret.ID)))
+	return values
+}
+
+// parseSignedURL reads the signed URL parameters from a query string. The
+// signature still has to be checked.
+func parseSignedURL(method, path, documentID string, query url.Values) (*SignedURL, error) {
+	exp, err := strconv.ParseInt(query.Get(expiresParam), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exp")
+	}
+	u := &SignedURL{
+		Method:     method,
+		Path:       path,
+		DocumentID: documentID,
+		KeyID:      query.Get(keyIDParam),
+		ExpiresAt:  time.Unix(exp, 0),
+	}
+	if v := query.Get(maxUsesParam); v != "" {
+		if u.MaxUses, err = strconv.Atoi(v); err != nil || u.MaxUses < 1 {
+			return nil, fmt.Errorf("invalid max")
+		}
+	}
+	return u, nil
+}
+
+// SignURL signs a request for method on a document on behalf of the calling
+// key and returns the query parameters to append to the document URL.
+func (s *Store) SignURL(ctx context.Context, perms *Permissions, u *SignedURL) (url.Values, error) {
+	secret, err := s.db.ActiveSigningSecret(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u.KeyID = perms.KeyID
+	return u.Sign(secret), nil
+}
+
+// VerifySignedURL checks the signed URL parameters of a request for method
+// on path, which addresses the document id. A valid signature yields the
+// permissions of the key that signed it, narrowed to that document and
+// method. Invalid, expired or used-up signatures return (nil, nil) like
+// unknown API keys do.
+func (s *Store) VerifySignedURL(ctx context.Context, method, path, id string, query url.Values) (*Permissions, error) {
+	var scope Scope
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		method, scope = http.MethodGet, ScopeDocumentsRead
+	case http.MethodPut:
+		scope = ScopeDocumentsWrite
+	default:
+		return nil, nil
+	}
+
+	id, err := s.db.ResolveDocumentID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	u, err := parseSignedURL(method, path, id, query)
+	if err != nil || time.Now().After(u.ExpiresAt) {
+		return nil, nil
+	}
+
+	secret, err := s.db.GetSigningSecret(ctx, query.Get(secretIDParam))
+	if err != nil {
+		if err.Error() == "signing secret not found" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	signature := query.Get(SignatureParam)
+	if !hmac.Equal([]byte(signature), []byte(sign(secret, u.payload(secret.ID)))) {
+		return nil, nil
+	}
+
+	// The signing key has to still exist: deleting or expiring a key
+	// revokes every URL it signed.
+	var issuer *Permissions
+	if u.KeyID == s.MasterKeyID() && s.config.MasterAPIKey != "" {
+		issuer, err = s.masterPermissions(ctx)
+	} else {
+		var key *ApiKey
+		key, err = s.db.GetApiKeyByID(ctx, u.KeyID)
+		if err == nil {
+			if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+				return nil, nil
+			}
+			issuer = newPermissions(key)
+		}
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !issuer.Has(scope) {
+		return nil, nil
+	}
+
+	if u.MaxUses > 0 {
+		ok, err := s.db.ConsumeSignedURLUse(ctx, signature, u.MaxUses, u.ExpiresAt)
+		if err != nil || !ok {
+			return nil, err
+		}
+	}
+
+	perms := *issuer
+	perms.Scopes = []Scope{scope}
+	perms.DocumentID = id
+	return &perms, nil
+}
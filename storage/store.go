@@ -8,23 +8,31 @@ import (
 	"time"
 
 	"pocketjson/config"
+	"pocketjson/utils"
 )
 
 type apiKeyCacheEntry struct {
-	isValid bool
-	isAdmin bool
+	perms   *Permissions
 	expires time.Time
 }
 
+// keyUsage accumulates requests made with a key between two flushes.
+type keyUsage struct {
+	requests int64
+	lastUsed time.Time
+}
+
 type Store struct {
-	db           *DB
-	config       *config.Config
-	cleanup      sync.WaitGroup
-	ctx          context.Context
-	cancelCtx    context.CancelFunc
-	apiKeyCache  map[string]apiKeyCacheEntry
-	cacheMutex   sync.RWMutex
-	cacheTTL     time.Duration
+	db          *DB
+	config      *config.Config
+	cleanup     sync.WaitGroup
+	ctx         context.Context
+	cancelCtx   context.CancelFunc
+	apiKeyCache map[string]apiKeyCacheEntry
+	cacheMutex  sync.RWMutex
+	cacheTTL    time.Duration
+	usage       map[string]*keyUsage
+	usageMutex  sync.Mutex
 }
 
 func New(db *DB, cfg *config.Config) *Store {
@@ -36,9 +44,28 @@ func New(db *DB, cfg *config.Config) *Store {
 		cancelCtx:   cancel,
 		apiKeyCache: make(map[string]apiKeyCacheEntry),
 		cacheTTL:    5 * time.Minute,
+		usage:       make(map[string]*keyUsage),
+	}
+
+	if cfg.MasterAPIKey != "" {
+		masterID := utils.GetClientPrefix(cfg.MasterAPIKey)
+		if err := db.ReassignCreatorKey(ctx, cfg.MasterAPIKey, masterID); err != nil {
+			log.Printf("failed to migrate master key documents: %v", err)
+		}
+		if err := db.EnsureTenant(ctx, masterID); err != nil {
+			log.Printf("failed to create master tenant: %v", err)
+		}
 	}
+
+	if _, err := db.ActiveSigningSecret(ctx); err != nil {
+		log.Printf("failed to create signing secret: %v", err)
+	}
+
 	s.startCleanupRoutine()
 	s.startCacheCleanupRoutine()
+	s.startUsageFlushRoutine()
+	s.startWebhookRoutine()
+	s.startQueueRoutine()
 	return s
 }
 
@@ -62,6 +89,54 @@ func (s *Store) startCleanupRoutine() {
 				} else if deleted > 0 {
 					log.Printf("cleanup: deleted %d expired entries", deleted)
 				}
+
+				ctx, cancel = context.WithTimeout(s.ctx, 1*time.Minute)
+				if _, err := s.db.ClearExpiredPreviousKeys(ctx); err != nil {
+					log.Printf("cleanup error: %v", err)
+				}
+				if _, err := s.db.DeleteExpiredSignedURLUses(ctx); err != nil {
+					log.Printf("cleanup error: %v", err)
+				}
+				if _, err := s.db.DeleteExpiredLocks(ctx); err != nil {
+					log.Printf("cleanup error: %v", err)
+				}
+				cancel()
+
+				ctx, cancel = context.WithTimeout(s.ctx, 5*time.Minute)
+				if _, err := s.db.DeleteExpiredItems(ctx); err != nil {
+					log.Printf("cleanup error: %v", err)
+				}
+				if _, err := s.db.DeleteExpiredBuckets(ctx); err != nil {
+					log.Printf("cleanup error: %v", err)
+				}
+				cancel()
+
+				var tombstonesBefore time.Time
+				if retention := s.config.ChangesRetention; retention > 0 {
+					tombstonesBefore = time.Now().Add(-retention)
+				}
+				ctx, cancel = context.WithTimeout(s.ctx, 5*time.Minute)
+				if _, err := s.db.CompactChanges(ctx, tombstonesBefore); err != nil {
+					log.Printf("cleanup error: %v", err)
+				}
+				cancel()
+
+				ctx, cancel = context.WithTimeout(s.ctx, 1*time.Minute)
+				if _, err := s.db.DeleteDeliveredBefore(ctx, time.Now().Add(-7*24*time.Hour)); err != nil {
+					log.Printf("cleanup error: %v", err)
+				}
+				cancel()
+
+				if retention := s.config.AuditRetention; retention > 0 {
+					ctx, cancel = context.WithTimeout(s.ctx, 5*time.Minute)
+					pruned, err := s.db.DeleteAuditEventsBefore(ctx, time.Now().Add(-retention))
+					cancel()
+					if err != nil {
+						log.Printf("cleanup error: %v", err)
+					} else if pruned > 0 {
+						log.Printf("cleanup: pruned %d audit events", pruned)
+					}
+				}
 			}
 		}
 	}()
@@ -97,55 +172,185 @@ func (s *Store) cleanExpiredCacheEntries() {
 	}
 }
 
-// ValidateApiKey validates an API key and returns (isValid, isAdmin, error).
+// ValidateApiKey validates an API key and returns the permissions it grants.
 // Uses constant-time comparison for master key and caches results for performance.
-// Returns an error only if database operations fail; authentication failures return (false, false, nil).
-func (s *Store) ValidateApiKey(ctx context.Context, key string) (bool, bool, error) {
-	if len(key) == len(s.config.MasterAPIKey) &&
-		subtle.ConstantTimeCompare([]byte(key), []byte(s.config.MasterAPIKey)) == 1 {
-		return true, true, nil
-	}
-
+// Returns an error only if database operations fail; authentication failures return (nil, nil).
+func (s *Store) ValidateApiKey(ctx context.Context, key string) (*Permissions, error) {
 	if key == "" {
-		return false, false, nil
+		return nil, nil
 	}
 
 	s.cacheMutex.RLock()
 	if cached, found := s.apiKeyCache[key]; found && time.Now().Before(cached.expires) {
 		s.cacheMutex.RUnlock()
-		return cached.isValid, cached.isAdmin, nil
+		return cached.perms, nil
 	}
 	s.cacheMutex.RUnlock()
 
-	isAdmin, _, err := s.db.GetApiKey(ctx, key)
+	if len(key) == len(s.config.MasterAPIKey) &&
+		subtle.ConstantTimeCompare([]byte(key), []byte(s.config.MasterAPIKey)) == 1 {
+		perms, err := s.masterPermissions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.cacheApiKey(key, perms, s.cacheTTL)
+		return perms, nil
+	}
+
+	apiKey, err := s.db.GetApiKey(ctx, key)
 	if err != nil {
 		if err.Error() == "api key not found" {
-			s.cacheApiKey(key, false, false, 30*time.Second)
-			return false, false, nil
+			s.cacheApiKey(key, nil, 30*time.Second)
+			return nil, nil
 		}
 		log.Printf("api key validation error: %v", err)
-		return false, false, err
+		return nil, err
+	}
+
+	perms := newPermissions(apiKey)
+	ttl := s.cacheTTL
+	if until := apiKey.ValidUntil(key); !until.IsZero() && time.Until(until) < ttl {
+		ttl = time.Until(until)
+	}
+	s.cacheApiKey(key, perms, ttl)
+	return perms, nil
+}
+
+// VerifyEditToken checks the edit token of a guest document. A valid token
+// yields permissions to update or delete that document only; anything else
+// returns (nil, nil).
+func (s *Store) VerifyEditToken(ctx context.Context, id, token string) (*Permissions, error) {
+	if token == "" || id == "" {
+		return nil, nil
+	}
+	ok, err := s.db.CheckEditToken(ctx, id, utils.HashToken(token))
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &Permissions{
+		KeyID:      "guest",
+		Scopes:     []Scope{ScopeDocumentsWrite, ScopeDocumentsDelete},
+		DocumentID: id,
+		Guest:      true,
+	}, nil
+}
+
+// masterPermissions builds the permissions of the master key, which is not
+// stored in api_keys but still has a tenant for its own documents.
+func (s *Store) masterPermissions(ctx context.Context) (*Permissions, error) {
+	keyID := s.MasterKeyID()
+	namespace := keyID
+	tenant, err := s.db.GetTenant(ctx, keyID)
+	if err == nil {
+		namespace = tenant.Namespace()
+	} else if err.Error() != "tenant not found" {
+		return nil, err
 	}
 
-	s.cacheApiKey(key, true, isAdmin, s.cacheTTL)
-	return true, isAdmin, nil
+	return &Permissions{
+		KeyID:     keyID,
+		TenantID:  keyID,
+		IsAdmin:   true,
+		Scopes:    AllScopes,
+		namespace: namespace,
+	}, nil
 }
 
-func (s *Store) cacheApiKey(key string, isValid, isAdmin bool, ttl time.Duration) {
+func (s *Store) cacheApiKey(key string, perms *Permissions, ttl time.Duration) {
 	s.cacheMutex.Lock()
 	defer s.cacheMutex.Unlock()
 
 	s.apiKeyCache[key] = apiKeyCacheEntry{
-		isValid: isValid,
-		isAdmin: isAdmin,
+		perms:   perms,
 		expires: time.Now().Add(ttl),
 	}
 }
 
-func (s *Store) InvalidateApiKeyCache(key string) {
+// InvalidateApiKeyCache drops every cached entry belonging to the key with
+// the given public ID. The cache is keyed by secret, so this scans it.
+func (s *Store) InvalidateApiKeyCache(keyID string) {
 	s.cacheMutex.Lock()
 	defer s.cacheMutex.Unlock()
-	delete(s.apiKeyCache, key)
+	for key, entry := range s.apiKeyCache {
+		if entry.perms != nil && entry.perms.KeyID == keyID {
+			delete(s.apiKeyCache, key)
+		}
+	}
+}
+
+// RecordKeyUsage counts a request made with a key. Counters are kept in
+// memory and written to the database in the background, so this is cheap
+// enough to call on every request.
+func (s *Store) RecordKeyUsage(keyID string) {
+	if keyID == "" {
+		return
+	}
+
+	s.usageMutex.Lock()
+	defer s.usageMutex.Unlock()
+
+	u, ok := s.usage[keyID]
+	if !ok {
+		u = &keyUsage{}
+		s.usage[keyID] = u
+	}
+	u.requests++
+	u.lastUsed = time.Now()
+}
+
+func (s *Store) startUsageFlushRoutine() {
+	s.cleanup.Add(1)
+	go func() {
+		defer s.cleanup.Done()
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.ctx.Done():
+				// Flush whatever is left with a fresh context, ours is cancelled.
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				s.flushKeyUsage(ctx)
+				cancel()
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(s.ctx, 1*time.Minute)
+				s.flushKeyUsage(ctx)
+				cancel()
+			}
+		}
+	}()
+}
+
+func (s *Store) flushKeyUsage(ctx context.Context) {
+	s.usageMutex.Lock()
+	pending := s.usage
+	s.usage = make(map[string]*keyUsage)
+	s.usageMutex.Unlock()
+
+	for keyID, u := range pending {
+		if err := s.db.RecordApiKeyUsage(ctx, keyID, u.requests, u.lastUsed); err != nil {
+			log.Printf("failed to record usage of key %s: %v", keyID, err)
+		}
+	}
+}
+
+// InvalidateTenantCache drops the cached permissions of every key in a
+// tenant, e.g. after its slug changed.
+func (s *Store) InvalidateTenantCache(tenantID string) {
+	s.cacheMutex.Lock()
+	defer s.cacheMutex.Unlock()
+	for key, entry := range s.apiKeyCache {
+		if entry.perms != nil && entry.perms.TenantID == tenantID {
+			delete(s.apiKeyCache, key)
+		}
+	}
+}
+
+// MasterKeyID returns the public ID of the master key, which has no row in
+// api_keys.
+func (s *Store) MasterKeyID() string {
+	return utils.GetClientPrefix(s.config.MasterAPIKey)
 }
 
 func (s *Store) DB() *DB {
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"pocketjson/config"
+)
+
+// newTestStore returns a store on a fresh database. Unlike New it starts no
+// background routines, so tests drive them by hand.
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	dsn := filepath.Join(t.TempDir(), "test.db") + "?_fk=1&_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
+	db, err := NewDB(dsn)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Store{
+		db:          db,
+		config:      &config.Config{WebhookMaxAttempts: 3},
+		ctx:         ctx,
+		cancelCtx:   cancel,
+		apiKeyCache: make(map[string]apiKeyCacheEntry),
+		cacheTTL:    time.Minute,
+		usage:       make(map[string]*keyUsage),
+	}
+	t.Cleanup(func() {
+		cancel()
+		db.Close()
+	})
+	return s
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Tenant owns a namespace shared by all of its keys. Custom document IDs are
+// prefixed with the tenant slug when it has one, or with its ID otherwise.
+type Tenant struct {
+	ID          string
+	Slug        string
+	Description string
+	CreatedAt   time.Time
+}
+
+// Namespace returns the prefix used for the tenant's custom document IDs.
+func (t *Tenant) Namespace() string {
+	if t.Slug != "" {
+		return t.Slug
+	}
+	return t.ID
+}
+
+// EnsureTenant creates a tenant without a slug if it does not exist yet.
+func (db *DB) EnsureTenant(ctx context.Context, id string) error {
+	query := `INSERT OR IGNORE INTO tenants (id, created_at) VALUES (?, ?)`
+	_, err := db.conn.ExecContext(ctx, query, id, time.Now())
+	return err
+}
+
+func (db *DB) CreateTenant(ctx context.Context, tenant *Tenant) error {
+	if tenant.Slug != "" {
+		if err := db.checkSlugAvailable(ctx, tenant.ID, tenant.Slug); err != nil {
+			return err
+		}
+	}
+	query := `INSERT INTO tenants (id, slug, description, created_at) VALUES (?, ?, ?, ?)`
+	_, err := db.conn.ExecContext(ctx, query, tenant.ID, nullString(tenant.Slug), tenant.Description, tenant.CreatedAt)
+	return err
+}
+
+const tenantColumns = `id, COALESCE(slug, ''), COALESCE(description, ''), created_at`
+
+func scanTenant(row scanner) (*Tenant, error) {
+	var t Tenant
+	err := row.Scan(&t.ID, &t.Slug, &t.Description, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("tenant not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (db *DB) GetTenant(ctx context.Context, id string) (*Tenant, error) {
+	query := `SELECT ` + tenantColumns + ` FROM tenants WHERE id = ?`
+	return scanTenant(db.conn.QueryRowContext(ctx, query, id))
+}
+
+func (db *DB) ListTenants(ctx context.Context) ([]*Tenant, error) {
+	query := `SELECT ` + tenantColumns + ` FROM tenants ORDER BY created_at, id`
+	rows, err := db.conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tenants := []*Tenant{}
+	for rows.Next() {
+		t, err := scanTenant(rows)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+	return tenants, rows.Err()
+}
+
+// UpdateTenant changes the slug and description of a tenant. Nil arguments
+// are left untouched and an empty slug removes it. Documents keep the ID they
+// were stored under; the slug being replaced stays reserved for the tenant
+// and ResolveDocumentID maps between its old and new prefixes.
+func (db *DB) UpdateTenant(ctx context.Context, id string, slug, description *string) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldSlug string
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(slug, '') FROM tenants WHERE id = ?`, id).Scan(&oldSlug)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("tenant not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	if slug != nil && *slug != oldSlug {
+		if *slug != "" {
+			if err := checkSlugAvailable(ctx, tx, id, *slug); err != nil {
+				return err
+			}
+		}
+		if oldSlug != "" {
+			query := `INSERT OR REPLACE INTO tenant_slugs (slug, tenant_id, retired_at) VALUES (?, ?, ?)`
+			if _, err := tx.ExecContext(ctx, query, oldSlug, id, time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+
+	query := `UPDATE tenants SET
+		slug = CASE WHEN ? THEN ? ELSE slug END,
+		description = COALESCE(?, description)
+	WHERE id = ?`
+	var newSlug interface{}
+	if slug != nil {
+		newSlug = nullString(*slug)
+	}
+	if _, err := tx.ExecContext(ctx, query, slug != nil, newSlug, description, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) checkSlugAvailable(ctx context.Context, tenantID, slug string) error {
+	return checkSlugAvailable(ctx, db.conn, tenantID, slug)
+}
+
+// checkSlugAvailable rejects slugs already used as another tenant's slug or
+// ID, or given up by another tenant, since all of them act as namespace
+// prefixes.
+func checkSlugAvailable(ctx context.Context, q querier, tenantID, slug string) error {
+	query := `SELECT
+		(SELECT COUNT(*) FROM tenants WHERE (slug = ? OR id = ?) AND id != ?) +
+		(SELECT COUNT(*) FROM tenant_slugs WHERE slug = ? AND tenant_id != ?)`
+	var n int
+	if err := q.QueryRowContext(ctx, query, slug, slug, tenantID, slug, tenantID).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("slug already taken")
+	}
+	return nil
+}
+
+// ResolveDocumentID returns the ID a document is stored under. Documents
+// written before their tenant got a slug live under the tenant ID, and later
+// ones under the slug it had at the time; any of the tenant's current or
+// former prefixes resolves to whichever exists, preferring the current one.
+func (db *DB) ResolveDocumentID(ctx context.Context, id string) (string, error) {
+	return resolveDocumentID(ctx, db.conn, id)
+}
+
+func resolveDocumentID(ctx context.Context, q querier, id string) (string, error) {
+	prefix, rest, ok := strings.Cut(id, "_")
+	if !ok {
+		return id, nil
+	}
+
+	var exists bool
+	err := q.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM json_storage WHERE id = ?)`, id).Scan(&exists)
+	if err != nil || exists {
+		return id, err
+	}
+
+	query := `SELECT id, COALESCE(slug, '') FROM tenants
+	WHERE slug = ? OR id = ? OR id = (SELECT tenant_id FROM tenant_slugs WHERE slug = ?)`
+	var tenantID, slug string
+	err = q.QueryRowContext(ctx, query, prefix, prefix, prefix).Scan(&tenantID, &slug)
+	if err == sql.ErrNoRows {
+		return id, nil
+	}
+	if err != nil {
+		return id, err
+	}
+
+	query = `SELECT p.prefix || '_' || ? FROM (
+		SELECT ? AS prefix, 0 AS rank
+		UNION ALL SELECT ?, 1
+		UNION ALL SELECT slug, 2 FROM tenant_slugs WHERE tenant_id = ?
+	) p
+	WHERE p.prefix != '' AND p.prefix != ?
+		AND EXISTS(SELECT 1 FROM json_storage WHERE id = p.prefix || '_' || ?)
+	ORDER BY p.rank LIMIT 1`
+	var alias string
+	err = q.QueryRowContext(ctx, query, rest, slug, tenantID, tenantID, prefix, rest).Scan(&alias)
+	if err == sql.ErrNoRows {
+		return id, nil
+	}
+	if err != nil {
+		return id, err
+	}
+	return alias, nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
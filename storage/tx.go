@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// querier is implemented by both *sql.DB and *sql.Tx, so that document
+// operations can run on their own or as part of a larger transaction.
+type querier interface {
+	execer
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Tx runs document operations inside one transaction. It is handed out by
+// DB.Atomic and offers the same document methods as DB.
+type Tx struct {
+	tx *sql.Tx
+}
+
+// Atomic runs fn in a single transaction that is committed if fn returns
+// nil and rolled back otherwise.
+func (db *DB) Atomic(ctx context.Context, fn func(tx *Tx) error) error {
+	return db.changeDocuments(ctx, func(tx *sql.Tx) error {
+		return fn(&Tx{tx: tx})
+	})
+}
+
+func (t *Tx) CreateJSON(ctx context.Context, id, data string, expiresAt time.Time, creatorKey, tenantID string, visibility Visibility, kind Kind, editTokenHash string) error {
+	return createJSON(ctx, t.tx, id, data, expiresAt, creatorKey, tenantID, visibility, kind, editTokenHash)
+}
+
+func (t *Tx) GetJSON(ctx context.Context, id string) (string, error) {
+	return getJSON(ctx, t.tx, id)
+}
+
+func (t *Tx) GetDocument(ctx context.Context, id string) (*Document, error) {
+	return getDocument(ctx, t.tx, id)
+}
+
+func (t *Tx) ResolveDocumentID(ctx context.Context, id string) (string, error) {
+	return resolveDocumentID(ctx, t.tx, id)
+}
+
+func (t *Tx) UpdateJSON(ctx context.Context, id, data string, expiresAt time.Time) error {
+	return updateJSON(ctx, t.tx, id, data, expiresAt)
+}
+
+func (t *Tx) DeleteJSON(ctx context.Context, id string) error {
+	return deleteJSON(ctx, t.tx, id)
+}
+
+func createJSON(ctx context.Context, q querier, id, data string, expiresAt time.Time, creatorKey, tenantID string, visibility Visibility, kind Kind, editTokenHash string) error {
+	query := `INSERT INTO json_storage (id, data, expires_at, creator_key, tenant_id, visibility, kind, edit_token_hash, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	if _, err := q.ExecContext(ctx, query, id, data, expiresAt, creatorKey, nullString(tenantID), visibility, kind, nullString(editTokenHash), time.Now()); err != nil {
+		return err
+	}
+	return recordDocumentEvent(ctx, q, EventDocumentCreated, "id = ?", id)
+}
+
+func getJSON(ctx context.Context, q querier, id string) (string, error) {
+	id, err := resolveDocumentID(ctx, q, id)
+	if err != nil {
+		return "", err
+	}
+
+	query := `SELECT data FROM json_storage WHERE id = ? AND expires_at > ?`
+	var data string
+	err = q.QueryRowContext(ctx, query, id, time.Now()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("json not found")
+	}
+	if err != nil {
+		return "", err
+	}
+	return data, nil
+}
+
+func getDocument(ctx context.Context, q querier, id string) (*Document, error) {
+	id, err := resolveDocumentID(ctx, q, id)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT ` + documentColumns + ` FROM json_storage WHERE id = ? AND expires_at > ?`
+	return scanDocument(q.QueryRowContext(ctx, query, id, time.Now()))
+}
+
+func updateJSON(ctx context.Context, q querier, id, data string, expiresAt time.Time) error {
+	query := `UPDATE json_storage SET data = ?, expires_at = ?, version = version + 1 WHERE id = ? AND expires_at > ?`
+	result, err := q.ExecContext(ctx, query, data, expiresAt, id, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := expectRow(result, "json not found"); err != nil {
+		return err
+	}
+	return recordDocumentEvent(ctx, q, EventDocumentUpdated, "id = ?", id)
+}
+
+func deleteJSON(ctx context.Context, q querier, id string) error {
+	now := time.Now()
+	if err := recordDocumentEvent(ctx, q, EventDocumentDeleted, "id = ? AND expires_at > ?", id, now); err != nil {
+		return err
+	}
+	result, err := q.ExecContext(ctx, `DELETE FROM json_storage WHERE id = ? AND expires_at > ?`, id, now)
+	if err != nil {
+		return err
+	}
+	return expectRow(result, "json not found")
+}
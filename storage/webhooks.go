@@ -0,0 +1,365 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pocketjson/utils"
+)
+
+// Document lifecycle events delivered to webhooks.
+const (
+	EventDocumentCreated = "document.created"
+	EventDocumentUpdated = "document.updated"
+	EventDocumentDeleted = "document.deleted"
+	EventDocumentExpired = "document.expired"
+)
+
+// AllEvents lists every event a webhook can subscribe to.
+var AllEvents = []string{
+	EventDocumentCreated,
+	EventDocumentUpdated,
+	EventDocumentDeleted,
+	EventDocumentExpired,
+}
+
+// ParseEvents validates event names and removes duplicates. An empty list
+// subscribes to every event.
+func ParseEvents(names []string) ([]string, error) {
+	seen := make(map[string]bool, len(names))
+	events := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		known := false
+		for _, event := range AllEvents {
+			known = known || event == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event %q", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			events = append(events, name)
+		}
+	}
+	return events, nil
+}
+
+// Webhook subscribes a key to lifecycle events of its tenant's documents.
+// Only documents whose custom ID starts with IDPrefix are reported.
+type Webhook struct {
+	ID        string
+	KeyID     string
+	TenantID  string
+	URL       string
+	Secret    string
+	Events    []string
+	IDPrefix  string
+	CreatedAt time.Time
+}
+
+// Delivery states.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// Delivery is one event waiting in, or processed from, the webhook outbox.
+type Delivery struct {
+	ID            int64      `json:"id"`
+	WebhookID     string     `json:"webhook_id"`
+	Event         string     `json:"event"`
+	DocumentID    string     `json:"document_id"`
+	Payload       string     `json:"payload"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+
+	// URL and Secret of the webhook, filled in for pending deliveries.
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+const webhookColumns = `id, key_id, tenant_id, url, secret, events, id_prefix, created_at`
+
+func scanWebhook(row scanner) (*Webhook, error) {
+	var (
+		w      Webhook
+		events string
+	)
+	err := row.Scan(&w.ID, &w.KeyID, &w.TenantID, &w.URL, &w.Secret, &events, &w.IDPrefix, &w.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("webhook not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if events != "" {
+		w.Events = strings.Split(events, ",")
+	}
+	return &w, nil
+}
+
+func (db *DB) CreateWebhook(ctx context.Context, w *Webhook) error {
+	query := `INSERT INTO webhooks (` + webhookColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.conn.ExecContext(ctx, query, w.ID, w.KeyID, w.TenantID, w.URL, w.Secret, strings.Join(w.Events, ","), w.IDPrefix, w.CreatedAt)
+	return err
+}
+
+func (db *DB) GetWebhook(ctx context.Context, id string) (*Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = ?`
+	return scanWebhook(db.conn.QueryRowContext(ctx, query, id))
+}
+
+// ListWebhooks returns the webhooks created by a key.
+func (db *DB) ListWebhooks(ctx context.Context, keyID string) ([]*Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks WHERE key_id = ? ORDER BY created_at`
+	rows, err := db.conn.QueryContext(ctx, query, keyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook removes a webhook along with its deliveries.
+func (db *DB) DeleteWebhook(ctx context.Context, id string) error {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return expectRow(result, "webhook not found")
+}
+
+// DueDeliveries returns up to limit pending deliveries whose next attempt
+// is due, oldest first.
+func (db *DB) DueDeliveries(ctx context.Context, limit int) ([]*Delivery, error) {
+	query := `
+	SELECT d.id, d.webhook_id, d.event, d.document_id, d.payload, d.attempts, d.created_at, w.url, w.secret
+	FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+	WHERE d.status = 'pending' AND d.next_attempt_at <= ?
+	ORDER BY d.id LIMIT ?`
+	rows, err := db.conn.QueryContext(ctx, query, time.Now(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*Delivery
+	for rows.Next() {
+		d := Delivery{Status: DeliveryPending}
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.DocumentID, &d.Payload, &d.Attempts, &d.CreatedAt, &d.URL, &d.Secret); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, rows.Err()
+}
+
+// MarkDelivered records a successful delivery.
+func (db *DB) MarkDelivered(ctx context.Context, id int64) error {
+	query := `UPDATE webhook_deliveries SET status = 'delivered', attempts = attempts + 1, last_error = '', next_attempt_at = NULL, delivered_at = ? WHERE id = ?`
+	_, err := db.conn.ExecContext(ctx, query, time.Now(), id)
+	return err
+}
+
+// MarkFailed records a failed attempt. A zero retryAt moves the delivery to
+// the dead letters.
+func (db *DB) MarkFailed(ctx context.Context, id int64, reason string, retryAt time.Time) error {
+	if retryAt.IsZero() {
+		query := `UPDATE webhook_deliveries SET status = 'dead', attempts = attempts + 1, last_error = ?, next_attempt_at = NULL WHERE id = ?`
+		_, err := db.conn.ExecContext(ctx, query, reason, id)
+		return err
+	}
+	query := `UPDATE webhook_deliveries SET attempts = attempts + 1, last_error = ?, next_attempt_at = ? WHERE id = ?`
+	_, err := db.conn.ExecContext(ctx, query, reason, retryAt, id)
+	return err
+}
+
+// ListDeliveries returns the deliveries of a webhook, newest first,
+// optionally only those with the given status.
+func (db *DB) ListDeliveries(ctx context.Context, webhookID, status string, limit int) ([]*Delivery, error) {
+	query := `
+	SELECT id, webhook_id, event, document_id, payload, status, attempts, next_attempt_at, last_error, created_at, delivered_at
+	FROM webhook_deliveries WHERE webhook_id = ? AND (? = '' OR status = ?)
+	ORDER BY id DESC LIMIT ?`
+	rows, err := db.conn.QueryContext(ctx, query, webhookID, status, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*Delivery{}
+	for rows.Next() {
+		var (
+			d                      Delivery
+			nextAttempt, delivered sql.NullTime
+		)
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.DocumentID, &d.Payload, &d.Status, &d.Attempts, &nextAttempt, &d.LastError, &d.CreatedAt, &delivered); err != nil {
+			return nil, err
+		}
+		d.NextAttemptAt = nullTimePtr(nextAttempt)
+		d.DeliveredAt = nullTimePtr(delivered)
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RetryDelivery puts a dead-lettered delivery back into the outbox.
+func (db *DB) RetryDelivery(ctx context.Context, webhookID string, id int64) error {
+	query := `UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = ? WHERE id = ? AND webhook_id = ? AND status = 'dead'`
+	result, err := db.conn.ExecContext(ctx, query, time.Now(), id, webhookID)
+	if err != nil {
+		return err
+	}
+	return expectRow(result, "dead delivery not found")
+}
+
+// DeleteDeliveredBefore prunes successful deliveries older than cutoff.
+func (db *DB) DeleteDeliveredBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	result, err := db.conn.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE status = 'delivered' AND delivered_at < ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// webhookClient sends webhook deliveries. Receivers get 10 seconds to answer
+// and have to be on a public address, so webhooks cannot be aimed at the
+// server's own network.
+var webhookClient = utils.PublicHTTPClient(10 * time.Second)
+
+func (s *Store) startWebhookRoutine() {
+	s.cleanup.Add(1)
+	go func() {
+		defer s.cleanup.Done()
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				s.deliverWebhooks()
+			}
+		}
+	}()
+}
+
+// deliverWebhooks sends the deliveries that are due, a few at a time.
+func (s *Store) deliverWebhooks() {
+	ctx, cancel := context.WithTimeout(s.ctx, 1*time.Minute)
+	defer cancel()
+
+	deliveries, err := s.db.DueDeliveries(ctx, 50)
+	if err != nil {
+		log.Printf("webhook error: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, 8)
+	for _, d := range deliveries {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(d *Delivery) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			s.deliver(ctx, d)
+		}(d)
+	}
+	wg.Wait()
+}
+
+func (s *Store) deliver(ctx context.Context, d *Delivery) {
+	err := sendDelivery(ctx, d)
+	if s.ctx.Err() != nil {
+		// Shutting down; the attempt is retried on the next start.
+		return
+	}
+
+	if err == nil {
+		err = s.db.MarkDelivered(ctx, d.ID)
+	} else {
+		var retryAt time.Time
+		if d.Attempts+1 < s.config.WebhookMaxAttempts {
+			retryAt = time.Now().Add(webhookBackoff(d.Attempts))
+		} else {
+			log.Printf("webhook delivery %d dead after %d attempts: %v", d.ID, d.Attempts+1, err)
+		}
+		err = s.db.MarkFailed(ctx, d.ID, err.Error(), retryAt)
+	}
+	if err != nil {
+		log.Printf("failed to record webhook delivery %d: %v", d.ID, err)
+	}
+}
+
+// webhookBackoff returns how long to wait after the given number of failed
+// attempts: 30 seconds, doubling up to an hour.
+func webhookBackoff(attempts int) time.Duration {
+	delay := 30 * time.Second
+	for i := 0; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
+
+// sendDelivery posts a delivery to its webhook. The X-PocketJSON-Signature
+// header carries the send time and an HMAC-SHA256 of "<time>.<body>" made
+// with the webhook secret, so receivers can check origin and freshness.
+func sendDelivery(ctx context.Context, d *Delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, strings.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(d.Secret))
+	mac.Write([]byte(timestamp + "." + d.Payload))
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PocketJSON-Webhook")
+	req.Header.Set("X-PocketJSON-Event", d.Event)
+	req.Header.Set("X-PocketJSON-Delivery", strconv.FormatInt(d.ID, 10))
+	req.Header.Set("X-PocketJSON-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// addWebhook subscribes a webhook in tenant "t1" to every event and stores
+// a document, which queues one delivery.
+func addWebhook(t *testing.T, s *Store, url string) *Webhook {
+	t.Helper()
+	ctx := context.Background()
+
+	webhook := &Webhook{
+		ID:        "wh1",
+		KeyID:     "k1",
+		TenantID:  "t1",
+		URL:       url,
+		Secret:    "s3cret",
+		CreatedAt: time.Now(),
+	}
+	if err := s.db.CreateWebhook(ctx, webhook); err != nil {
+		t.Fatalf("failed to create webhook: %v", err)
+	}
+	if err := s.db.EnsureTenant(ctx, "t1"); err != nil {
+		t.Fatalf("failed to create tenant: %v", err)
+	}
+	if err := s.db.CreateJSON(ctx, "t1_doc", `{"a":1}`, time.Now().Add(time.Hour), "k1", "t1", VisibilityPublic, KindDocument, ""); err != nil {
+		t.Fatalf("failed to create document: %v", err)
+	}
+	return webhook
+}
+
+func TestWebhookRefusesNonPublicAddresses(t *testing.T) {
+	s := newTestStore(t)
+
+	var reached atomic.Bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Store(true)
+	}))
+	defer receiver.Close()
+
+	webhook := addWebhook(t, s, receiver.URL)
+	s.deliverWebhooks()
+
+	if reached.Load() {
+		t.Fatal("delivery reached a loopback receiver")
+	}
+	deliveries, err := s.db.ListDeliveries(context.Background(), webhook.ID, "", 10)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("ListDeliveries = %d deliveries, %v", len(deliveries), err)
+	}
+	if d := deliveries[0]; d.Status != DeliveryPending || d.Attempts != 1 || !strings.Contains(d.LastError, "non-public address") {
+		t.Errorf("delivery = %s after %d attempts (%q), want a refused attempt", d.Status, d.Attempts, d.LastError)
+	}
+}
+
+// allowLoopbackWebhooks lets deliveries reach httptest servers, which
+// listen on loopback addresses the real client refuses.
+func allowLoopbackWebhooks(t *testing.T) {
+	t.Helper()
+	previous := webhookClient
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+	t.Cleanup(func() { webhookClient = previous })
+}
+
+func TestWebhookDeliverySignature(t *testing.T) {
+	s := newTestStore(t)
+	allowLoopbackWebhooks(t)
+
+	var (
+		mu      sync.Mutex
+		headers http.Header
+		body    []byte
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		headers = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer receiver.Close()
+
+	webhook := addWebhook(t, s, receiver.URL)
+	s.deliverWebhooks()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if body == nil {
+		t.Fatal("receiver got no delivery")
+	}
+
+	var payload struct {
+		Event      string `json:"event"`
+		DocumentID string `json:"document_id"`
+		TenantID   string `json:"tenant_id"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("invalid payload %q: %v", body, err)
+	}
+	if payload.Event != EventDocumentCreated || payload.DocumentID != "t1_doc" || payload.TenantID != "t1" {
+		t.Errorf("payload = %+v", payload)
+	}
+	if got := headers.Get("X-PocketJSON-Event"); got != EventDocumentCreated {
+		t.Errorf("X-PocketJSON-Event = %q", got)
+	}
+	if got := headers.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+
+	// t=<unix time>,v1=<hex HMAC-SHA256 of "<time>.<body>">
+	signature := headers.Get("X-PocketJSON-Signature")
+	timestamp, mac, ok := strings.Cut(signature, ",")
+	if !ok || !strings.HasPrefix(timestamp, "t=") || !strings.HasPrefix(mac, "v1=") {
+		t.Fatalf("X-PocketJSON-Signature = %q", signature)
+	}
+	expected := hmac.New(sha256.New, []byte(webhook.Secret))
+	expected.Write([]byte(strings.TrimPrefix(timestamp, "t=") + "." + string(body)))
+	if strings.TrimPrefix(mac, "v1=") != hex.EncodeToString(expected.Sum(nil)) {
+		t.Errorf("signature %q does not match the body", signature)
+	}
+
+	deliveries, err := s.db.ListDeliveries(context.Background(), webhook.ID, "", 10)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("ListDeliveries = %d deliveries, %v", len(deliveries), err)
+	}
+	if d := deliveries[0]; d.Status != DeliveryDelivered || d.Attempts != 1 || d.DeliveredAt == nil {
+		t.Errorf("delivery = %s after %d attempts, want delivered after 1", d.Status, d.Attempts)
+	}
+	if got := headers.Get("X-PocketJSON-Delivery"); got != "1" {
+		t.Errorf("X-PocketJSON-Delivery = %q, want 1", got)
+	}
+}
+
+func TestWebhookRetriesUntilDeadLetter(t *testing.T) {
+	s := newTestStore(t)
+	allowLoopbackWebhooks(t)
+	ctx := context.Background()
+
+	var failing atomic.Bool
+	failing.Store(true)
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+
+	webhook := addWebhook(t, s, receiver.URL)
+	delivery := func() *Delivery {
+		t.Helper()
+		deliveries, err := s.db.ListDeliveries(ctx, webhook.ID, "", 10)
+		if err != nil || len(deliveries) != 1 {
+			t.Fatalf("ListDeliveries = %d deliveries, %v", len(deliveries), err)
+		}
+		return deliveries[0]
+	}
+	makeDue := func() {
+		t.Helper()
+		if _, err := s.db.conn.ExecContext(ctx, `UPDATE webhook_deliveries SET next_attempt_at = ?`, time.Now()); err != nil {
+			t.Fatalf("failed to make delivery due: %v", err)
+		}
+	}
+
+	start := time.Now()
+	s.deliverWebhooks()
+	d := delivery()
+	if d.Status != DeliveryPending || d.Attempts != 1 || !strings.Contains(d.LastError, "500") {
+		t.Fatalf("after a failure: %s, %d attempts, %q", d.Status, d.Attempts, d.LastError)
+	}
+	if d.NextAttemptAt == nil || d.NextAttemptAt.Before(start.Add(29*time.Second)) || d.NextAttemptAt.After(time.Now().Add(31*time.Second)) {
+		t.Errorf("next attempt at %v, want about 30 seconds after the failure", d.NextAttemptAt)
+	}
+
+	// Not due yet, so nothing is sent.
+	s.deliverWebhooks()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("receiver called %d times before the retry was due, want 1", n)
+	}
+
+	// WebhookMaxAttempts is 3: the third failure dead-letters the delivery.
+	makeDue()
+	s.deliverWebhooks()
+	makeDue()
+	s.deliverWebhooks()
+	d = delivery()
+	if d.Status != DeliveryDead || d.Attempts != 3 || d.NextAttemptAt != nil {
+		t.Fatalf("after 3 failures: %s, %d attempts, next attempt %v", d.Status, d.Attempts, d.NextAttemptAt)
+	}
+
+	// Dead letters stay put until retried by hand.
+	makeDue()
+	s.deliverWebhooks()
+	if n := calls.Load(); n != 3 {
+		t.Errorf("receiver called %d times, want 3", n)
+	}
+
+	failing.Store(false)
+	if err := s.db.RetryDelivery(ctx, webhook.ID, d.ID); err != nil {
+		t.Fatalf("RetryDelivery: %v", err)
+	}
+	s.deliverWebhooks()
+	if d = delivery(); d.Status != DeliveryDelivered {
+		t.Errorf("after a manual retry: %s, want delivered", d.Status)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, time.Hour},
+		{50, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
@@ -19,3 +19,10 @@ func GetClientPrefix(apiKey string) string {
 	hash := sha256.Sum256([]byte(apiKey))
 	return fmt.Sprintf("%x", hash)[:10]
 }
+
+// HashToken returns the hex SHA-256 of a secret token, the form in which
+// tokens are stored.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
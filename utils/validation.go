@@ -10,3 +10,13 @@ func IsValidCustomID(id string) bool {
 	}
 	return customIDPattern.MatchString(id)
 }
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,31}$`)
+var hexIDPattern = regexp.MustCompile(`^[0-9a-f]{10}$`)
+
+// IsValidSlug reports whether s can be used as a tenant slug. Slugs become
+// document ID prefixes, so they cannot contain underscores or look like the
+// hex IDs generated for tenants without a slug.
+func IsValidSlug(s string) bool {
+	return slugPattern.MatchString(s) && !hexIDPattern.MatchString(s)
+}